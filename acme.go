@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/models"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns an autocert.Manager which obtains certificates for
+// the configured domains from an ACME certificate authority, keeping them in
+// the database so every server process shares them. Certificates are
+// obtained during the first handshake for a domain and renewed by the manager
+// before they expire.
+func newACMEManager(acmeConfig config.ACME, db models.Datastore) (*autocert.Manager, error) {
+	httpClient := http.DefaultClient
+	if acmeConfig.CAFile != "" {
+		// Trust a private CA, such as the one a local Pebble test server uses
+		var err error
+		httpClient, err = httpClientTrusting(acmeConfig.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      acmeCache{db},
+		HostPolicy: autocert.HostWhitelist(acmeConfig.Domains...),
+		Email:      acmeConfig.Email,
+		Client: &acme.Client{
+			DirectoryURL: acmeConfig.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+// acmeCache is an autocert.Cache which stores certificates and the ACME
+// account key in the database
+type acmeCache struct {
+	db models.Datastore
+}
+
+func (c acmeCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.db.GetACMECacheEntry(ctx, key)
+	if err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (c acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.db.PutACMECacheEntry(ctx, key, data)
+}
+
+func (c acmeCache) Delete(ctx context.Context, key string) error {
+	return c.db.DeleteACMECacheEntry(ctx, key)
+}
+
+// withDefaultServerName gives handshakes from clients which don't send SNI,
+// and the readiness check, the certificate for defaultName rather than failing
+func withDefaultServerName(defaultName string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			withName := *hello
+			withName.ServerName = defaultName
+			hello = &withName
+		}
+		return getCertificate(hello)
+	}
+}
+
+// httpClientTrusting returns an HTTP client which trusts the certificates in
+// caFile as well as the system's root certificates
+func httpClientTrusting(caFile string) (*http.Client, error) {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return &http.Client{Transport: transport}, nil
+}
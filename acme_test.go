@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMECache(t *testing.T) {
+	ctx := context.Background()
+	cache := acmeCache{fakedb.New()}
+
+	if _, err := cache.Get(ctx, "teamserver.test"); err != autocert.ErrCacheMiss {
+		t.Errorf("expected autocert.ErrCacheMiss, got %v", err)
+	}
+	if err := cache.Put(ctx, "teamserver.test", []byte("certificate")); err != nil {
+		t.Fatalf("error storing: %v", err)
+	}
+	if data, err := cache.Get(ctx, "teamserver.test"); err != nil || string(data) != "certificate" {
+		t.Errorf("expected stored data, got %q, %v", data, err)
+	}
+	if err := cache.Delete(ctx, "teamserver.test"); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+	if _, err := cache.Get(ctx, "teamserver.test"); err != autocert.ErrCacheMiss {
+		t.Errorf("expected autocert.ErrCacheMiss after deleting, got %v", err)
+	}
+}
+
+func TestACMEManagerRefusesOtherDomains(t *testing.T) {
+	db := fakedb.New()
+	manager, err := newACMEManager(config.ACME{
+		DirectoryURL: "https://127.0.0.1:1/dir", // never contacted
+		Domains:      []string{"teamserver.test"},
+	}, db)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Error("expected no certificate for a domain which isn't configured")
+	}
+}
+
+// TestACMEWithPebble obtains a certificate from a Pebble test CA, then checks
+// a second manager sharing the database serves it without asking the CA. Run
+// Pebble with PEBBLE_VA_ALWAYS_VALID=1 so it doesn't need to reach the test,
+// and set TEAMSERVER_TEST_PEBBLE_DIRECTORY_URL (e.g.
+// https://localhost:14000/dir) and TEAMSERVER_TEST_PEBBLE_CA_FILE to Pebble's
+// certificate.
+func TestACMEWithPebble(t *testing.T) {
+	directoryURL := os.Getenv("TEAMSERVER_TEST_PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("TEAMSERVER_TEST_PEBBLE_DIRECTORY_URL isn't set")
+	}
+	acmeConfig := config.ACME{
+		DirectoryURL: directoryURL,
+		Domains:      []string{"teamserver.test"},
+		Challenge:    "tls-alpn-01",
+		CAFile:       os.Getenv("TEAMSERVER_TEST_PEBBLE_CA_FILE"),
+	}
+	db := fakedb.New()
+	manager, err := newACMEManager(acmeConfig, db)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+
+	cert, err := withDefaultServerName("teamserver.test", manager.GetCertificate)(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("error obtaining certificate: %v", err)
+	}
+	checkCertificateFor(t, cert, "teamserver.test")
+	if db.Called("PutACMECacheEntry") == 0 {
+		t.Error("expected certificate to be stored in the database")
+	}
+
+	acmeConfig.DirectoryURL = "https://127.0.0.1:1/dir" // never contacted
+	cached, err := newACMEManager(acmeConfig, db)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	cert, err = cached.GetCertificate(&tls.ClientHelloInfo{ServerName: "teamserver.test"})
+	if err != nil {
+		t.Fatalf("error getting stored certificate: %v", err)
+	}
+	checkCertificateFor(t, cert, "teamserver.test")
+}
+
+func checkCertificateFor(t *testing.T, cert *tls.Certificate, domain string) {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("expected certificate for %s: %v", domain, err)
+	}
+}
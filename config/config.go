@@ -0,0 +1,546 @@
+// Package config loads the teamserver's settings from a TOML file, with
+// environment variables overriding anything set in the file.
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fluidkeys/teamserver/logging"
+)
+
+// DefaultFile is read if TEAMSERVER_CONFIG doesn't name a config file. It's
+// fine for it not to exist.
+const DefaultFile = "teamserver.toml"
+
+const redacted = "REDACTED"
+
+// Config holds every setting for the teamserver
+type Config struct {
+	Database   Database   `toml:"database"`
+	Server     Server     `toml:"server"`
+	TLS        TLS        `toml:"tls"`
+	RateLimits RateLimits `toml:"rate_limits"`
+	KeyPolicy  KeyPolicy  `toml:"key_policy"`
+	Features   Features   `toml:"features"`
+	Logging    Logging    `toml:"logging"`
+	Tracing    Tracing    `toml:"tracing"`
+}
+
+// Database configures the connection to Postgres. If URL is set (as Heroku
+// does with DATABASE_URL) the other settings are ignored.
+type Database struct {
+	URL      string `toml:"url"`
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	Name     string `toml:"name"`
+	SSLMode  string `toml:"sslmode"`
+}
+
+// Server configures the HTTP listener
+type Server struct {
+	ListenAddress     string   `toml:"listen_address"`
+	ReadTimeout       Duration `toml:"read_timeout"`
+	ReadHeaderTimeout Duration `toml:"read_header_timeout"`
+	WriteTimeout      Duration `toml:"write_timeout"`
+	IdleTimeout       Duration `toml:"idle_timeout"`
+	ShutdownTimeout   Duration `toml:"shutdown_timeout"`
+	RequestTimeout    Duration `toml:"request_timeout"`
+	MaxHeaderBytes    int      `toml:"max_header_bytes"`
+	MaxBodyBytes      int64    `toml:"max_body_bytes"`
+}
+
+// TLS configures serving HTTPS directly rather than behind a proxy. It's
+// disabled unless both files are given or ACME is enabled.
+type TLS struct {
+	CertFile        string   `toml:"cert_file"`
+	KeyFile         string   `toml:"key_file"`
+	RedirectAddress string   `toml:"redirect_address"`
+	HSTSMaxAge      Duration `toml:"hsts_max_age"`
+	ACME            ACME     `toml:"acme"`
+}
+
+// ACME configures obtaining and renewing certificates automatically from a
+// certificate authority such as Let's Encrypt. They're kept in the database.
+type ACME struct {
+	Enabled      bool     `toml:"enabled"`
+	DirectoryURL string   `toml:"directory_url"`
+	Email        string   `toml:"email"`
+	Domains      []string `toml:"domains"`
+	Challenge    string   `toml:"challenge"`
+	CAFile       string   `toml:"ca_file"`
+}
+
+// RateLimits configures how many requests clients can make to the public
+// endpoints which write to the database or parse posted OpenPGP data. Each client IP address and each
+// public key gets its own allowance. Routes overrides the default limit for
+// particular routes, keyed by method and unversioned pattern such as
+// "POST /teams".
+type RateLimits struct {
+	Enabled           bool                 `toml:"enabled"`
+	RequestsPerMinute int                  `toml:"requests_per_minute"`
+	Burst             int                  `toml:"burst"`
+	Store             string               `toml:"store"`
+	TrustForwardedFor bool                 `toml:"trust_forwarded_for"`
+	Routes            map[string]RateLimit `toml:"routes"`
+}
+
+// A RateLimit allows RequestsPerMinute on average, with up to Burst at once
+type RateLimit struct {
+	RequestsPerMinute int `toml:"requests_per_minute"`
+	Burst             int `toml:"burst"`
+}
+
+// KeyPolicy configures which public keys the teamserver accepts and how it
+// monitors them
+type KeyPolicy struct {
+	MinRSABits          int      `toml:"min_rsa_bits"`
+	ExpiryCheckInterval Duration `toml:"expiry_check_interval"`
+}
+
+// Logging configures the server's log output
+type Logging struct {
+	Level string `toml:"level"`
+}
+
+// Tracing configures where spans recording the time taken to serve requests
+// are sent. Exporter is "none", "stdout" for trying tracing out locally, or
+// "otlp" to send spans to an OpenTelemetry collector at OTLPEndpoint.
+type Tracing struct {
+	Exporter     string `toml:"exporter"`
+	OTLPEndpoint string `toml:"otlp_endpoint"`
+	ServiceName  string `toml:"service_name"`
+}
+
+// Features turns optional behaviour on and off
+type Features struct {
+	KeyExpiryMonitor bool `toml:"key_expiry_monitor"`
+	LegacyRoutes     bool `toml:"legacy_routes"`
+	Metrics          bool `toml:"metrics"`
+}
+
+// Duration is a time.Duration written in config files as a string such as
+// "6h" or "30m"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration string such as "6h"
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MarshalText writes the duration as a string such as "6h0m0s"
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Default returns the settings used for anything not set in the config file or
+// environment
+func Default() *Config {
+	return &Config{
+		Database: Database{
+			Host:    "localhost",
+			Port:    5432,
+			User:    "teamserver",
+			Name:    "teamserver_development",
+			SSLMode: "disable",
+		},
+		Server: Server{
+			ListenAddress:     ":4747",
+			ReadTimeout:       Duration{15 * time.Second},
+			ReadHeaderTimeout: Duration{5 * time.Second},
+			WriteTimeout:      Duration{30 * time.Second},
+			IdleTimeout:       Duration{2 * time.Minute},
+			ShutdownTimeout:   Duration{25 * time.Second},
+			RequestTimeout:    Duration{20 * time.Second},
+			MaxHeaderBytes:    64 << 10,
+			MaxBodyBytes:      1 << 20,
+		},
+		TLS: TLS{
+			HSTSMaxAge: Duration{365 * 24 * time.Hour},
+			ACME: ACME{
+				DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+				Domains:      []string{},
+				Challenge:    "http-01",
+			},
+		},
+		RateLimits: RateLimits{
+			Enabled:           true,
+			RequestsPerMinute: 60,
+			Burst:             10,
+			Store:             "memory",
+			Routes: map[string]RateLimit{
+				"POST /teams": {RequestsPerMinute: 5, Burst: 5},
+			},
+		},
+		KeyPolicy: KeyPolicy{
+			MinRSABits:          2048,
+			ExpiryCheckInterval: Duration{6 * time.Hour},
+		},
+		Features: Features{
+			KeyExpiryMonitor: true,
+			LegacyRoutes:     true,
+			Metrics:          true,
+		},
+		Logging: Logging{
+			Level: "info",
+		},
+		Tracing: Tracing{
+			Exporter:     "none",
+			OTLPEndpoint: "http://localhost:4318",
+			ServiceName:  "teamserver",
+		},
+	}
+}
+
+// Load reads the config file named by TEAMSERVER_CONFIG (or DefaultFile if it
+// exists), applies environment overrides and validates the result.
+func Load() (*Config, error) {
+	config := Default()
+
+	filename, present := os.LookupEnv("TEAMSERVER_CONFIG")
+	if !present {
+		filename = DefaultFile
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) && !present {
+		// no config file: run on defaults and environment
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer file.Close()
+		if err = config.read(file); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+
+	if err = config.applyEnvironment(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) read(r io.Reader) error {
+	metadata, err := toml.DecodeReader(r, c)
+	if err != nil {
+		return err
+	}
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		keys := []string{}
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown settings: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// applyEnvironment overrides settings with any environment variables that are
+// set. The DATABASE_URL and PORT variables set by Heroku are honoured.
+func (c *Config) applyEnvironment(lookupEnv func(string) (string, bool)) error {
+	texts := map[string]*string{
+		"DATABASE_URL":                    &c.Database.URL,
+		"TEAMSERVER_DB_HOST":              &c.Database.Host,
+		"TEAMSERVER_DB_USER":              &c.Database.User,
+		"TEAMSERVER_PASSWORD":             &c.Database.Password,
+		"TEAMSERVER_DB_NAME":              &c.Database.Name,
+		"TEAMSERVER_DB_SSLMODE":           &c.Database.SSLMode,
+		"TEAMSERVER_LISTEN_ADDRESS":       &c.Server.ListenAddress,
+		"TEAMSERVER_TLS_CERT_FILE":        &c.TLS.CertFile,
+		"TEAMSERVER_TLS_KEY_FILE":         &c.TLS.KeyFile,
+		"TEAMSERVER_TLS_REDIRECT_ADDRESS": &c.TLS.RedirectAddress,
+		"TEAMSERVER_ACME_DIRECTORY_URL":   &c.TLS.ACME.DirectoryURL,
+		"TEAMSERVER_ACME_EMAIL":           &c.TLS.ACME.Email,
+		"TEAMSERVER_ACME_CHALLENGE":       &c.TLS.ACME.Challenge,
+		"TEAMSERVER_ACME_CA_FILE":         &c.TLS.ACME.CAFile,
+		"TEAMSERVER_RATE_LIMIT_STORE":     &c.RateLimits.Store,
+		"TEAMSERVER_LOG_LEVEL":            &c.Logging.Level,
+		"TEAMSERVER_TRACING_EXPORTER":     &c.Tracing.Exporter,
+		"OTEL_EXPORTER_OTLP_ENDPOINT":     &c.Tracing.OTLPEndpoint,
+		"OTEL_SERVICE_NAME":               &c.Tracing.ServiceName,
+	}
+	ints := map[string]*int{
+		"TEAMSERVER_DB_PORT":                        &c.Database.Port,
+		"TEAMSERVER_MAX_HEADER_BYTES":               &c.Server.MaxHeaderBytes,
+		"TEAMSERVER_RATE_LIMIT_REQUESTS_PER_MINUTE": &c.RateLimits.RequestsPerMinute,
+		"TEAMSERVER_RATE_LIMIT_BURST":               &c.RateLimits.Burst,
+		"TEAMSERVER_KEY_MIN_RSA_BITS":               &c.KeyPolicy.MinRSABits,
+	}
+	bools := map[string]*bool{
+		"TEAMSERVER_ACME_ENABLED":                   &c.TLS.ACME.Enabled,
+		"TEAMSERVER_RATE_LIMIT_ENABLED":             &c.RateLimits.Enabled,
+		"TEAMSERVER_RATE_LIMIT_TRUST_FORWARDED_FOR": &c.RateLimits.TrustForwardedFor,
+		"TEAMSERVER_FEATURE_KEY_EXPIRY_MONITOR":     &c.Features.KeyExpiryMonitor,
+		"TEAMSERVER_FEATURE_LEGACY_ROUTES":          &c.Features.LegacyRoutes,
+		"TEAMSERVER_FEATURE_METRICS":                &c.Features.Metrics,
+	}
+	durations := map[string]*Duration{
+		"TEAMSERVER_KEY_EXPIRY_CHECK_INTERVAL": &c.KeyPolicy.ExpiryCheckInterval,
+		"TEAMSERVER_TLS_HSTS_MAX_AGE":          &c.TLS.HSTSMaxAge,
+		"TEAMSERVER_READ_TIMEOUT":              &c.Server.ReadTimeout,
+		"TEAMSERVER_READ_HEADER_TIMEOUT":       &c.Server.ReadHeaderTimeout,
+		"TEAMSERVER_WRITE_TIMEOUT":             &c.Server.WriteTimeout,
+		"TEAMSERVER_IDLE_TIMEOUT":              &c.Server.IdleTimeout,
+		"TEAMSERVER_SHUTDOWN_TIMEOUT":          &c.Server.ShutdownTimeout,
+		"TEAMSERVER_REQUEST_TIMEOUT":           &c.Server.RequestTimeout,
+	}
+
+	for name, setting := range texts {
+		if value, ok := lookupEnv(name); ok {
+			*setting = value
+		}
+	}
+	if domains, ok := lookupEnv("TEAMSERVER_ACME_DOMAINS"); ok {
+		c.TLS.ACME.Domains = []string{}
+		for _, domain := range strings.Split(domains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				c.TLS.ACME.Domains = append(c.TLS.ACME.Domains, domain)
+			}
+		}
+	}
+	if port, ok := lookupEnv("PORT"); ok {
+		c.Server.ListenAddress = ":" + port
+	}
+	for name, setting := range ints {
+		if value, ok := lookupEnv(name); ok {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: expected an integer, got %q", name, value)
+			}
+			*setting = i
+		}
+	}
+	if value, ok := lookupEnv("TEAMSERVER_MAX_BODY_BYTES"); ok {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("TEAMSERVER_MAX_BODY_BYTES: expected an integer, got %q", value)
+		}
+		c.Server.MaxBodyBytes = i
+	}
+	for name, setting := range bools {
+		if value, ok := lookupEnv(name); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: expected true or false, got %q", name, value)
+			}
+			*setting = b
+		}
+	}
+	for name, setting := range durations {
+		if value, ok := lookupEnv(name); ok {
+			if err := setting.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("%s: expected a duration such as 6h, got %q", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the settings make sense together, returning an error listing
+// every problem found
+func (c *Config) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Database.URL != "" {
+		if _, err := url.Parse(c.Database.URL); err != nil {
+			problem("database.url: %v", err)
+		}
+	} else {
+		if c.Database.Host == "" {
+			problem("database.host: must be set")
+		}
+		if c.Database.Port < 1 || c.Database.Port > 65535 {
+			problem("database.port: %d is not a valid port", c.Database.Port)
+		}
+		if c.Database.User == "" {
+			problem("database.user: must be set")
+		}
+		if c.Database.Name == "" {
+			problem("database.name: must be set")
+		}
+		switch c.Database.SSLMode {
+		case "disable", "require", "verify-ca", "verify-full":
+		default:
+			problem("database.sslmode: must be one of disable, require, verify-ca or verify-full, got %q", c.Database.SSLMode)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddress); err != nil {
+		problem("server.listen_address: %v", err)
+	}
+
+	for name, timeout := range map[string]Duration{
+		"read_timeout":        c.Server.ReadTimeout,
+		"read_header_timeout": c.Server.ReadHeaderTimeout,
+		"write_timeout":       c.Server.WriteTimeout,
+		"idle_timeout":        c.Server.IdleTimeout,
+		"shutdown_timeout":    c.Server.ShutdownTimeout,
+		"request_timeout":     c.Server.RequestTimeout,
+	} {
+		if timeout.Duration <= 0 {
+			problem("server.%s: must be positive", name)
+		}
+	}
+	if c.Server.RequestTimeout.Duration > c.Server.WriteTimeout.Duration {
+		problem("server.request_timeout: must not be longer than write_timeout, or responses to slow requests can't be written")
+	}
+	if c.Server.MaxHeaderBytes < 1024 {
+		problem("server.max_header_bytes: must be at least 1024")
+	}
+	if c.Server.MaxBodyBytes < 1024 {
+		problem("server.max_body_bytes: must be at least 1024")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problem("tls: cert_file and key_file must be set together")
+	}
+	if c.TLS.RedirectAddress != "" {
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectAddress); err != nil {
+			problem("tls.redirect_address: %v", err)
+		}
+		if !c.TLSEnabled() {
+			problem("tls.redirect_address: redirecting to HTTPS needs a certificate or ACME")
+		}
+	}
+	if c.TLS.HSTSMaxAge.Duration < 0 {
+		problem("tls.hsts_max_age: must not be negative")
+	}
+	if c.TLS.ACME.Enabled {
+		if c.TLS.CertFile != "" {
+			problem("tls.acme: can't be enabled as well as tls.cert_file")
+		}
+		if _, err := url.Parse(c.TLS.ACME.DirectoryURL); err != nil || c.TLS.ACME.DirectoryURL == "" {
+			problem("tls.acme.directory_url: must be a URL")
+		}
+		if len(c.TLS.ACME.Domains) == 0 {
+			problem("tls.acme.domains: must list at least one domain")
+		}
+		switch c.TLS.ACME.Challenge {
+		case "http-01", "tls-alpn-01":
+		default:
+			problem("tls.acme.challenge: must be http-01 or tls-alpn-01, got %q", c.TLS.ACME.Challenge)
+		}
+		if c.TLS.ACME.Challenge == "http-01" && c.TLS.RedirectAddress == "" {
+			problem("tls.acme.challenge: http-01 needs tls.redirect_address to answer challenges over HTTP")
+		}
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ACME.CAFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problem("tls: %v", err)
+		}
+	}
+
+	if c.RateLimits.Enabled {
+		if c.RateLimits.RequestsPerMinute < 1 {
+			problem("rate_limits.requests_per_minute: must be at least 1")
+		}
+		if c.RateLimits.Burst < 1 {
+			problem("rate_limits.burst: must be at least 1")
+		}
+		if c.RateLimits.Store != "memory" && c.RateLimits.Store != "postgres" {
+			problem("rate_limits.store: must be memory or postgres, got %q", c.RateLimits.Store)
+		}
+		for route, limit := range c.RateLimits.Routes {
+			if limit.RequestsPerMinute < 1 {
+				problem("rate_limits.routes.%q.requests_per_minute: must be at least 1", route)
+			}
+			if limit.Burst < 1 {
+				problem("rate_limits.routes.%q.burst: must be at least 1", route)
+			}
+		}
+	}
+
+	if c.KeyPolicy.MinRSABits < 1024 {
+		problem("key_policy.min_rsa_bits: must be at least 1024")
+	}
+	if c.KeyPolicy.ExpiryCheckInterval.Duration < time.Minute {
+		problem("key_policy.expiry_check_interval: must be at least 1m")
+	}
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		problem("logging.level: %v", err)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if endpoint, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || endpoint.Host == "" {
+			problem("tracing.otlp_endpoint: must be a URL such as http://localhost:4318")
+		}
+	default:
+		problem("tracing.exporter: must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.ServiceName == "" {
+		problem("tracing.service_name: must be set")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// DatabaseDSN returns the data source name for connecting to Postgres. Unless
+// database.url is set it's built as a postgres:// URL, so values containing
+// spaces, quotes or other special characters are escaped.
+func (c *Config) DatabaseDSN() string {
+	if c.Database.URL != "" {
+		return c.Database.URL
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(c.Database.Host, strconv.Itoa(c.Database.Port)),
+		Path:     "/" + c.Database.Name,
+		RawQuery: url.Values{"sslmode": {c.Database.SSLMode}}.Encode(),
+	}
+	if c.Database.Password != "" {
+		dsn.User = url.UserPassword(c.Database.User, c.Database.Password)
+	} else if c.Database.User != "" {
+		dsn.User = url.User(c.Database.User)
+	}
+	return dsn.String()
+}
+
+// TLSEnabled returns true if the server should serve HTTPS itself
+func (c *Config) TLSEnabled() bool {
+	return (c.TLS.CertFile != "" && c.TLS.KeyFile != "") || c.TLS.ACME.Enabled
+}
+
+// Print writes the effective configuration as TOML with secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	redactedConfig := *c
+	if redactedConfig.Database.Password != "" {
+		redactedConfig.Database.Password = redacted
+	}
+	if databaseURL, err := url.Parse(c.Database.URL); err == nil && databaseURL.User != nil {
+		if _, hasPassword := databaseURL.User.Password(); hasPassword {
+			databaseURL.User = url.UserPassword(databaseURL.User.Username(), redacted)
+			redactedConfig.Database.URL = databaseURL.String()
+		}
+	}
+	return toml.NewEncoder(w).Encode(redactedConfig)
+}
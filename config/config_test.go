@@ -0,0 +1,47 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestDatabaseDSNEscapesValues(t *testing.T) {
+	cfg := Default()
+	cfg.Database = Database{
+		Host:     "db.example.com",
+		Port:     5432,
+		User:     "team server",
+		Password: `p@ss w'rd sslmode=disable/#?`,
+		Name:     "teamserver",
+		SSLMode:  "verify-full",
+	}
+
+	keyValues, err := pq.ParseURL(cfg.DatabaseDSN())
+	if err != nil {
+		t.Fatalf("error parsing DSN: %v", err)
+	}
+	for _, want := range []string{
+		`host=db.example.com`,
+		`port=5432`,
+		`user=team\ server`,
+		`password=p@ss\ w\'rd\ sslmode=disable/#?`,
+		`dbname=teamserver`,
+		`sslmode=verify-full`,
+	} {
+		if !strings.Contains(keyValues, want) {
+			t.Errorf("expected %s in %s", want, keyValues)
+		}
+	}
+}
+
+func TestDatabaseDSNPrefersURL(t *testing.T) {
+	cfg := Default()
+	cfg.Database.URL = "postgres://teamserver@localhost/teamserver"
+	cfg.Database.Password = "ignored"
+
+	if got := cfg.DatabaseDSN(); got != cfg.Database.URL {
+		t.Errorf("expected %s, got %s", cfg.Database.URL, got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fluidkeys/teamserver/models"
+)
+
+// maxJSONBodyBytes leaves room for the largest armored key allowed by
+// validation, once JSON-escaped, plus the other fields
+const maxJSONBodyBytes = 160 * 1024
+
+// A validator checks the fields of a decoded request body
+type validator interface {
+	Validate() error
+}
+
+// A requestError is a problem with a request body, reported to the client
+// with the given status
+type requestError struct {
+	status  int
+	message string
+	fields  []models.FieldError
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// decodeJSON strictly decodes the JSON request body into v, then validates it
+// if v has a Validate method. The body must be sent as application/json, be at
+// most maxJSONBodyBytes, contain a single JSON value and have no fields that v
+// doesn't. Errors are *requestError, ready for writeRequestError.
+func decodeJSON(res http.ResponseWriter, req *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &requestError{
+			status:  http.StatusUnsupportedMediaType,
+			message: "Content-Type must be application/json",
+		}
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxJSONBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(v); err != nil {
+		return jsonDecodeError(err)
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return &requestError{
+			status:  http.StatusBadRequest,
+			message: "request body must contain a single JSON object",
+		}
+	}
+
+	if validator, ok := v.(validator); ok {
+		if err = validator.Validate(); err != nil {
+			if validationError, ok := err.(*models.ValidationError); ok {
+				return &requestError{
+					status:  http.StatusBadRequest,
+					message: "request body has invalid fields",
+					fields:  validationError.Errors,
+				}
+			}
+			return &requestError{status: http.StatusBadRequest, message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// jsonDecodeError explains err from json.Decoder.Decode without exposing Go
+// type names to clients
+func jsonDecodeError(err error) *requestError {
+	badRequest := func(format string, args ...interface{}) *requestError {
+		return &requestError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+	}
+
+	switch e := err.(type) {
+	case *http.MaxBytesError:
+		return &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("request body must be at most %d bytes", e.Limit),
+		}
+	case *json.SyntaxError:
+		return badRequest("request body has malformed JSON at byte %d", e.Offset)
+	case *json.UnmarshalTypeError:
+		if e.Field == "" {
+			return badRequest("request body must be a JSON object")
+		}
+		return &requestError{
+			status:  http.StatusBadRequest,
+			message: "request body has invalid fields",
+			fields:  []models.FieldError{{Field: e.Field, Message: "must be a " + e.Type.Kind().String()}},
+		}
+	}
+
+	switch {
+	case err == io.EOF:
+		return badRequest("request body must not be empty")
+	case err == io.ErrUnexpectedEOF:
+		return badRequest("request body has malformed JSON")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &requestError{
+			status:  http.StatusBadRequest,
+			message: "request body has invalid fields",
+			fields:  []models.FieldError{{Field: field, Message: "is not a known field"}},
+		}
+	default:
+		return badRequest("error reading request body: %v", err)
+	}
+}
+
+// writeRequestError writes err as a JSON Message with its status, or as an
+// internal server error if it isn't a *requestError
+func writeRequestError(res http.ResponseWriter, req *http.Request, err error) {
+	e, ok := err.(*requestError)
+	if !ok {
+		internalServerError(res, req, err)
+		return
+	}
+	out, _ := json.Marshal(Message{Message: e.message, Errors: e.fields})
+	writeJSON(res, e.status, out)
+}
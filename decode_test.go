@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/models"
+)
+
+func TestDecodeJSONBodyTooLarge(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverLimit int64
+		wantMessage string
+	}{
+		{"over the JSON limit", 1 << 20, "request body must be at most 163840 bytes"},
+		{"over the server's limit", 1024, "request body must be at most 1024 bytes"},
+	}
+
+	body := jsonBody(models.TeamsPOST{Name: strings.Repeat("a", maxJSONBodyBytes)})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/teams", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+			req.Body = http.MaxBytesReader(res, req.Body, test.serverLimit)
+
+			var teamsPost models.TeamsPOST
+			err := decodeJSON(res, req, &teamsPost)
+
+			e, ok := err.(*requestError)
+			if !ok || e.status != http.StatusRequestEntityTooLarge || e.message != test.wantMessage {
+				t.Errorf("expected 413 %q, got %#v", test.wantMessage, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+// validateEncryptedPayload checks that payload (armored or binary) is an
+// OpenPGP message encrypted only to keys of the given team members which could
+// be used for encryption at now. Symmetrically encrypted and unencrypted
+// payloads are rejected, as are messages with hidden (wildcard) recipients.
+// Problems with the payload are returned as a *requestError.
+func validateEncryptedPayload(payload []byte, members []*models.Member, now time.Time) error {
+	allowedKeyIDs, err := memberEncryptionKeyIDs(members, now)
+	if err != nil {
+		return err
+	}
+
+	recipientKeyIDs, err := getRecipientKeyIDs(payload)
+	if err != nil {
+		return invalidPayload(err.Error())
+	}
+
+	for _, keyID := range recipientKeyIDs {
+		if keyID == 0 {
+			return invalidPayload("payload is encrypted to a hidden recipient")
+		}
+		if !allowedKeyIDs[formatKeyID(keyID)] {
+			return invalidPayload(fmt.Sprintf(
+				"payload is encrypted to key %s which is not a current encryption key of a team member",
+				formatKeyID(keyID)))
+		}
+	}
+	return nil
+}
+
+// validateTeamPayload looks up the members of the team with the given UUID and
+// checks the payload is encrypted only to them, returning sql.ErrNoRows if
+// there's no such team.
+func validateTeamPayload(ctx context.Context, teamUUID uuid.UUID, payload []byte, db models.Datastore) error {
+	team, err := db.GetTeamWithMembers(ctx, teamUUID)
+	if err != nil {
+		return err
+	}
+	return validateEncryptedPayload(payload, team.Members, time.Now())
+}
+
+func invalidPayload(message string) error {
+	return &requestError{status: http.StatusBadRequest, message: message}
+}
+
+func formatKeyID(keyID uint64) string {
+	return fmt.Sprintf("%016X", keyID)
+}
+
+// getRecipientKeyIDs reads the public-key encrypted session key packets at the
+// start of an OpenPGP message, returning the key ID of each recipient.
+func getRecipientKeyIDs(payload []byte) ([]uint64, error) {
+	var r io.Reader = bytes.NewReader(payload)
+	if bytes.HasPrefix(bytes.TrimSpace(payload), []byte("-----BEGIN")) {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding armored payload: %v", err)
+		}
+		if block.Type != "PGP MESSAGE" {
+			return nil, fmt.Errorf("expected armored PGP MESSAGE, got %s", block.Type)
+		}
+		r = block.Body
+	}
+
+	packets := packet.NewReader(r)
+	recipientKeyIDs := []uint64{}
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("payload contains no encrypted data")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading payload: %v", err)
+		}
+
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			recipientKeyIDs = append(recipientKeyIDs, p.KeyId)
+		case *packet.SymmetricKeyEncrypted:
+			return nil, fmt.Errorf("symmetrically encrypted payloads are not allowed")
+		case *packet.SymmetricallyEncrypted:
+			if len(recipientKeyIDs) == 0 {
+				return nil, fmt.Errorf("payload is not encrypted to any public key")
+			}
+			return recipientKeyIDs, nil
+		default:
+			return nil, fmt.Errorf("payload is not encrypted")
+		}
+	}
+}
+
+// memberEncryptionKeyIDs returns the set of key IDs of the members' keys which
+// can be used for encryption at now: the primary key if it's flagged for
+// encryption, and subkeys flagged for encryption and neither revoked nor
+// expired, as long as the primary key is neither revoked nor expired.
+func memberEncryptionKeyIDs(members []*models.Member, now time.Time) (map[string]bool, error) {
+	keyIDs := map[string]bool{}
+	for _, member := range members {
+		metadata, err := models.ParseKeyMetadata(member.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if metadata.IsRevoked || isExpired(metadata.ExpiresAt, now) {
+			continue
+		}
+		if metadata.CanEncrypt {
+			keyIDs[metadata.KeyID] = true
+		}
+		for _, subkey := range metadata.Subkeys {
+			if subkey.CanEncrypt && !subkey.IsRevoked && !isExpired(subkey.ExpiresAt, now) {
+				keyIDs[subkey.KeyID] = true
+			}
+		}
+	}
+	return keyIDs, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestValidateEncryptedPayload(t *testing.T) {
+	members := []*models.Member{
+		{Fingerprint: fixtures.Valid.Fingerprint, PublicKey: fixtures.Valid.Armored},
+		{Fingerprint: fixtures.Expired.Fingerprint, PublicKey: fixtures.Expired.Armored},
+		{Fingerprint: fixtures.Revoked.Fingerprint, PublicKey: fixtures.Revoked.Armored},
+	}
+	encryptingPrimary, armoredEncryptingPrimary := newEncryptingPrimaryKey(t)
+	members = append(members, &models.Member{PublicKey: armoredEncryptingPrimary})
+	valid := readEntity(t, fixtures.Valid)
+	hidden := *valid.Subkeys[0].PublicKey
+	hidden.KeyId = 0
+
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr string
+	}{
+		{"encrypted to a member's subkey", encryptTo(t, valid.Subkeys[0].PublicKey), ""},
+		{"armored", armorMessage(t, encryptTo(t, valid.Subkeys[0].PublicKey)), ""},
+		{
+			"encrypted to a non-member",
+			encryptTo(t, valid.Subkeys[0].PublicKey, readEntity(t, fixtures.RSA1024).Subkeys[0].PublicKey),
+			"not a current encryption key",
+		},
+		{"encrypted to a member's primary key", encryptTo(t, valid.PrimaryKey), "not a current encryption key"},
+		{"encrypted to a member's primary key flagged for encryption", encryptTo(t, encryptingPrimary.PrimaryKey), ""},
+		{
+			"encrypted to an expired member's subkey",
+			encryptTo(t, readEntity(t, fixtures.Expired).Subkeys[0].PublicKey),
+			"not a current encryption key",
+		},
+		{
+			"encrypted to a revoked member's subkey",
+			encryptTo(t, readEntity(t, fixtures.Revoked).Subkeys[0].PublicKey),
+			"not a current encryption key",
+		},
+		{"hidden recipient", encryptTo(t, &hidden), "hidden recipient"},
+		{"symmetrically encrypted", encryptSymmetrically(t), "symmetrically encrypted"},
+		{"not encrypted", literal(t), "payload is not encrypted"},
+		{"empty", []byte{}, "no encrypted data"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateEncryptedPayload(test.payload, members, time.Now())
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected payload to be accepted, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error containing %q, got nil", test.wantErr)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("expected error containing %q, got %q", test.wantErr, err)
+			}
+			if reqErr, ok := err.(*requestError); !ok || reqErr.status != http.StatusBadRequest {
+				t.Errorf("expected a 400 requestError, got %#v", err)
+			}
+		})
+	}
+}
+
+func TestPayloadHandler(t *testing.T) {
+	db := fakedb.New()
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Valid)
+	valid := readEntity(t, fixtures.Valid)
+	toMember := armorMessage(t, encryptTo(t, valid.Subkeys[0].PublicKey))
+	toNonMember := armorMessage(t, encryptTo(t, readEntity(t, fixtures.RSA1024).Subkeys[0].PublicKey))
+
+	tests := []struct {
+		name       string
+		uuid       string
+		body       string
+		wantStatus int
+	}{
+		{"encrypted to members", teamUUID.String(), payloadJSON(toMember), http.StatusOK},
+		{"encrypted to a non-member", teamUUID.String(), payloadJSON(toNonMember), http.StatusBadRequest},
+		{"missing payload", teamUUID.String(), `{}`, http.StatusBadRequest},
+		{"not armored", teamUUID.String(), `{"payload": "hello"}`, http.StatusBadRequest},
+		{"invalid UUID", "not-a-uuid", payloadJSON(toMember), http.StatusBadRequest},
+		{"unknown team", uuid.NewV4().String(), payloadJSON(toMember), http.StatusNotFound},
+	}
+
+	env := newTestEnv(db)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := doRequest(env, "POST", "/v1/teams/"+test.uuid+"/payload", test.body)
+			if res.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+		})
+	}
+}
+
+// newEncryptingPrimaryKey returns a key with no subkeys whose primary key is
+// flagged for encryption, and the key armored
+func newEncryptingPrimaryKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Primary", "", "primary@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	entity.Subkeys = nil
+	for _, identity := range entity.Identities {
+		identity.SelfSignature.FlagEncryptCommunications = true
+		if err := identity.SelfSignature.SignUserId(identity.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("error signing identity: %v", err)
+		}
+	}
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("error armoring key: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	w.Close()
+	return entity, buf.String()
+}
+
+func TestPayloadHandlerIsRateLimited(t *testing.T) {
+	db := fakedb.New()
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Valid)
+	cfg := config.Default()
+	cfg.RateLimits.Burst = 1
+	env := newEnv(db, cfg, newServerMetrics(nil, logging.Discard()), logging.Discard())
+	body := payloadJSON(armorMessage(t, encryptTo(t, readEntity(t, fixtures.Valid).Subkeys[0].PublicKey)))
+
+	if res := doRequest(env, "POST", "/v1/teams/"+teamUUID.String()+"/payload", body); res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res := doRequest(env, "POST", "/v1/teams/"+teamUUID.String()+"/payload", body); res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func payloadJSON(armored []byte) string {
+	body, _ := json.Marshal(models.PayloadPOST{Payload: string(armored)})
+	return string(body)
+}
+
+func readEntity(t *testing.T, key fixtures.Key) *openpgp.Entity {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Armored))
+	if err != nil {
+		t.Fatalf("error reading key %s: %v", key.Fingerprint, err)
+	}
+	return entities[0]
+}
+
+// encryptTo returns an OpenPGP message with a session key encrypted to each of
+// the given public keys, whatever their flags, expiry or revocation say
+func encryptTo(t *testing.T, recipients ...*packet.PublicKey) []byte {
+	cipher := packet.CipherAES128
+	sessionKey := make([]byte, cipher.KeySize())
+	buf := new(bytes.Buffer)
+	for _, recipient := range recipients {
+		if err := packet.SerializeEncryptedKey(buf, recipient, cipher, sessionKey, nil); err != nil {
+			t.Fatalf("error encrypting session key: %v", err)
+		}
+	}
+	writeEncryptedLiteral(t, buf, cipher, sessionKey)
+	return buf.Bytes()
+}
+
+func encryptSymmetrically(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	config := &packet.Config{DefaultCipher: packet.CipherAES128}
+	sessionKey, err := packet.SerializeSymmetricKeyEncrypted(buf, []byte("passphrase"), config)
+	if err != nil {
+		t.Fatalf("error encrypting session key: %v", err)
+	}
+	writeEncryptedLiteral(t, buf, packet.CipherAES128, sessionKey)
+	return buf.Bytes()
+}
+
+func writeEncryptedLiteral(t *testing.T, buf *bytes.Buffer, cipher packet.CipherFunction, key []byte) {
+	encrypted, err := packet.SerializeSymmetricallyEncrypted(buf, cipher, key, nil)
+	if err != nil {
+		t.Fatalf("error encrypting payload: %v", err)
+	}
+	writeLiteral(t, encrypted)
+}
+
+func literal(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	writeLiteral(t, nopCloser{buf})
+	return buf.Bytes()
+}
+
+func writeLiteral(t *testing.T, w interface {
+	Write([]byte) (int, error)
+	Close() error
+}) {
+	plaintext, err := packet.SerializeLiteral(w, true, "", 0)
+	if err != nil {
+		t.Fatalf("error writing literal data: %v", err)
+	}
+	if _, err := plaintext.Write([]byte("secret")); err != nil {
+		t.Fatalf("error writing literal data: %v", err)
+	}
+	if err := plaintext.Close(); err != nil {
+		t.Fatalf("error closing literal data: %v", err)
+	}
+}
+
+func armorMessage(t *testing.T, message []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatalf("error armoring message: %v", err)
+	}
+	w.Write(message)
+	w.Close()
+	return buf.Bytes()
+}
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// writeWithETag writes body as JSON with an ETag derived from it. If the
+// request's If-None-Match already lists that ETag, only the headers are sent
+// with 304 Not Modified.
+func writeWithETag(res http.ResponseWriter, req *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	res.Header().Set("ETag", etag)
+	// Clients may keep the response, but must check it's current before using it
+	res.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		res.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(res, http.StatusOK, body)
+}
+
+// etagMatches returns true if ifNoneMatch, a comma separated list of ETags,
+// includes etag or is "*". As RFC 7232 requires, weak ETags match too.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+	uuid "github.com/satori/go.uuid"
+)
+
+// TestRoutes makes requests to every route against a team with the Valid key
+// as its member, covering each way its handler can fail
+func TestRoutes(t *testing.T) {
+	valid := readEntity(t, fixtures.Valid)
+	toMember := payloadJSON(armorMessage(t, encryptTo(t, valid.Subkeys[0].PublicKey)))
+	toNonMember := payloadJSON(armorMessage(t, encryptTo(t, readEntity(t, fixtures.Expired).Subkeys[0].PublicKey)))
+	revocation := jsonBody(models.RevokePOST{RevocationSignature: armoredRevocation(t, fixtures.Revoked)})
+	connectionLost := errors.New("connection lost")
+
+	fail := func(method string) func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+		return func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+			db.Fail(method, connectionLost)
+		}
+	}
+	storeKey := func(key fixtures.Key) func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+		return func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+			if _, err := db.CreatePublicKey(context.Background(), key.Fingerprint, key.Armored); err != nil {
+				t.Fatalf("error creating key: %v", err)
+			}
+		}
+	}
+	revokeKey := func(key fixtures.Key) func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+		return func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+			storeKey(key)(t, env, db, teamUUID)
+			if err := db.RevokePublicKey(context.Background(), key.Fingerprint, key.Armored); err != nil {
+				t.Fatalf("error revoking key: %v", err)
+			}
+		}
+	}
+	teamsPOST := func(key fixtures.Key) string {
+		return jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: key.Armored})
+	}
+	requestPOST := func(key fixtures.Key) string {
+		return jsonBody(models.RequestPOST{PublicKey: key.Armored})
+	}
+	unknownTeam := uuid.NewV4().String()
+	revokePath := "/v1/keys/" + fixtures.Revoked.Fingerprint.String() + "/revoke"
+
+	tests := []struct {
+		route       string
+		name        string
+		path        string
+		setup       func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string)
+		body        string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"GET /v1/teams", "list teams", "/v1/teams", nil, "", http.StatusOK, ""},
+		{"GET /v1/teams", "database failure", "/v1/teams", fail("AllTeams"), "",
+			http.StatusInternalServerError, "internal server error"},
+
+		{"POST /v1/teams", "create team", "/v1/teams", nil, teamsPOST(fixtures.Valid), http.StatusOK, ""},
+		{"POST /v1/teams", "expired key", "/v1/teams", nil, teamsPOST(fixtures.Expired), http.StatusOK, ""},
+		{"POST /v1/teams", "no body", "/v1/teams", nil, "",
+			http.StatusUnsupportedMediaType, "Content-Type must be application/json"},
+		{"POST /v1/teams", "malformed JSON", "/v1/teams", nil, `{"teamName":`,
+			http.StatusBadRequest, "malformed JSON"},
+		{"POST /v1/teams", "unknown field", "/v1/teams", nil, `{"teamName": "Kiffix", "admin": true}`,
+			http.StatusBadRequest, "invalid fields"},
+		{"POST /v1/teams", "missing fields", "/v1/teams", nil, `{}`, http.StatusBadRequest, "invalid fields"},
+		{"POST /v1/teams", "body too large", "/v1/teams", nil,
+			`{"teamName": "` + strings.Repeat("a", maxJSONBodyBytes) + `"}`,
+			http.StatusRequestEntityTooLarge, "at most"},
+		{"POST /v1/teams", "multiple keys", "/v1/teams", nil, teamsPOST(fixtures.MultipleEntities),
+			http.StatusBadRequest, "expected 1 openpgp.Entity"},
+		{"POST /v1/teams", "secret key", "/v1/teams", nil, teamsPOST(fixtures.SecretKey),
+			http.StatusBadRequest, ""},
+		{"POST /v1/teams", "weak key", "/v1/teams", nil, teamsPOST(fixtures.RSA1024),
+			http.StatusBadRequest, "1024-bit RSA"},
+		{"POST /v1/teams", "revoked key", "/v1/teams", revokeKey(fixtures.Revoked), teamsPOST(fixtures.Revoked),
+			http.StatusForbidden, models.ErrPublicKeyRevoked.Error()},
+		{"POST /v1/teams", "database failure", "/v1/teams", fail("Tx.CreateTeam"), teamsPOST(fixtures.Valid),
+			http.StatusInternalServerError, "internal server error"},
+
+		{"GET /v1/teams/{uuid}", "get team", "/v1/teams/{uuid}", nil, "", http.StatusOK, ""},
+		{"GET /v1/teams/{uuid}", "invalid UUID", "/v1/teams/not-a-uuid", nil, "", http.StatusBadRequest, "uuid"},
+		{"GET /v1/teams/{uuid}", "unknown team", "/v1/teams/" + unknownTeam, nil, "",
+			http.StatusNotFound, "team not found"},
+		{"GET /v1/teams/{uuid}", "database failure", "/v1/teams/{uuid}", fail("GetTeamWithMembers"), "",
+			http.StatusInternalServerError, "internal server error"},
+
+		{"GET /v1/teams/{uuid}/summary", "get summary", "/v1/teams/{uuid}/summary", nil, "", http.StatusOK, ""},
+		{"GET /v1/teams/{uuid}/summary", "invalid UUID", "/v1/teams/not-a-uuid/summary", nil, "",
+			http.StatusBadRequest, "uuid"},
+		{"GET /v1/teams/{uuid}/summary", "unknown team", "/v1/teams/" + unknownTeam + "/summary", nil, "",
+			http.StatusNotFound, "team not found"},
+		{"GET /v1/teams/{uuid}/summary", "database failure", "/v1/teams/{uuid}/summary", fail("GetTeam"), "",
+			http.StatusInternalServerError, "internal server error"},
+
+		{"POST /v1/teams/{uuid}/request", "request to join", "/v1/teams/{uuid}/request", nil,
+			requestPOST(fixtures.Expired), http.StatusCreated, ""},
+		{"POST /v1/teams/{uuid}/request", "request to join again", "/v1/teams/{uuid}/request",
+			func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+				storeKey(fixtures.Expired)(t, env, db, teamUUID)
+				if _, err := db.CreateTeamJoinRequest(context.Background(), fixtures.Expired.Fingerprint, teamUUID); err != nil {
+					t.Fatalf("error creating join request: %v", err)
+				}
+			},
+			requestPOST(fixtures.Expired), http.StatusOK, ""},
+		{"POST /v1/teams/{uuid}/request", "invalid UUID", "/v1/teams/not-a-uuid/request", nil,
+			requestPOST(fixtures.Expired), http.StatusBadRequest, "uuid"},
+		{"POST /v1/teams/{uuid}/request", "unknown team", "/v1/teams/" + unknownTeam + "/request", nil,
+			requestPOST(fixtures.Expired), http.StatusNotFound, "team not found"},
+		{"POST /v1/teams/{uuid}/request", "missing fields", "/v1/teams/{uuid}/request", nil, `{}`,
+			http.StatusBadRequest, "invalid fields"},
+		{"POST /v1/teams/{uuid}/request", "multiple keys", "/v1/teams/{uuid}/request", nil,
+			requestPOST(fixtures.MultipleEntities), http.StatusBadRequest, "expected 1 openpgp.Entity"},
+		{"POST /v1/teams/{uuid}/request", "secret key", "/v1/teams/{uuid}/request", nil,
+			requestPOST(fixtures.SecretKey), http.StatusBadRequest, ""},
+		{"POST /v1/teams/{uuid}/request", "weak key", "/v1/teams/{uuid}/request", nil,
+			requestPOST(fixtures.RSA1024), http.StatusBadRequest, "1024-bit RSA"},
+		{"POST /v1/teams/{uuid}/request", "revoked key", "/v1/teams/{uuid}/request", revokeKey(fixtures.Revoked),
+			requestPOST(fixtures.Revoked), http.StatusForbidden, models.ErrPublicKeyRevoked.Error()},
+		{"POST /v1/teams/{uuid}/request", "database failure", "/v1/teams/{uuid}/request",
+			fail("Tx.CreateTeamJoinRequest"), requestPOST(fixtures.Expired),
+			http.StatusInternalServerError, "internal server error"},
+
+		{"GET /v1/teams/{uuid}/health", "get health", "/v1/teams/{uuid}/health", nil, "", http.StatusOK, ""},
+		{"GET /v1/teams/{uuid}/health", "invalid UUID", "/v1/teams/not-a-uuid/health", nil, "",
+			http.StatusBadRequest, "uuid"},
+		{"GET /v1/teams/{uuid}/health", "unknown team", "/v1/teams/" + unknownTeam + "/health", nil, "",
+			http.StatusNotFound, "team not found"},
+		{"GET /v1/teams/{uuid}/health", "database failure", "/v1/teams/{uuid}/health",
+			fail("GetTeamMembersWithRevoked"), "", http.StatusInternalServerError, "internal server error"},
+
+		{"POST /v1/teams/{uuid}/payload", "encrypted to members", "/v1/teams/{uuid}/payload", nil,
+			toMember, http.StatusOK, ""},
+		{"POST /v1/teams/{uuid}/payload", "encrypted to a non-member", "/v1/teams/{uuid}/payload", nil,
+			toNonMember, http.StatusBadRequest, ""},
+		{"POST /v1/teams/{uuid}/payload", "not armored", "/v1/teams/{uuid}/payload", nil,
+			`{"payload": "hello"}`, http.StatusBadRequest, "invalid fields"},
+		{"POST /v1/teams/{uuid}/payload", "invalid UUID", "/v1/teams/not-a-uuid/payload", nil,
+			toMember, http.StatusBadRequest, "uuid"},
+		{"POST /v1/teams/{uuid}/payload", "unknown team", "/v1/teams/" + unknownTeam + "/payload", nil,
+			toMember, http.StatusNotFound, "team not found"},
+		{"POST /v1/teams/{uuid}/payload", "database failure", "/v1/teams/{uuid}/payload",
+			fail("GetTeamWithMembers"), toMember, http.StatusInternalServerError, "internal server error"},
+
+		{"POST /v1/keys/{fingerprint}/revoke", "revoke key", revokePath, storeKey(fixtures.Revoked),
+			revocation, http.StatusOK, "revoked"},
+		{"POST /v1/keys/{fingerprint}/revoke", "invalid fingerprint", "/v1/keys/not-a-fingerprint/revoke", nil,
+			revocation, http.StatusBadRequest, ""},
+		{"POST /v1/keys/{fingerprint}/revoke", "unknown key", revokePath, nil,
+			revocation, http.StatusNotFound, "no key with fingerprint"},
+		{"POST /v1/keys/{fingerprint}/revoke", "not a revocation", revokePath, storeKey(fixtures.Revoked),
+			jsonBody(models.RevokePOST{RevocationSignature: fixtures.Valid.Armored}),
+			http.StatusBadRequest, "expected a key revocation signature"},
+		{"POST /v1/keys/{fingerprint}/revoke", "another key's revocation",
+			"/v1/keys/" + fixtures.Valid.Fingerprint.String() + "/revoke", nil,
+			revocation, http.StatusBadRequest, "invalid revocation signature"},
+		{"POST /v1/keys/{fingerprint}/revoke", "database failure", revokePath,
+			func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+				storeKey(fixtures.Revoked)(t, env, db, teamUUID)
+				db.Fail("RevokePublicKey", connectionLost)
+			},
+			revocation, http.StatusInternalServerError, "internal server error"},
+
+		{"GET /docs", "list routes", "/docs", nil, "", http.StatusOK, ""},
+		{"GET /openapi.json", "get spec", "/openapi.json", nil, "", http.StatusOK, ""},
+		{"GET /healthz", "check up", "/healthz", nil, "", http.StatusOK, ""},
+		{"GET /readyz", "check ready", "/readyz", nil, "", http.StatusOK, ""},
+		{"GET /readyz", "database unavailable", "/readyz",
+			func(t *testing.T, env *Env, db *fakedb.DB, teamUUID string) {
+				env.readiness.add("database", func(ctx context.Context) error { return connectionLost })
+			},
+			"", http.StatusServiceUnavailable, ""},
+		{"GET /metrics", "get metrics", "/metrics", nil, "", http.StatusOK, ""},
+	}
+
+	covered := map[string]bool{}
+	for _, test := range tests {
+		covered[test.route] = true
+		t.Run(test.route+" "+test.name, func(t *testing.T) {
+			db := fakedb.New()
+			teamUUID := createTestTeam(t, db, "Existing", fixtures.Valid).String()
+			env := newRouteTestEnv(db)
+			if test.setup != nil {
+				test.setup(t, env, db, teamUUID)
+			}
+
+			method := strings.SplitN(test.route, " ", 2)[0]
+			res := doRequest(env, method, strings.Replace(test.path, "{uuid}", teamUUID, 1), test.body)
+
+			if res.Code != test.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+			if test.wantMessage == "" {
+				return
+			}
+			var message Message
+			if err := json.Unmarshal(res.Body.Bytes(), &message); err != nil {
+				t.Fatalf("error decoding message: %v: %s", err, res.Body)
+			}
+			if !strings.Contains(message.Message, test.wantMessage) {
+				t.Errorf("expected message containing %q, got %q", test.wantMessage, message.Message)
+			}
+		})
+	}
+	checkRoutesCovered(t, newRouteTestEnv(fakedb.New()).router, covered)
+}
+
+func TestUnroutedRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"unknown path", "GET", "/v1/nothing", http.StatusNotFound},
+		{"unknown version", "GET", "/v2/teams", http.StatusNotFound},
+		{"method not allowed", "DELETE", "/v1/teams", http.StatusMethodNotAllowed},
+	}
+
+	env := newRouteTestEnv(fakedb.New())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := doRequest(env, test.method, test.path, "")
+			if res.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+		})
+	}
+}
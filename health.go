@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessCheckTimeout stops a hung dependency, such as an unreachable
+// database, from hanging the readiness probe too
+const readinessCheckTimeout = 5 * time.Second
+
+// readinessCheck reports whether something the server needs to serve requests,
+// such as the database, is working
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks are run on every request to `/readyz`
+type readinessChecks struct {
+	mu     sync.Mutex
+	checks []readinessCheck
+}
+
+// add registers check, which should return an error if the server isn't ready
+func (c *readinessChecks) add(name string, check func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, readinessCheck{name, check})
+}
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Health is the response from `/healthz` and `/readyz`
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// run runs every check at once, returning their results in the order they were
+// added
+func (c *readinessChecks) run(ctx context.Context) Health {
+	c.mu.Lock()
+	checks := append([]readinessCheck{}, c.checks...)
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	health := Health{Status: healthOK, Checks: make([]HealthCheck, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := check.check(ctx)
+			result := HealthCheck{
+				Name:       check.name,
+				Status:     healthOK,
+				DurationMs: float64(time.Since(start).Nanoseconds()) / 1e6,
+			}
+			if err != nil {
+				result.Status = healthUnavailable
+				result.Error = err.Error()
+			}
+			health.Checks[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, result := range health.Checks {
+		if result.Status != healthOK {
+			health.Status = healthUnavailable
+		}
+	}
+	return health
+}
+
+// handleHealthz reports that the process is up and serving requests. It
+// doesn't check dependencies, so a database outage doesn't get the process
+// restarted.
+func handleHealthz(res http.ResponseWriter, req *http.Request) {
+	writeHealth(res, Health{Status: healthOK, Checks: []HealthCheck{}})
+}
+
+// handleReadyz runs the readiness checks, responding 503 Service Unavailable
+// if any fail so load balancers stop sending requests to this process
+func (c *readinessChecks) handleReadyz(res http.ResponseWriter, req *http.Request) {
+	writeHealth(res, c.run(req.Context()))
+}
+
+func writeHealth(res http.ResponseWriter, health Health) {
+	body, err := json.Marshal(health)
+	if err != nil {
+		writeJSONMessage(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if health.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(res, status, body)
+}
+
+// checkCertificate returns a readiness check that getCertificate has a
+// certificate loaded which hasn't expired
+func checkCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(context.Context) error {
+	return func(ctx context.Context) error {
+		cert, err := getCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			return err
+		}
+		if cert == nil || len(cert.Certificate) == 0 {
+			return fmt.Errorf("no certificate loaded")
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("error parsing certificate: %v", err)
+		}
+		if time.Now().After(leaf.NotAfter) {
+			return fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyClaimTimeout is how long a request can hold its Idempotency-Key
+// before it's assumed to have died without a response. It's much longer than
+// requests are allowed to run.
+const idempotencyClaimTimeout = 5 * time.Minute
+
+// idempotencyRetention is how long a response is kept for its request to be
+// retried. A retry after that is handled again.
+const idempotencyRetention = 24 * time.Hour
+
+// idempotencySweepInterval is how often responses older than
+// idempotencyRetention are deleted
+const idempotencySweepInterval = time.Hour
+
+// idempotent wraps a handler so that a request retried with the same
+// Idempotency-Key header gets the original response replayed rather than
+// being handled again. While the original is being handled, retries get a
+// 409. Keys are chosen by clients, so they're scoped to the client identified
+// by clientKey, and a key reused for a different request gets a 422. Requests
+// without the header are passed straight through.
+func idempotent(handler http.Handler, db models.Datastore, clientKey rateLimitKeyFunc) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			handler.ServeHTTP(res, req)
+			return
+		}
+		if len(key) > 255 {
+			writeJSONMessage(res, http.StatusBadRequest, idempotencyKeyHeader+" is too long")
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxJSONBodyBytes))
+		if _, ok := err.(*http.MaxBytesError); ok {
+			writeJSONMessage(res, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body must be at most %d bytes", maxJSONBodyBytes))
+			return
+		} else if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		requestHash := sha256.Sum256(body)
+		client, req := clientKey(req)
+
+		claim := &models.IdempotentResponse{
+			Client:      client,
+			Key:         key,
+			Method:      req.Method,
+			Path:        req.URL.Path,
+			RequestHash: hex.EncodeToString(requestHash[:]),
+		}
+		stored, err := db.ClaimIdempotencyKey(req.Context(), claim, idempotencyClaimTimeout)
+		if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		if stored != nil {
+			replayIdempotentResponse(res, claim, stored)
+			return
+		}
+
+		// The response is stored, or the claim released so the client can
+		// retry, even if the request is cancelled once the response is written
+		ctx := context.WithoutCancel(req.Context())
+		logger := logging.FromContext(req.Context())
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := db.ReleaseIdempotencyKey(ctx, claim.Client, claim.Key, claim.Method, claim.Path); err != nil {
+				logger.Error("error releasing idempotency key", logging.Fields{"error": err})
+			}
+		}()
+
+		recorder := &responseRecorder{
+			ResponseWriter: res,
+			statusCode:     http.StatusOK,
+			headerBefore:   res.Header().Clone(),
+		}
+		handler.ServeHTTP(recorder, req)
+
+		// Server errors aren't stored so the client can retry them
+		if recorder.statusCode >= 500 {
+			return
+		}
+		response := *claim
+		response.StatusCode = recorder.statusCode
+		response.Header = recorder.header
+		response.ResponseBody = recorder.body.String()
+		err = db.CompleteIdempotentResponse(ctx, &response)
+		if err == models.ErrIdempotencyKeyNotClaimed {
+			// The claim went stale and another request took it, so it's
+			// not this request's to release
+			logger.Warn("idempotency key was reclaimed before the response was stored",
+				logging.Fields{"idempotencyKey": claim.Key})
+			completed = true
+			return
+		} else if err != nil {
+			logger.Error("error storing idempotent response", logging.Fields{"error": err})
+			return
+		}
+		completed = true
+	})
+}
+
+// sweepIdempotentResponses deletes responses older than idempotencyRetention
+// every interval until ctx is done
+func sweepIdempotentResponses(ctx context.Context, db models.Datastore, interval time.Duration, logger *logging.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		deleted, err := db.DeleteIdempotentResponses(ctx, idempotencyRetention)
+		if err != nil {
+			logger.Error("error deleting expired idempotent responses", logging.Fields{"error": err})
+		} else if deleted > 0 {
+			logger.Info("deleted expired idempotent responses", logging.Fields{"count": deleted})
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replayIdempotentResponse writes the stored response to a request which
+// claimed its Idempotency-Key first, if it's finished and the request was
+// the same
+func replayIdempotentResponse(res http.ResponseWriter, claim *models.IdempotentResponse, stored *models.IdempotentResponse) {
+	if stored.RequestHash != claim.RequestHash {
+		writeJSONMessage(res, http.StatusUnprocessableEntity, idempotencyKeyHeader+" was already used for a different request")
+		return
+	}
+	if stored.Pending {
+		writeJSONMessage(res, http.StatusConflict, "a request with this "+idempotencyKeyHeader+" is still being handled")
+		return
+	}
+	for name, values := range stored.Header {
+		res.Header()[name] = values
+	}
+	res.Header().Set("Idempotent-Replayed", "true")
+	res.WriteHeader(stored.StatusCode)
+	res.Write([]byte(stored.ResponseBody))
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy of the status code, the headers the handler set and the body.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode   int
+	headerBefore http.Header
+	header       http.Header
+	body         bytes.Buffer
+	wroteHeader  bool
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.recordHeader()
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.recordHeader()
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// recordHeader keeps the headers which have been set since the handler was
+// called, leaving out ones set by middleware for this request only
+func (r *responseRecorder) recordHeader() {
+	r.wroteHeader = true
+	r.header = http.Header{}
+	for name, values := range r.ResponseWriter.Header() {
+		if !equalValues(values, r.headerBefore[name]) {
+			r.header[name] = append([]string{}, values...)
+		}
+	}
+}
+
+func equalValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	db := fakedb.New()
+	env := newTestEnv(db)
+	body := jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: fixtures.Valid.Armored})
+
+	first := doIdempotentRequest(env, "POST", "/v1/teams", body, "key-1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", first.Code, first.Body)
+	}
+	retried := doIdempotentRequest(env, "POST", "/v1/teams", body, "key-1")
+	if retried.Code != first.Code || retried.Body.String() != first.Body.String() {
+		t.Errorf("expected %d %s replayed, got %d %s", first.Code, first.Body, retried.Code, retried.Body)
+	}
+	if retried.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected Idempotent-Replayed header")
+	}
+	if n := db.Called("Tx.CreateTeam"); n != 1 {
+		t.Errorf("expected team to be created once, got %d", n)
+	}
+}
+
+func TestIdempotentReplaysHeaders(t *testing.T) {
+	db := fakedb.New()
+	handler := idempotent(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("Location", "/v1/teams/1")
+		res.WriteHeader(http.StatusCreated)
+		res.Write([]byte("{}"))
+	}), db, byIP(false))
+	serveWithRequestID := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/teams", strings.NewReader("body"))
+		req.Header.Set(idempotencyKeyHeader, "key")
+		res := httptest.NewRecorder()
+		// set by middleware before the handler runs, so not part of the
+		// stored response
+		res.Header().Set("X-Request-Id", requestID)
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	serveWithRequestID("first")
+	res := serveWithRequestID("second")
+
+	if res.Code != http.StatusCreated {
+		t.Errorf("expected status 201, got %d", res.Code)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":        "application/json",
+		"Location":            "/v1/teams/1",
+		"X-Request-Id":        "second",
+		"Idempotent-Replayed": "true",
+	} {
+		if got := res.Header().Get(name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(db *fakedb.DB)
+		handler    http.HandlerFunc
+		body       string
+		wantStatus int
+		wantCalls  int
+		wantLog    string
+	}{
+		{
+			name:       "different request with the same key",
+			setup:      func(db *fakedb.DB) { completeClaim(t, db, "other body") },
+			body:       "body",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "request with the same key in progress",
+			setup:      func(db *fakedb.DB) { claim(t, db, "body") },
+			body:       "body",
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "body too large",
+			body:       strings.Repeat("a", maxJSONBodyBytes+1),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "server error",
+			handler: func(res http.ResponseWriter, req *http.Request) {
+				http.Error(res, "{}", http.StatusInternalServerError)
+			},
+			body:       "body",
+			wantStatus: http.StatusInternalServerError,
+			wantCalls:  1,
+		},
+		{
+			name:       "request with the same key from another client",
+			setup:      func(db *fakedb.DB) { completeClaimFrom(t, db, "ip:198.51.100.1", "other body") },
+			body:       "body",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name: "claim taken by another request before the response is stored",
+			handler: func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusCreated)
+			},
+			setup: func(db *fakedb.DB) {
+				db.Fail("CompleteIdempotentResponse", models.ErrIdempotencyKeyNotClaimed)
+			},
+			body:       "body",
+			wantStatus: http.StatusCreated,
+			wantLog:    "idempotency key was reclaimed",
+		},
+		{
+			name: "failing to store the response",
+			setup: func(db *fakedb.DB) {
+				db.Fail("CompleteIdempotentResponse", errors.New("connection lost"))
+			},
+			body:       "body",
+			wantStatus: http.StatusCreated,
+			wantCalls:  1,
+			wantLog:    "error storing idempotent response",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := fakedb.New()
+			if test.setup != nil {
+				test.setup(db)
+			}
+			handler := test.handler
+			if handler == nil {
+				handler = func(res http.ResponseWriter, req *http.Request) {
+					res.WriteHeader(http.StatusCreated)
+				}
+			}
+			out := new(bytes.Buffer)
+			req := httptest.NewRequest("POST", "/v1/teams", strings.NewReader(test.body))
+			req = req.WithContext(logging.NewContext(req.Context(), logging.New(out, logging.Info)))
+			req.Header.Set(idempotencyKeyHeader, "key")
+			res := httptest.NewRecorder()
+
+			idempotent(handler, db, byIP(false)).ServeHTTP(res, req)
+
+			if res.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+			if n := db.Called("ReleaseIdempotencyKey"); n != test.wantCalls {
+				t.Errorf("expected claim to be released %d times, got %d", test.wantCalls, n)
+			}
+			if !strings.Contains(out.String(), test.wantLog) {
+				t.Errorf("expected log containing %q, got %q", test.wantLog, out)
+			}
+			if test.wantCalls > 0 {
+				if _, err := db.GetIdempotentResponse(context.Background(), testClient, "key", "POST", "/v1/teams"); err == nil {
+					t.Errorf("expected claim to be deleted")
+				}
+			}
+		})
+	}
+}
+
+func doIdempotentRequest(env http.Handler, method string, path string, body string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, key)
+	res := httptest.NewRecorder()
+	env.ServeHTTP(res, req)
+	return res
+}
+
+// testClient identifies requests made with httptest.NewRequest
+const testClient = "ip:192.0.2.1"
+
+// claim claims the key "key" for a request to POST /v1/teams with body
+func claim(t *testing.T, db *fakedb.DB, body string) *models.IdempotentResponse {
+	return claimFrom(t, db, testClient, body)
+}
+
+func claimFrom(t *testing.T, db *fakedb.DB, client string, body string) *models.IdempotentResponse {
+	c := &models.IdempotentResponse{
+		Client:      client,
+		Key:         "key",
+		Method:      "POST",
+		Path:        "/v1/teams",
+		RequestHash: fmt.Sprintf("%x", sha256.Sum256([]byte(body))),
+	}
+	if _, err := db.ClaimIdempotencyKey(context.Background(), c, time.Minute); err != nil {
+		t.Fatalf("error claiming idempotency key: %v", err)
+	}
+	return c
+}
+
+func completeClaim(t *testing.T, db *fakedb.DB, body string) {
+	completeClaimFrom(t, db, testClient, body)
+}
+
+func completeClaimFrom(t *testing.T, db *fakedb.DB, client string, body string) {
+	response := claimFrom(t, db, client, body)
+	response.StatusCode = http.StatusCreated
+	if err := db.CompleteIdempotentResponse(context.Background(), response); err != nil {
+		t.Fatalf("error storing idempotent response: %v", err)
+	}
+}
+
+func TestSweepIdempotentResponses(t *testing.T) {
+	db := fakedb.New()
+	completeClaim(t, db, "body")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sweepIdempotentResponses(ctx, db, time.Hour, logging.New(new(bytes.Buffer), logging.Info))
+
+	if n := db.Called("DeleteIdempotentResponses"); n != 1 {
+		t.Errorf("expected expired responses to be deleted once, got %d", n)
+	}
+	if _, err := db.GetIdempotentResponse(context.Background(), testClient, "key", "POST", "/v1/teams"); err != nil {
+		t.Errorf("expected a response inside the retention window to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/metrics"
+	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+// serverMetrics are the metrics served at `/metrics`
+type serverMetrics struct {
+	registry          *metrics.Registry
+	requests          *metrics.CounterVec
+	requestDuration   *metrics.HistogramVec
+	datastoreDuration *metrics.HistogramVec
+	datastoreErrors   *metrics.CounterVec
+}
+
+// newServerMetrics registers metrics for HTTP requests and the datastore, plus
+// the connection pool stats of db and counts of the records it holds
+func newServerMetrics(db *models.DB, logger *logging.Logger) *serverMetrics {
+	registry := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("teamserver_http_requests_total",
+			"HTTP requests served, by route and response status.",
+			"method", "route", "status"),
+		requestDuration: registry.NewHistogramVec("teamserver_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by route.",
+			metrics.DefaultBuckets, "method", "route"),
+		datastoreDuration: registry.NewHistogramVec("teamserver_datastore_call_duration_seconds",
+			"Time taken by calls to the datastore, by method.",
+			metrics.DefaultBuckets, "method"),
+		datastoreErrors: registry.NewCounterVec("teamserver_datastore_errors_total",
+			"Datastore calls which returned an error other than no rows, by method.",
+			"method"),
+	}
+	if db != nil {
+		registerPoolMetrics(registry, db.Stats)
+		registerRecordCountMetrics(registry, db, logger)
+	}
+	return m
+}
+
+func registerPoolMetrics(registry *metrics.Registry, stats func() sql.DBStats) {
+	gauge := func(name string, help string, value func(sql.DBStats) float64) {
+		registry.NewGaugeFunc(name, help, func() []metrics.Sample {
+			return []metrics.Sample{{Value: value(stats())}}
+		})
+	}
+	counter := func(name string, help string, value func(sql.DBStats) float64) {
+		registry.NewCounterFunc(name, help, func() []metrics.Sample {
+			return []metrics.Sample{{Value: value(stats())}}
+		})
+	}
+	gauge("teamserver_db_max_open_connections", "Maximum number of open connections to the database.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	gauge("teamserver_db_open_connections", "Open connections to the database, in use or idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	gauge("teamserver_db_in_use_connections", "Database connections in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	gauge("teamserver_db_idle_connections", "Idle database connections.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+	counter("teamserver_db_wait_count_total", "Times a query waited for a free database connection.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	counter("teamserver_db_wait_duration_seconds_total", "Time spent waiting for free database connections.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+}
+
+// recordCountTimeout stops a slow count holding up the whole scrape
+const recordCountTimeout = 5 * time.Second
+
+func registerRecordCountMetrics(registry *metrics.Registry, db models.Datastore, logger *logging.Logger) {
+	registry.NewGaugeFunc("teamserver_records",
+		"Teams, members and pending join requests stored, by kind.",
+		func() []metrics.Sample {
+			ctx, cancel := context.WithTimeout(context.Background(), recordCountTimeout)
+			defer cancel()
+			counts, err := db.CountRecords(ctx)
+			if err != nil {
+				logger.Error("error counting records for metrics", logging.Fields{"error": err})
+				return nil
+			}
+			return []metrics.Sample{
+				{LabelValues: []string{"teams"}, Value: float64(counts.Teams)},
+				{LabelValues: []string{"members"}, Value: float64(counts.Members)},
+				{LabelValues: []string{"pending_join_requests"}, Value: float64(counts.PendingJoinRequests)},
+			}
+		}, "kind")
+}
+
+// instrumentRequests counts requests and times how long they take, labelled
+// with the pattern of the route that handled them
+func (m *serverMetrics) instrumentRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req)
+
+		route := getRequestInfo(req).route
+		if route == "" {
+			route = "unmatched" // don't make a new series for every 404
+		}
+		method := methodLabel(req.Method)
+		m.requests.Inc(method, route, strconv.Itoa(recorder.status))
+		m.requestDuration.Observe(time.Since(start).Seconds(), method, route)
+	})
+}
+
+// methodLabel returns method if it's a standard HTTP method, otherwise
+// "other", so clients can't make a new series for every method they invent
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return method
+	default:
+		return "other"
+	}
+}
+
+// observe records the duration of a datastore call started at start, and
+// whether it failed
+func (m *serverMetrics) observe(method string, start time.Time, err error) {
+	m.datastoreDuration.Observe(time.Since(start).Seconds(), method)
+	if err != nil && err != sql.ErrNoRows {
+		m.datastoreErrors.Inc(method)
+	}
+}
+
+// instrumentedDatastore wraps a Datastore, timing every call
+type instrumentedDatastore struct {
+	next    models.Datastore
+	metrics *serverMetrics
+}
+
+// instrumentDatastore returns a Datastore which records the latency and errors
+// of every call to db in m
+func (m *serverMetrics) instrumentDatastore(db models.Datastore) models.Datastore {
+	return &instrumentedDatastore{next: db, metrics: m}
+}
+
+func (d *instrumentedDatastore) AllTeams(ctx context.Context) ([]*models.Team, error) {
+	start := time.Now()
+	teams, err := d.next.AllTeams(ctx)
+	d.metrics.observe("AllTeams", start, err)
+	return teams, err
+}
+
+func (d *instrumentedDatastore) CreateTeam(ctx context.Context, teamName string) (int64, *uuid.UUID, error) {
+	start := time.Now()
+	teamID, teamUUID, err := d.next.CreateTeam(ctx, teamName)
+	d.metrics.observe("CreateTeam", start, err)
+	return teamID, teamUUID, err
+}
+
+func (d *instrumentedDatastore) CreateTeamUser(ctx context.Context, teamID int64, fingerprint models.Fingerprint) (int64, error) {
+	start := time.Now()
+	id, err := d.next.CreateTeamUser(ctx, teamID, fingerprint)
+	d.metrics.observe("CreateTeamUser", start, err)
+	return id, err
+}
+
+func (d *instrumentedDatastore) CreatePublicKey(ctx context.Context, fingerprint models.Fingerprint, armoredPublicKey string) (int64, error) {
+	start := time.Now()
+	id, err := d.next.CreatePublicKey(ctx, fingerprint, armoredPublicKey)
+	d.metrics.observe("CreatePublicKey", start, err)
+	return id, err
+}
+
+func (d *instrumentedDatastore) GetTeam(ctx context.Context, teamUUID uuid.UUID) (*models.Team, error) {
+	start := time.Now()
+	team, err := d.next.GetTeam(ctx, teamUUID)
+	d.metrics.observe("GetTeam", start, err)
+	return team, err
+}
+
+func (d *instrumentedDatastore) GetTeamWithMembers(ctx context.Context, teamUUID uuid.UUID) (*models.Team, error) {
+	start := time.Now()
+	team, err := d.next.GetTeamWithMembers(ctx, teamUUID)
+	d.metrics.observe("GetTeamWithMembers", start, err)
+	return team, err
+}
+
+func (d *instrumentedDatastore) CreateTeamJoinRequest(ctx context.Context, fingerprint models.Fingerprint, teamUUID string) (int64, error) {
+	start := time.Now()
+	id, err := d.next.CreateTeamJoinRequest(ctx, fingerprint, teamUUID)
+	d.metrics.observe("CreateTeamJoinRequest", start, err)
+	return id, err
+}
+
+func (d *instrumentedDatastore) GetTeamMembers(ctx context.Context, teamID int) ([]*models.Member, error) {
+	start := time.Now()
+	members, err := d.next.GetTeamMembers(ctx, teamID)
+	d.metrics.observe("GetTeamMembers", start, err)
+	return members, err
+}
+
+func (d *instrumentedDatastore) GetTeamMembersWithRevoked(ctx context.Context, teamUUID uuid.UUID) ([]*models.Member, []*models.Member, error) {
+	start := time.Now()
+	members, revokedMembers, err := d.next.GetTeamMembersWithRevoked(ctx, teamUUID)
+	d.metrics.observe("GetTeamMembersWithRevoked", start, err)
+	return members, revokedMembers, err
+}
+
+func (d *instrumentedDatastore) GetTeamJoinRequests(ctx context.Context, teamID int) ([]*models.JoinRequest, error) {
+	start := time.Now()
+	joinRequests, err := d.next.GetTeamJoinRequests(ctx, teamID)
+	d.metrics.observe("GetTeamJoinRequests", start, err)
+	return joinRequests, err
+}
+
+func (d *instrumentedDatastore) GetTeamJoinRequest(ctx context.Context, teamUUID string, fingerprint models.Fingerprint) (*models.JoinRequest, error) {
+	start := time.Now()
+	joinRequest, err := d.next.GetTeamJoinRequest(ctx, teamUUID, fingerprint)
+	d.metrics.observe("GetTeamJoinRequest", start, err)
+	return joinRequest, err
+}
+
+func (d *instrumentedDatastore) AllPublicKeys(ctx context.Context) ([]*models.PublicKey, error) {
+	start := time.Now()
+	publicKeys, err := d.next.AllPublicKeys(ctx)
+	d.metrics.observe("AllPublicKeys", start, err)
+	return publicKeys, err
+}
+
+func (d *instrumentedDatastore) AllRevokedPublicKeys(ctx context.Context) ([]*models.PublicKey, error) {
+	start := time.Now()
+	publicKeys, err := d.next.AllRevokedPublicKeys(ctx)
+	d.metrics.observe("AllRevokedPublicKeys", start, err)
+	return publicKeys, err
+}
+
+func (d *instrumentedDatastore) GetPublicKey(ctx context.Context, fingerprint models.Fingerprint) (*models.PublicKey, error) {
+	start := time.Now()
+	publicKey, err := d.next.GetPublicKey(ctx, fingerprint)
+	d.metrics.observe("GetPublicKey", start, err)
+	return publicKey, err
+}
+
+func (d *instrumentedDatastore) RevokePublicKey(ctx context.Context, fingerprint models.Fingerprint, armoredPublicKey string) error {
+	start := time.Now()
+	err := d.next.RevokePublicKey(ctx, fingerprint, armoredPublicKey)
+	d.metrics.observe("RevokePublicKey", start, err)
+	return err
+}
+
+func (d *instrumentedDatastore) GetIdempotentResponse(ctx context.Context, client string, key string, method string, path string) (*models.IdempotentResponse, error) {
+	start := time.Now()
+	response, err := d.next.GetIdempotentResponse(ctx, client, key, method, path)
+	d.metrics.observe("GetIdempotentResponse", start, err)
+	return response, err
+}
+
+func (d *instrumentedDatastore) ClaimIdempotencyKey(ctx context.Context, claim *models.IdempotentResponse, staleAfter time.Duration) (*models.IdempotentResponse, error) {
+	start := time.Now()
+	existing, err := d.next.ClaimIdempotencyKey(ctx, claim, staleAfter)
+	d.metrics.observe("ClaimIdempotencyKey", start, err)
+	return existing, err
+}
+
+func (d *instrumentedDatastore) CompleteIdempotentResponse(ctx context.Context, response *models.IdempotentResponse) error {
+	start := time.Now()
+	err := d.next.CompleteIdempotentResponse(ctx, response)
+	d.metrics.observe("CompleteIdempotentResponse", start, err)
+	return err
+}
+
+func (d *instrumentedDatastore) ReleaseIdempotencyKey(ctx context.Context, client string, key string, method string, path string) error {
+	start := time.Now()
+	err := d.next.ReleaseIdempotencyKey(ctx, client, key, method, path)
+	d.metrics.observe("ReleaseIdempotencyKey", start, err)
+	return err
+}
+
+func (d *instrumentedDatastore) DeleteIdempotentResponses(ctx context.Context, olderThan time.Duration) (int64, error) {
+	start := time.Now()
+	deleted, err := d.next.DeleteIdempotentResponses(ctx, olderThan)
+	d.metrics.observe("DeleteIdempotentResponses", start, err)
+	return deleted, err
+}
+
+func (d *instrumentedDatastore) TakeRateLimitToken(ctx context.Context, key string, ratePerSecond float64, burst int) (bool, time.Duration, error) {
+	start := time.Now()
+	allowed, retryAfter, err := d.next.TakeRateLimitToken(ctx, key, ratePerSecond, burst)
+	d.metrics.observe("TakeRateLimitToken", start, err)
+	return allowed, retryAfter, err
+}
+
+func (d *instrumentedDatastore) ReturnRateLimitToken(ctx context.Context, key string, burst int) error {
+	start := time.Now()
+	err := d.next.ReturnRateLimitToken(ctx, key, burst)
+	d.metrics.observe("ReturnRateLimitToken", start, err)
+	return err
+}
+
+func (d *instrumentedDatastore) DeleteFullRateLimitBuckets(ctx context.Context) (int64, error) {
+	start := time.Now()
+	deleted, err := d.next.DeleteFullRateLimitBuckets(ctx)
+	d.metrics.observe("DeleteFullRateLimitBuckets", start, err)
+	return deleted, err
+}
+
+func (d *instrumentedDatastore) GetACMECacheEntry(ctx context.Context, key string) ([]byte, error) {
+	start := time.Now()
+	data, err := d.next.GetACMECacheEntry(ctx, key)
+	d.metrics.observe("GetACMECacheEntry", start, err)
+	return data, err
+}
+
+func (d *instrumentedDatastore) PutACMECacheEntry(ctx context.Context, key string, data []byte) error {
+	start := time.Now()
+	err := d.next.PutACMECacheEntry(ctx, key, data)
+	d.metrics.observe("PutACMECacheEntry", start, err)
+	return err
+}
+
+func (d *instrumentedDatastore) DeleteACMECacheEntry(ctx context.Context, key string) error {
+	start := time.Now()
+	err := d.next.DeleteACMECacheEntry(ctx, key)
+	d.metrics.observe("DeleteACMECacheEntry", start, err)
+	return err
+}
+
+func (d *instrumentedDatastore) CountRecords(ctx context.Context) (*models.RecordCounts, error) {
+	start := time.Now()
+	counts, err := d.next.CountRecords(ctx)
+	d.metrics.observe("CountRecords", start, err)
+	return counts, err
+}
+
+// WithTx times the whole transaction, including the work done by fn
+func (d *instrumentedDatastore) WithTx(ctx context.Context, fn func(models.Tx) error) error {
+	start := time.Now()
+	err := d.next.WithTx(ctx, fn)
+	d.metrics.observe("WithTx", start, err)
+	return err
+}
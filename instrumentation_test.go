@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+func TestRequestMetricsLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{"known route", "GET", "/v1/teams", `method="GET",route="/v1/teams",status="200"`},
+		{"method not allowed", "DELETE", "/v1/teams", `method="DELETE",route="/v1/teams",status="405"`},
+		{"unknown method", "BREW", "/v1/teams", `method="other",route="/v1/teams",status="405"`},
+		{"unknown route", "GET", "/v1/coffee", `method="GET",route="unmatched",status="404"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(fakedb.New())
+			doRequest(env, test.method, test.path, "")
+
+			res := doRequest(env, "GET", "/metrics", "")
+			if res.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", res.Code)
+			}
+			want := "teamserver_http_requests_total{" + test.want + "} 1"
+			if !strings.Contains(res.Body.String(), want) {
+				t.Errorf("expected %s in metrics:\n%s", want, res.Body)
+			}
+		})
+	}
+}
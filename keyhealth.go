@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+)
+
+const (
+	keyStatusOK           = "ok"
+	keyStatusExpiringSoon = "expiringSoon"
+	keyStatusExpired      = "expired"
+	keyStatusRevoked      = "revoked"
+
+	// keyExpiryWarningPeriod is how far ahead of expiry a key is reported as
+	// expiring soon
+	keyExpiryWarningPeriod = 30 * 24 * time.Hour
+)
+
+// A KeyHealth describes whether a member's key is usable now and for how long
+type KeyHealth struct {
+	Fingerprint            models.Fingerprint `json:"fingerprint"`
+	Status                 string             `json:"status"`
+	PrimaryKeyExpiry       *time.Time         `json:"primaryKeyExpiry,omitempty"`
+	EncryptionSubkeyExpiry *time.Time         `json:"encryptionSubkeyExpiry,omitempty"`
+}
+
+// A TeamHealth lists the members of a team whose keys need attention
+type TeamHealth struct {
+	Members []*KeyHealth `json:"members"`
+}
+
+// getKeyHealth parses the armored public key and works out the expiry of the
+// primary key and the longest-lived encryption subkey as of now.
+func getKeyHealth(armoredPublicKey string, now time.Time) (*KeyHealth, error) {
+	fingerprint, err := fingerprintFromPublicKey(armoredPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := models.ParseKeyMetadata(armoredPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	health := KeyHealth{
+		Fingerprint:      fingerprint,
+		Status:           keyStatusOK,
+		PrimaryKeyExpiry: metadata.ExpiresAt,
+	}
+
+	hasEncryptionSubkey := false
+	for _, subkey := range metadata.Subkeys {
+		if subkey.IsRevoked || !subkey.CanEncrypt {
+			continue
+		}
+		if !hasEncryptionSubkey || laterExpiry(subkey.ExpiresAt, health.EncryptionSubkeyExpiry) {
+			health.EncryptionSubkeyExpiry = subkey.ExpiresAt
+		}
+		hasEncryptionSubkey = true
+	}
+
+	switch {
+	case metadata.IsRevoked:
+		health.Status = keyStatusRevoked
+	case isExpired(health.PrimaryKeyExpiry, now),
+		!hasEncryptionSubkey,
+		isExpired(health.EncryptionSubkeyExpiry, now):
+		health.Status = keyStatusExpired
+	case isExpired(health.PrimaryKeyExpiry, now.Add(keyExpiryWarningPeriod)),
+		isExpired(health.EncryptionSubkeyExpiry, now.Add(keyExpiryWarningPeriod)):
+		health.Status = keyStatusExpiringSoon
+	}
+	return &health, nil
+}
+
+// getTeamHealth returns the health of each member's key where it isn't ok.
+// Members whose keys the server has marked revoked are reported as revoked even
+// if the stored key doesn't say so.
+func getTeamHealth(members []*models.Member, revokedMembers []*models.Member, now time.Time) (*TeamHealth, error) {
+	teamHealth := TeamHealth{Members: make([]*KeyHealth, 0)}
+	for _, member := range members {
+		health, err := getKeyHealth(member.PublicKey, now)
+		if err != nil {
+			return nil, err
+		}
+		if health.Status != keyStatusOK {
+			teamHealth.Members = append(teamHealth.Members, health)
+		}
+	}
+	for _, member := range revokedMembers {
+		health, err := getRevokedKeyHealth(member.PublicKey, now)
+		if err != nil {
+			return nil, err
+		}
+		teamHealth.Members = append(teamHealth.Members, health)
+	}
+	return &teamHealth, nil
+}
+
+func getRevokedKeyHealth(armoredPublicKey string, now time.Time) (*KeyHealth, error) {
+	health, err := getKeyHealth(armoredPublicKey, now)
+	if err != nil {
+		return nil, err
+	}
+	health.Status = keyStatusRevoked
+	return health, nil
+}
+
+// monitorKeyExpiry periodically checks every public key in the database,
+// logging a notification when a key becomes expired, revoked or about to
+// expire. It returns when ctx is cancelled.
+func monitorKeyExpiry(ctx context.Context, db models.Datastore, interval time.Duration, logger *logging.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	notifier := newKeyHealthNotifier(logger)
+	for {
+		checkKeyExpiry(ctx, db, time.Now(), notifier)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func checkKeyExpiry(ctx context.Context, db models.Datastore, now time.Time, notifier *keyHealthNotifier) {
+	publicKeys, err := db.AllPublicKeys(ctx)
+	if err != nil {
+		notifier.logger.Error("failed to load public keys for expiry check", logging.Fields{"error": err})
+		return
+	}
+	revokedKeys, err := db.AllRevokedPublicKeys(ctx)
+	if err != nil {
+		notifier.logger.Error("failed to load revoked public keys for expiry check", logging.Fields{"error": err})
+		return
+	}
+	for _, publicKey := range publicKeys {
+		notifier.check(publicKey, getKeyHealth, now)
+	}
+	for _, publicKey := range revokedKeys {
+		notifier.check(publicKey, getRevokedKeyHealth, now)
+	}
+}
+
+// A keyHealthNotifier logs the health of keys which aren't ok, remembering
+// what it last logged for each key so a key is only logged again when its
+// status changes
+type keyHealthNotifier struct {
+	logger   *logging.Logger
+	notified map[models.Fingerprint]string
+}
+
+func newKeyHealthNotifier(logger *logging.Logger) *keyHealthNotifier {
+	return &keyHealthNotifier{logger: logger, notified: map[models.Fingerprint]string{}}
+}
+
+func (n *keyHealthNotifier) check(publicKey *models.PublicKey,
+	keyHealth func(string, time.Time) (*KeyHealth, error), now time.Time) {
+
+	health, err := keyHealth(publicKey.ArmoredPublicKey, now)
+	if err != nil {
+		n.logger.Error("failed to check key expiry", logging.Fields{
+			"fingerprint": publicKey.Fingerprint.String(),
+			"error":       err,
+		})
+		return
+	}
+	if health.Status == keyStatusOK {
+		delete(n.notified, health.Fingerprint)
+		return
+	}
+	if n.notified[health.Fingerprint] == health.Status {
+		return
+	}
+	n.notified[health.Fingerprint] = health.Status
+	notifyKeyHealth(health, n.logger)
+}
+
+func notifyKeyHealth(health *KeyHealth, logger *logging.Logger) {
+	fields := logging.Fields{
+		"fingerprint": health.Fingerprint.String(),
+		"status":      health.Status,
+	}
+	switch health.Status {
+	case keyStatusRevoked:
+		logger.Warn("key has been revoked", fields)
+	case keyStatusExpired:
+		logger.Warn("key has expired", fields)
+	case keyStatusExpiringSoon:
+		logger.Info("key expires soon", fields)
+	}
+}
+
+// laterExpiry returns true if a expires after b, where nil means never.
+func laterExpiry(a *time.Time, b *time.Time) bool {
+	if a == nil {
+		return b != nil
+	}
+	return b != nil && a.After(*b)
+}
+
+func isExpired(expiry *time.Time, at time.Time) bool {
+	return expiry != nil && at.After(*expiry)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+func TestGetTeamHealth(t *testing.T) {
+	members := []*models.Member{
+		{Fingerprint: fixtures.Valid.Fingerprint, PublicKey: fixtures.Valid.Armored},
+		{Fingerprint: fixtures.Expired.Fingerprint, PublicKey: fixtures.Expired.Armored},
+	}
+	// the server can mark a key revoked before the stored key carries the
+	// revocation signature, so RSA1024's status comes from the query
+	revokedMembers := []*models.Member{
+		{Fingerprint: fixtures.RSA1024.Fingerprint, PublicKey: fixtures.RSA1024.Armored},
+	}
+
+	teamHealth, err := getTeamHealth(members, revokedMembers, time.Now())
+	if err != nil {
+		t.Fatalf("error getting team health: %v", err)
+	}
+	got := healthStatuses(teamHealth)
+	want := map[models.Fingerprint]string{
+		fixtures.Expired.Fingerprint: keyStatusExpired,
+		fixtures.RSA1024.Fingerprint: keyStatusRevoked,
+	}
+	if !equalStatuses(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestTeamHealthHandlerReportsRevokedMembers(t *testing.T) {
+	db := fakedb.New()
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Valid, fixtures.Revoked)
+	err := db.RevokePublicKey(context.Background(), fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored)
+	if err != nil {
+		t.Fatalf("error revoking key: %v", err)
+	}
+
+	res := doRequest(newTestEnv(db), "GET", "/v1/teams/"+teamUUID.String()+"/health", "")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	var teamHealth TeamHealth
+	if err := json.Unmarshal(res.Body.Bytes(), &teamHealth); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	got := healthStatuses(&teamHealth)
+	want := map[models.Fingerprint]string{fixtures.Revoked.Fingerprint: keyStatusRevoked}
+	if !equalStatuses(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestCheckKeyExpiryLogsEachStatusOnce(t *testing.T) {
+	db := fakedb.New()
+	createTestTeam(t, db, "Kiffix", fixtures.Valid, fixtures.Expired, fixtures.Revoked)
+	ctx := context.Background()
+	err := db.RevokePublicKey(ctx, fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored)
+	if err != nil {
+		t.Fatalf("error revoking key: %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	notifier := newKeyHealthNotifier(logging.New(out, logging.Info))
+	for i := 0; i < 3; i++ {
+		checkKeyExpiry(ctx, db, time.Now(), notifier)
+	}
+
+	if n := strings.Count(out.String(), "key has expired"); n != 1 {
+		t.Errorf("expected expired key to be logged once, got %d times:\n%s", n, out)
+	}
+	if n := strings.Count(out.String(), "key has been revoked"); n != 1 {
+		t.Errorf("expected revoked key to be logged once, got %d times:\n%s", n, out)
+	}
+	if strings.Contains(out.String(), fixtures.Valid.Fingerprint.String()) {
+		t.Errorf("expected valid key not to be logged:\n%s", out)
+	}
+}
+
+func healthStatuses(teamHealth *TeamHealth) map[models.Fingerprint]string {
+	statuses := map[models.Fingerprint]string{}
+	for _, health := range teamHealth.Members {
+		statuses[health.Fingerprint] = health.Status
+	}
+	return statuses
+}
+
+func equalStatuses(a map[models.Fingerprint]string, b map[models.Fingerprint]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for fingerprint, status := range a {
+		if b[fingerprint] != status {
+			return false
+		}
+	}
+	return true
+}
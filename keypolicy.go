@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/models"
+)
+
+// checkKeyPolicy returns an error explaining why armoredPublicKey isn't
+// acceptable under policy, or nil if it is
+func checkKeyPolicy(armoredPublicKey string, policy config.KeyPolicy) error {
+	metadata, err := models.ParseKeyMetadata(armoredPublicKey)
+	if err != nil {
+		return err
+	}
+	if isWeakRSA(metadata.Algorithm, metadata.BitLength, policy.MinRSABits) {
+		return fmt.Errorf("primary key is %d-bit RSA, minimum is %d bits",
+			*metadata.BitLength, policy.MinRSABits)
+	}
+	for _, subkey := range metadata.Subkeys {
+		if isWeakRSA(subkey.Algorithm, subkey.BitLength, policy.MinRSABits) {
+			return fmt.Errorf("subkey %s is %d-bit RSA, minimum is %d bits",
+				subkey.KeyID, *subkey.BitLength, policy.MinRSABits)
+		}
+	}
+	return nil
+}
+
+func isWeakRSA(algorithm string, bitLength *int, minRSABits int) bool {
+	return strings.HasPrefix(algorithm, "RSA") && bitLength != nil && *bitLength < minRSABits
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+	"github.com/fluidkeys/teamserver/models"
+)
+
+// KeysHandler is used to server up HTTP requests to `/keys`
+type KeysHandler struct{}
+
+func (h *KeysHandler) handleRevokePost(fingerprintString string, db models.Datastore) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fingerprint, err := models.ParseFingerprint(fingerprintString)
+		if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		setRequestFingerprint(req, fingerprint)
+
+		var revokePost models.RevokePOST
+		err = decodeJSON(res, req, &revokePost)
+		if err != nil {
+			writeRequestError(res, req, err)
+			return
+		}
+
+		publicKey, err := db.GetPublicKey(req.Context(), fingerprint)
+		if err == sql.ErrNoRows {
+			writeJSONMessage(res, http.StatusNotFound, "no key with fingerprint "+fingerprint.Display())
+			return
+		} else if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+
+		revocation, err := readArmoredRevocation(revokePost.RevocationSignature)
+		if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		revokedPublicKey, err := addRevocation(publicKey.ArmoredPublicKey, revocation)
+		if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = db.RevokePublicKey(req.Context(), fingerprint, revokedPublicKey)
+		if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		writeJSONMessage(res, http.StatusOK, "key "+fingerprint.Display()+" revoked")
+	})
+}
+
+// readArmoredRevocation reads a single key revocation signature. GnuPG exports
+// revocation certificates as a public key block, so either armor type is
+// accepted.
+func readArmoredRevocation(armoredRevocation string) (*packet.Signature, error) {
+	block, err := armor.Decode(strings.NewReader(armoredRevocation))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding armored revocation: %v", err)
+	}
+	if block.Type != openpgp.SignatureType && block.Type != openpgp.PublicKeyType {
+		return nil, fmt.Errorf("expected armored signature, got %s", block.Type)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading revocation: %v", err)
+	}
+	signature, ok := p.(*packet.Signature)
+	if !ok || signature.SigType != packet.SigTypeKeyRevocation {
+		return nil, fmt.Errorf("expected a key revocation signature")
+	}
+	return signature, nil
+}
+
+// addRevocation verifies the revocation signature against the primary key of
+// the armored public key, returning the key re-armored with the revocation
+// included.
+func addRevocation(armoredPublicKey string, revocation *packet.Signature) (string, error) {
+	entityList, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredPublicKey))
+	if err != nil {
+		return "", fmt.Errorf("error reading armored key ring: %v", err)
+	}
+	if len(entityList) != 1 {
+		return "", fmt.Errorf("expected 1 openpgp.Entity, got %d", len(entityList))
+	}
+	entity := entityList[0]
+
+	err = entity.PrimaryKey.VerifyRevocationSignature(revocation)
+	if err != nil {
+		return "", fmt.Errorf("invalid revocation signature: %v", err)
+	}
+	entity.Revocations = append(entity.Revocations, revocation)
+
+	// Entity.Serialize doesn't write revocations, so insert them directly
+	// after the primary key packet.
+	primaryKey := bytes.Buffer{}
+	if err = entity.PrimaryKey.Serialize(&primaryKey); err != nil {
+		return "", err
+	}
+	serialized := bytes.Buffer{}
+	if err = entity.Serialize(&serialized); err != nil {
+		return "", err
+	}
+
+	out := bytes.Buffer{}
+	armorWriter, err := armor.Encode(&out, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	armorWriter.Write(primaryKey.Bytes())
+	for _, signature := range entity.Revocations {
+		if err = signature.Serialize(armorWriter); err != nil {
+			return "", err
+		}
+	}
+	armorWriter.Write(serialized.Bytes()[primaryKey.Len():])
+	if err = armorWriter.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,148 @@
+// Package logging writes leveled, structured log lines as JSON, one object
+// per line, so they can be searched and filtered by field.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Level is the severity of a log line
+type Level int
+
+// Log levels, from least to most severe
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level with the given name, e.g. "info"
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return Level(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// Fields are the key-value pairs logged with a message
+type Fields map[string]interface{}
+
+// A Logger writes log lines at or above its level, each including the fields
+// the logger was created With
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  Level
+	fields Fields
+	now    func() time.Time
+}
+
+// New returns a Logger writing lines at or above level to out
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, mu: &sync.Mutex{}, level: level, fields: Fields{}, now: time.Now}
+}
+
+var defaultLogger = New(os.Stderr, Info)
+
+// With returns a Logger which adds fields to every line it writes
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	child := *l
+	child.fields = merged
+	return &child
+}
+
+// Enabled returns true if lines at level would be written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug logs detail only needed when investigating a problem
+func (l *Logger) Debug(message string, fields Fields) { l.log(Debug, message, fields) }
+
+// Info logs normal operation, such as requests being served
+func (l *Logger) Info(message string, fields Fields) { l.log(Info, message, fields) }
+
+// Warn logs something unexpected which the server recovered from
+func (l *Logger) Warn(message string, fields Fields) { l.log(Warn, message, fields) }
+
+// Error logs a failure which needs looking into
+func (l *Logger) Error(message string, fields Fields) { l.log(Error, message, fields) }
+
+func (l *Logger) log(level Level, message string, fields Fields) {
+	if !l.Enabled(level) {
+		return
+	}
+	line := Fields{}
+	for key, value := range l.fields {
+		line[key] = value
+	}
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error() // errors have no exported fields to marshal
+		}
+		line[key] = value
+	}
+	line["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = message
+
+	out, err := json.Marshal(line)
+	if err != nil {
+		out, _ = json.Marshal(Fields{
+			"time":  line["time"],
+			"level": Error.String(),
+			"msg":   "error marshalling log line",
+			"error": err.Error(),
+		})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(out, '\n'))
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the Logger carried by ctx, or a Logger writing info
+// and above to stderr if there isn't one
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
+
+// Discard returns a Logger which writes nothing
+func Discard() *Logger {
+	return New(ioutil.Discard, Error+1)
+}
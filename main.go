@@ -1,93 +1,181 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"path"
-	"strings"
 
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/logging"
 	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/tracing"
 
 	_ "github.com/lib/pq"
 )
 
-const (
-	host   = "localhost"
-	port   = 5432
-	user   = "teamserver"
-	dbname = "teamserver_development"
-)
-
-var (
-	password = os.Getenv("TEAMSERVER_PASSWORD")
-)
-
 // Env provides a way to hook into the database
 type Env struct {
 	db           models.Datastore
+	config       *config.Config
 	TeamsHandler *TeamsHandler
+	KeysHandler  *KeysHandler
+	rateLimiter  *rateLimiter
+	metrics      *serverMetrics
+	readiness    *readinessChecks
+	tracer       *tracing.Tracer
+	router       *Router
+	handler      http.Handler
+}
+
+// newEnv sets up the handlers and routes for serving requests from db,
+// recording metrics in m
+func newEnv(db models.Datastore, cfg *config.Config, m *serverMetrics, logger *logging.Logger) *Env {
+	env := &Env{
+		db:     db,
+		config: cfg,
+		TeamsHandler: &TeamsHandler{
+			SummaryHandler:    new(SummaryHandler),
+			RequestHandler:    &RequestHandler{KeyPolicy: cfg.KeyPolicy},
+			TeamHealthHandler: new(TeamHealthHandler),
+			PayloadHandler:    new(PayloadHandler),
+			KeyPolicy:         cfg.KeyPolicy,
+		},
+		KeysHandler: new(KeysHandler),
+		rateLimiter: newRateLimiter(cfg.RateLimits, db),
+		metrics:     m,
+		readiness:   &readinessChecks{},
+		tracer:      newTracer(cfg.Tracing, logger.With(logging.Fields{"component": "tracing"})),
+	}
+	env.router = newRouter(env)
+	env.handler = logRequests(logger, m.instrumentRequests(
+		withTimeout(cfg.Server.RequestTimeout.Duration, env.router)))
+	return env
 }
 
+// ServeHTTP serves req, recording a span for it which continues the trace of
+// the caller if it sent a traceparent header
 func (env *Env) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	var head string
-	head, req.URL.Path = shiftPath(req.URL.Path)
-	if head == "teams" {
-		env.TeamsHandler.ServeHTTP(res, req, env.db)
+	ctx := req.Context()
+	if parent, ok := tracing.Extract(req.Header); ok {
+		ctx = tracing.ContextWithRemoteParent(ctx, parent)
+	}
+	ctx, span := env.tracer.Start(ctx, req.Method, tracing.Server)
+	if span == nil {
+		env.handler.ServeHTTP(res, req)
 		return
 	}
-	http.Error(res, "Not Found", http.StatusNotFound)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+
+	recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+	env.handler.ServeHTTP(recorder, req.WithContext(ctx))
+
+	span.SetAttribute("http.status_code", recorder.status)
+	if recorder.status >= 500 {
+		span.SetError(fmt.Errorf("%s", http.StatusText(recorder.status)))
+	}
+	span.End()
 }
 
 func main() {
-	db, err := models.NewDB(connStr())
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// config commands don't need the database, so they work even when it's
+	// unreachable or misconfigured
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfigCommand(os.Args[2:], cfg)
+		return
+	}
+
+	level, _ := logging.ParseLevel(cfg.Logging.Level) // checked by config.Load
+	logger := logging.New(os.Stderr, level)
+
+	db, err := models.NewDB(cfg.DatabaseDSN(), logger)
 	if err != nil {
 		log.Panic(err)
 	}
-	env := &Env{db, new(TeamsHandler)}
 
-	err = http.ListenAndServe(Port(), env)
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], db)
+		return
+	}
+	m := newServerMetrics(db, logger.With(logging.Fields{"component": "metrics"}))
+	env := newEnv(traceDatastore(m.instrumentDatastore(db)), cfg, m, logger)
+	env.readiness.add("database", db.PingContext)
+	env.readiness.add("schema", db.CheckSchemaVersion)
+
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	if cfg.Features.KeyExpiryMonitor {
+		go monitorKeyExpiry(monitorCtx, db, cfg.KeyPolicy.ExpiryCheckInterval.Duration,
+			logger.With(logging.Fields{"component": "keyExpiryMonitor"}))
+	}
+	go sweepIdempotentResponses(monitorCtx, db, idempotencySweepInterval,
+		logger.With(logging.Fields{"component": "idempotencySweeper"}))
+	if cfg.RateLimits.Enabled && cfg.RateLimits.Store == "postgres" {
+		go sweepRateLimitBuckets(monitorCtx, db, postgresRateLimitSweepInterval,
+			logger.With(logging.Fields{"component": "rateLimits"}))
+	}
+
+	err = serve(cfg, env, logger)
+	stopMonitor()
+	if shutdownErr := env.tracer.Shutdown(context.Background()); shutdownErr != nil {
+		logger.Error("error exporting spans", logging.Fields{"error": shutdownErr})
+	}
+	if closeErr := db.Close(); closeErr != nil {
+		logger.Error("error closing database", logging.Fields{"error": closeErr})
+	}
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("serve: ", err)
 	}
 }
 
-// Port retrieves the port from the environment so we can run on Heroku
-func Port() string {
-	var port = os.Getenv("PORT")
-	// Set a default port if there is nothing in the environment
-	if port == "" {
-		port = "4747"
-		fmt.Println("INFO: No PORT environment variable detected, defaulting to " + port)
+// runCommand runs one of the administrative commands given on the command line
+// instead of starting the server
+func runCommand(command string, db *models.DB) {
+	switch command {
+	case "backfill-key-metadata":
+		count, err := db.BackfillKeyMetadata(context.Background())
+		if err != nil {
+			log.Fatalf("backfill failed after %d keys: %v", count, err)
+		}
+		fmt.Printf("Backfilled metadata for %d keys\n", count)
+	default:
+		log.Fatalf("unknown command: %s", command)
 	}
-	return ":" + port
 }
 
-func connStr() string {
-	herokuDatabaseURL, present := os.LookupEnv("DATABASE_URL")
-	if present {
-		return herokuDatabaseURL
+// runConfigCommand runs a `teamserver config` subcommand
+func runConfigCommand(args []string, cfg *config.Config) {
+	if len(args) == 0 {
+		log.Fatal("usage: teamserver config print")
+	}
+	switch args[0] {
+	case "print":
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown config command: %s", args[0])
 	}
-	return fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
 }
 
-func formatAsJSONMessage(message string) string {
-	bytes, _ := json.Marshal(map[string]string{"message": message})
-	return string(bytes)
+// writeJSON writes body, which is already JSON, as the response with status
+func writeJSON(res http.ResponseWriter, status int, body []byte) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+	res.Write(body)
 }
 
-// ShiftPath splits off the first component of p, which will be cleaned of
-// relative components before processing. head will never contain a slash and
-// tail will always be a rooted path without trailing slash.
-func shiftPath(p string) (head, tail string) {
-	p = path.Clean("/" + p)
-	i := strings.Index(p[1:], "/") + 1
-	if i <= 0 {
-		return p[1:], "/"
-	}
-	return p[1:i], p[i:]
+// writeJSONMessage writes message as a JSON Message with status, for errors
+// and simple acknowledgements
+func writeJSONMessage(res http.ResponseWriter, status int, message string) {
+	out, _ := json.Marshal(Message{Message: message})
+	writeJSON(res, status, out)
 }
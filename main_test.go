@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/dbtest"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+	uuid "github.com/satori/go.uuid"
+)
+
+// newTestEnv returns an Env using the default config over db, which logs
+// nothing
+func newTestEnv(db models.Datastore) *Env {
+	return newEnv(db, config.Default(), newServerMetrics(nil, logging.Discard()), logging.Discard())
+}
+
+// doRequest makes a request to env, sending body as JSON if it isn't empty
+func doRequest(env http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res := httptest.NewRecorder()
+	env.ServeHTTP(res, req)
+	return res
+}
+
+// openTestDatabase returns a throwaway Postgres database with every migration
+// applied, skipping the test if there isn't one to test against
+func openTestDatabase(t *testing.T) *dbtest.Database {
+	db, err := dbtest.Open(dbtest.MigrationsDir())
+	if err == dbtest.ErrNoDatabase {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatalf("error opening test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestTeam creates a team in db with the given keys as its members,
+// returning the team's UUID
+func createTestTeam(t *testing.T, db models.Datastore, name string, keys ...fixtures.Key) uuid.UUID {
+	var teamUUID *uuid.UUID
+	err := db.WithTx(context.Background(), func(tx models.Tx) error {
+		teamID, createdUUID, err := tx.CreateTeam(name)
+		if err != nil {
+			return err
+		}
+		teamUUID = createdUUID
+		for _, key := range keys {
+			if _, err := tx.CreatePublicKey(key.Fingerprint, key.Armored); err != nil {
+				return err
+			}
+			if _, err := tx.CreateTeamUser(teamID, key.Fingerprint); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating team: %v", err)
+	}
+	return *teamUUID
+}
+
+func TestRouterErrorsAreJSON(t *testing.T) {
+	for _, test := range []struct {
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"GET", "/v1/nothing-here", http.StatusNotFound},
+		{"DELETE", "/v1/teams", http.StatusMethodNotAllowed},
+	} {
+		res := doRequest(newTestEnv(fakedb.New()), test.method, test.path, "")
+		if res.Code != test.wantStatus {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.path, test.wantStatus, res.Code)
+		}
+		if got := res.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s %s: expected Content-Type application/json, got %q", test.method, test.path, got)
+		}
+		var message Message
+		if err := json.Unmarshal(res.Body.Bytes(), &message); err != nil || message.Message == "" {
+			t.Errorf("%s %s: expected a JSON message, got %s", test.method, test.path, res.Body)
+		}
+	}
+}
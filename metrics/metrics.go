@@ -0,0 +1,290 @@
+// Package metrics records counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram bucket upper bounds in seconds suitable for
+// request and query latencies
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds metrics and writes them out when scraped
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[m.name()] {
+		panic("metrics: " + m.name() + " is already registered")
+	}
+	r.names[m.name()] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes every registered metric in the Prometheus text format
+func (r *Registry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(res)
+	for _, m := range metrics {
+		m.write(w)
+	}
+	w.Flush()
+}
+
+// labelSet is the values of a metric's labels, joined so they can key a map
+type labelSet string
+
+const labelSeparator = "\xff"
+
+func newLabelSet(labelNames []string, labelValues []string) labelSet {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(labelNames), len(labelValues)))
+	}
+	return labelSet(strings.Join(labelValues, labelSeparator))
+}
+
+// format returns the labels as written after the metric name, e.g.
+// {method="GET",status="200"}, with extra appended
+func (s labelSet) format(labelNames []string, extra ...string) string {
+	pairs := []string{}
+	if len(labelNames) > 0 {
+		for i, value := range strings.Split(string(s), labelSeparator) {
+			pairs = append(pairs, labelNames[i]+`="`+escapeLabelValue(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// sortedKeys returns the label sets in a stable order so scrapes are easy to
+// read and compare
+func sortedKeys(m map[labelSet]bool) []labelSet {
+	keys := make([]labelSet, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// A CounterVec is a set of counters, one for each combination of label
+// values, which only ever go up
+type CounterVec struct {
+	metricName string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[labelSet]float64
+}
+
+// NewCounterVec registers a CounterVec with the given labels
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{metricName: name, help: help, labelNames: labelNames, values: map[labelSet]float64{}}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the counter with the given
+// label values
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters can't go down")
+	}
+	key := newLabelSet(c.labelNames, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += delta
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.metricName, c.help, "counter")
+	keys := map[labelSet]bool{}
+	for key := range c.values {
+		keys[key] = true
+	}
+	for _, key := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, key.format(c.labelNames), formatFloat(c.values[key]))
+	}
+}
+
+// A HistogramVec is a set of histograms, one for each combination of label
+// values, counting observations into buckets
+type HistogramVec struct {
+	metricName string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mu         sync.Mutex
+	histograms map[labelSet]*histogram
+}
+
+type histogram struct {
+	bucketCounts []uint64 // not cumulative; the last is for +Inf
+	sum          float64
+	count        uint64
+}
+
+// NewHistogramVec registers a HistogramVec with the given bucket upper bounds
+// and labels
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		metricName: name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		histograms: map[labelSet]*histogram{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records value in the histogram with the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := newLabelSet(h.labelNames, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{bucketCounts: make([]uint64, len(h.buckets)+1)}
+		h.histograms[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, value) // first bucket with bound >= value
+	hist.bucketCounts[i]++
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) name() string { return h.metricName }
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.metricName, h.help, "histogram")
+	keys := map[labelSet]bool{}
+	for key := range h.histograms {
+		keys[key] = true
+	}
+	for _, key := range sortedKeys(keys) {
+		hist := h.histograms[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.bucketCounts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+				key.format(h.labelNames, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, key.format(h.labelNames, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, key.format(h.labelNames), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, key.format(h.labelNames), hist.count)
+	}
+}
+
+// A Sample is one value of a metric collected by a func, with its label
+// values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// funcMetric is a gauge or counter whose values are collected by calling a
+// func each time metrics are scraped
+type funcMetric struct {
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+	collect    func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose samples are collected by calling
+// collect each time metrics are scraped. collect returning no samples, such as
+// when the value couldn't be read, leaves the gauge out of the scrape.
+func (r *Registry) NewGaugeFunc(name string, help string, collect func() []Sample, labelNames ...string) {
+	r.register(&funcMetric{name, help, "gauge", labelNames, collect})
+}
+
+// NewCounterFunc registers a counter whose samples are collected by calling
+// collect each time metrics are scraped, for counts kept elsewhere such as in
+// sql.DBStats
+func (r *Registry) NewCounterFunc(name string, help string, collect func() []Sample, labelNames ...string) {
+	r.register(&funcMetric{name, help, "counter", labelNames, collect})
+}
+
+func (f *funcMetric) name() string { return f.metricName }
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	samples := f.collect()
+	if len(samples) == 0 {
+		return
+	}
+	writeHeader(w, f.metricName, f.help, f.metricType)
+	for _, sample := range samples {
+		key := newLabelSet(f.labelNames, sample.LabelValues)
+		fmt.Fprintf(w, "%s%s %s\n", f.metricName, key.format(f.labelNames), formatFloat(sample.Value))
+	}
+}
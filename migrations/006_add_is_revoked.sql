@@ -0,0 +1 @@
+ALTER TABLE public_keys ADD COLUMN is_revoked BOOLEAN NOT NULL DEFAULT false;
\ No newline at end of file
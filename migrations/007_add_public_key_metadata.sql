@@ -0,0 +1,26 @@
+ALTER TABLE public_keys
+  ADD COLUMN algorithm VARCHAR
+, ADD COLUMN bit_length INT
+, ADD COLUMN key_created_at TIMESTAMP
+, ADD COLUMN key_expires_at TIMESTAMP
+;
+CREATE TABLE public_key_subkeys (
+  id SERIAL UNIQUE
+, fingerprint VARCHAR REFERENCES public_keys (fingerprint) ON UPDATE CASCADE ON DELETE CASCADE
+, subkey_fingerprint VARCHAR NOT NULL
+, key_id VARCHAR NOT NULL
+, algorithm VARCHAR
+, bit_length INT
+, key_created_at TIMESTAMP
+, key_expires_at TIMESTAMP
+, is_revoked BOOLEAN NOT NULL DEFAULT false
+, can_encrypt BOOLEAN NOT NULL DEFAULT false
+, can_sign BOOLEAN NOT NULL DEFAULT false
+, PRIMARY KEY (fingerprint,subkey_fingerprint)
+);
+CREATE TABLE public_key_user_ids (
+  id SERIAL UNIQUE
+, fingerprint VARCHAR REFERENCES public_keys (fingerprint) ON UPDATE CASCADE ON DELETE CASCADE
+, user_id TEXT NOT NULL
+, PRIMARY KEY (fingerprint,user_id)
+);
\ No newline at end of file
@@ -0,0 +1 @@
+UPDATE public_keys SET fingerprint = UPPER(REPLACE(fingerprint, ' ', ''));
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE idempotency_keys (
+  id SERIAL UNIQUE
+, key VARCHAR(255) NOT NULL
+, method VARCHAR(16) NOT NULL
+, path VARCHAR NOT NULL
+, request_hash VARCHAR(64) NOT NULL
+, status_code INT NOT NULL
+, response_body TEXT
+, created_at TIMESTAMP NOT NULL DEFAULT NOW()
+, PRIMARY KEY (key,method,path)
+);
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE TABLE rate_limit_buckets (
+  key VARCHAR PRIMARY KEY
+, tokens DOUBLE PRECISION NOT NULL
+, allowed BOOLEAN NOT NULL
+, updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE schema_version (
+  version INT NOT NULL
+);
+
+-- Every later migration ends by setting this to its own number, so the
+-- server can check the schema it is running against
+INSERT INTO schema_version (version) VALUES (11);
\ No newline at end of file
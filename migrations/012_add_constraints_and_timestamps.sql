@@ -0,0 +1,49 @@
+-- Teams are looked up by UUID, so every team needs one of its own. CreateTeam
+-- has always set it; this covers any rows made by hand.
+UPDATE teams SET uuid = md5(random()::text || id::text)::uuid WHERE uuid IS NULL;
+ALTER TABLE teams
+  ALTER COLUMN uuid SET NOT NULL
+, ADD CONSTRAINT teams_uuid_key UNIQUE (uuid)
+;
+
+-- Rows which existed before this migration get its time as their timestamps.
+-- updated_at is set by the statements which update each table.
+ALTER TABLE teams
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW()
+, ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+ALTER TABLE public_keys
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW()
+, ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+ALTER TABLE team_users
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW()
+, ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+UPDATE team_join_requests SET created_at = NOW() WHERE created_at IS NULL;
+ALTER TABLE team_join_requests
+  ALTER COLUMN created_at SET DEFAULT NOW()
+, ALTER COLUMN created_at SET NOT NULL
+, ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+ALTER TABLE public_key_subkeys
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW()
+, ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+ALTER TABLE public_key_user_ids
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW()
+, ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+ALTER TABLE idempotency_keys
+  ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+ALTER TABLE rate_limit_buckets
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+
+-- Revoking a key finds its memberships and join requests by fingerprint, which
+-- is the second column of those tables' primary keys so can't use them
+CREATE INDEX team_users_fingerprint_idx ON team_users (fingerprint);
+CREATE INDEX team_join_requests_fingerprint_idx ON team_join_requests (fingerprint);
+
+UPDATE schema_version SET version = 12;
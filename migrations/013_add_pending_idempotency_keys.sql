@@ -0,0 +1,21 @@
+-- A request with an Idempotency-Key claims it by storing a row with no status
+-- code, which is filled in with the response once there is one. Concurrent
+-- retries see the key is claimed rather than handling the request again.
+--
+-- Keys are chosen by clients, so each client has its own: two clients picking
+-- the same key mustn't get each other's responses. Existing rows can't be
+-- given a client, so they're dropped and those requests handled again if
+-- they're retried.
+DELETE FROM idempotency_keys;
+ALTER TABLE idempotency_keys
+  ALTER COLUMN status_code DROP NOT NULL
+, ADD COLUMN response_headers TEXT
+, ADD COLUMN client VARCHAR(255) NOT NULL
+, DROP CONSTRAINT idempotency_keys_pkey
+, ADD PRIMARY KEY (client, key, method, path)
+;
+
+-- Completed responses are deleted once they're older than the retention window
+CREATE INDEX idempotency_keys_updated_at_idx ON idempotency_keys (updated_at);
+
+UPDATE schema_version SET version = 13;
@@ -0,0 +1,9 @@
+-- Certificates, their private keys and the ACME account key, stored by
+-- autocert so every server process shares them and they survive restarts
+CREATE TABLE acme_cache (
+  key VARCHAR PRIMARY KEY
+, data BYTEA NOT NULL
+, updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+UPDATE schema_version SET version = 14;
@@ -0,0 +1,8 @@
+-- full_at is when a bucket will have refilled, after which it's the same as
+-- no bucket at all and can be deleted
+ALTER TABLE rate_limit_buckets
+  ADD COLUMN full_at TIMESTAMP NOT NULL DEFAULT NOW()
+;
+CREATE INDEX rate_limit_buckets_full_at ON rate_limit_buckets (full_at);
+
+UPDATE schema_version SET version = 15;
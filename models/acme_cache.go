@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+)
+
+// GetACMECacheEntry returns the data stored under key for the ACME
+// certificate manager, returning sql.ErrNoRows if there isn't any.
+func (db *DB) GetACMECacheEntry(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := db.QueryRowContext(ctx, `SELECT data FROM acme_cache WHERE key=$1`, key).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// PutACMECacheEntry stores data under key, replacing anything already there
+func (db *DB) PutACMECacheEntry(ctx context.Context, key string, data []byte) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO acme_cache (key, data) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET data=$2, updated_at=NOW()`, key, data)
+	return err
+}
+
+// DeleteACMECacheEntry deletes the data stored under key, if there is any
+func (db *DB) DeleteACMECacheEntry(ctx context.Context, key string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM acme_cache WHERE key=$1`, key)
+	return err
+}
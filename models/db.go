@@ -1,31 +1,58 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
+	"github.com/fluidkeys/teamserver/logging"
 	uuid "github.com/satori/go.uuid"
 )
 
 // Datastore is an interface specifiying all the ways of interacting with the
-// database
+// database. Every method takes a context: if it's cancelled, such as when the
+// client disconnects or the request's deadline passes, queries are abandoned.
 type Datastore interface {
-	AllTeams() ([]*Team, error)
-	CreateTeam(string) (int64, *uuid.UUID, error)
-	CreateTeamUser(int64, string) (int64, error)
-	CreatePublicKey(string, string) (int64, error)
-	GetTeam(uuid.UUID) (*Team, error)
-	CreateTeamJoinRequest(string, string) (int64, error)
-	GetTeamMembers(int) ([]*Member, error)
-	GetTeamJoinRequests(int) ([]*JoinRequest, error)
+	AllTeams(context.Context) ([]*Team, error)
+	CreateTeam(context.Context, string) (int64, *uuid.UUID, error)
+	CreateTeamUser(context.Context, int64, Fingerprint) (int64, error)
+	CreatePublicKey(context.Context, Fingerprint, string) (int64, error)
+	GetTeam(context.Context, uuid.UUID) (*Team, error)
+	GetTeamWithMembers(context.Context, uuid.UUID) (*Team, error)
+	CreateTeamJoinRequest(context.Context, Fingerprint, string) (int64, error)
+	GetTeamMembers(context.Context, int) ([]*Member, error)
+	GetTeamMembersWithRevoked(context.Context, uuid.UUID) ([]*Member, []*Member, error)
+	GetTeamJoinRequests(context.Context, int) ([]*JoinRequest, error)
+	GetTeamJoinRequest(context.Context, string, Fingerprint) (*JoinRequest, error)
+	AllPublicKeys(context.Context) ([]*PublicKey, error)
+	AllRevokedPublicKeys(context.Context) ([]*PublicKey, error)
+	GetPublicKey(context.Context, Fingerprint) (*PublicKey, error)
+	RevokePublicKey(context.Context, Fingerprint, string) error
+	GetIdempotentResponse(context.Context, string, string, string, string) (*IdempotentResponse, error)
+	ClaimIdempotencyKey(context.Context, *IdempotentResponse, time.Duration) (*IdempotentResponse, error)
+	CompleteIdempotentResponse(context.Context, *IdempotentResponse) error
+	ReleaseIdempotencyKey(context.Context, string, string, string, string) error
+	DeleteIdempotentResponses(context.Context, time.Duration) (int64, error)
+	TakeRateLimitToken(context.Context, string, float64, int) (bool, time.Duration, error)
+	ReturnRateLimitToken(context.Context, string, int) error
+	DeleteFullRateLimitBuckets(context.Context) (int64, error)
+	GetACMECacheEntry(context.Context, string) ([]byte, error)
+	PutACMECacheEntry(context.Context, string, []byte) error
+	DeleteACMECacheEntry(context.Context, string) error
+	CountRecords(context.Context) (*RecordCounts, error)
+	WithTx(context.Context, func(Tx) error) error
 }
 
 // DB is a struct the points at a sql database
 type DB struct {
 	*sql.DB
+	log *logging.Logger
 }
 
-// NewDB populates the global db variable with an opened postgres database
-func NewDB(dataSourceName string) (*DB, error) {
+// NewDB populates the global db variable with an opened postgres database,
+// logging problems the caller can't be told about, such as failed rollbacks,
+// to logger
+func NewDB(dataSourceName string, logger *logging.Logger) (*DB, error) {
 	db, err := sql.Open("postgres", dataSourceName)
 	if err != nil {
 		return nil, err
@@ -33,5 +60,14 @@ func NewDB(dataSourceName string) (*DB, error) {
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	return &DB{db, logger.With(logging.Fields{"component": "models"})}, nil
+}
+
+// rollback rolls back sqlTx after cause stopped it committing, logging if the
+// rollback itself fails since the caller will only see cause
+func (db *DB) rollback(sqlTx *sql.Tx, cause interface{}) {
+	db.log.Debug("rolling back transaction", logging.Fields{"cause": cause})
+	if err := sqlTx.Rollback(); err != nil {
+		db.log.Error("error rolling back transaction", logging.Fields{"error": err, "cause": cause})
+	}
 }
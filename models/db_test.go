@@ -0,0 +1,19 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/fluidkeys/teamserver/models/dbtest"
+)
+
+func TestDatastoreWithPostgres(t *testing.T) {
+	db, err := dbtest.Open(dbtest.MigrationsDir())
+	if err == dbtest.ErrNoDatabase {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatalf("error opening test database: %v", err)
+	}
+	defer db.Close()
+
+	dbtest.RunDatastoreTests(t, dbtest.OpenForTest(db))
+}
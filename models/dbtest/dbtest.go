@@ -0,0 +1,194 @@
+// Package dbtest gives integration tests a throwaway Postgres database with
+// every migration applied, and a suite of tests any models.Datastore should
+// pass.
+//
+// The database is a new schema in the database named by
+// TEAMSERVER_TEST_DATABASE_URL or, if that isn't set, in a temporary Postgres
+// server started with the initdb and postgres binaries on the PATH. If neither
+// is available Open returns ErrNoDatabase, so tests can skip.
+package dbtest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+
+	_ "github.com/lib/pq"
+)
+
+// DatabaseURLVariable names the environment variable giving the Postgres
+// database tests create their schemas in
+const DatabaseURLVariable = "TEAMSERVER_TEST_DATABASE_URL"
+
+// ErrNoDatabase is returned by Open when there's no database to test against
+var ErrNoDatabase = errors.New("dbtest: set " + DatabaseURLVariable +
+	" or put initdb and postgres on the PATH to run database tests")
+
+// skippedMigrations create the database and its user, which the test database
+// already has
+var skippedMigrations = map[string]bool{"001_create_database.sql": true}
+
+// Database is a models.DB using a schema which is dropped on Close
+type Database struct {
+	*models.DB
+	schema string
+	admin  *sql.DB
+	server *localServer
+}
+
+// Open creates a schema with every migration in migrationsDir applied, and
+// returns a DB using it. Use MigrationsDir for the repository's migrations.
+func Open(migrationsDir string) (*Database, error) {
+	d := &Database{}
+	if err := d.open(migrationsDir); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Database) open(migrationsDir string) (err error) {
+	dsn := lookupDatabaseURL()
+	if dsn == "" {
+		if d.server, err = startLocalServer(); err != nil {
+			return err
+		}
+		dsn = d.server.dsn
+	}
+
+	if d.admin, err = sql.Open("postgres", dsn); err != nil {
+		return err
+	}
+	d.schema = "teamserver_test_" + randomHex(8)
+	if _, err = d.admin.Exec(`CREATE SCHEMA ` + d.schema); err != nil {
+		return fmt.Errorf("dbtest: error creating schema: %v", err)
+	}
+
+	schemaDSN, err := withSearchPath(dsn, d.schema)
+	if err != nil {
+		return err
+	}
+	if d.DB, err = models.NewDB(schemaDSN, logging.Discard()); err != nil {
+		return err
+	}
+	// Every connection needs the search_path, which a pool of one guarantees
+	// doesn't get lost when connections are replaced
+	d.SetMaxOpenConns(1)
+
+	return d.migrate(migrationsDir)
+}
+
+// MigrationsDir returns the path of the repository's migrations directory
+func MigrationsDir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "migrations")
+}
+
+func (d *Database) migrate(migrationsDir string) error {
+	filenames, err := filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	if len(filenames) == 0 {
+		return fmt.Errorf("dbtest: no migrations in %s", migrationsDir)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		if skippedMigrations[filepath.Base(filename)] {
+			continue
+		}
+		migration, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if _, err = d.Exec(string(migration)); err != nil {
+			return fmt.Errorf("dbtest: error applying %s: %v", filepath.Base(filename), err)
+		}
+	}
+	return nil
+}
+
+// Truncate deletes every row written by a test, leaving the schema as it was
+// after migrating
+func (d *Database) Truncate(ctx context.Context) error {
+	rows, err := d.QueryContext(ctx, `SELECT table_name FROM information_schema.tables
+		WHERE table_schema=$1 AND table_name <> 'schema_version'`, d.schema)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tables := []string{}
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	_, err = d.ExecContext(ctx, `TRUNCATE `+strings.Join(tables, ", ")+` RESTART IDENTITY CASCADE`)
+	return err
+}
+
+// Close drops the schema and stops the temporary server, if one was started
+func (d *Database) Close() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if d.DB != nil {
+		keep(d.DB.Close())
+	}
+	if d.admin != nil {
+		if d.schema != "" {
+			_, err := d.admin.Exec(`DROP SCHEMA IF EXISTS ` + d.schema + ` CASCADE`)
+			keep(err)
+		}
+		keep(d.admin.Close())
+	}
+	if d.server != nil {
+		keep(d.server.stop())
+	}
+	return firstErr
+}
+
+// withSearchPath returns dsn, in URL or key=value form, with its search_path
+// set to schema
+func withSearchPath(dsn string, schema string) (string, error) {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + schema, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", fmt.Errorf("dbtest: %s: %v", DatabaseURLVariable, err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
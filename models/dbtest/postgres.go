@@ -0,0 +1,113 @@
+package dbtest
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localServerStartTimeout is how long to wait for a temporary Postgres server
+// to accept connections
+const localServerStartTimeout = 30 * time.Second
+
+func lookupDatabaseURL() string {
+	return strings.TrimSpace(os.Getenv(DatabaseURLVariable))
+}
+
+// localServer is a Postgres server in a temporary directory, listening only on
+// a Unix socket in that directory so it can't clash with any other server
+type localServer struct {
+	dir  string
+	cmd  *exec.Cmd
+	dsn  string
+	once sync.Once
+}
+
+// startLocalServer initialises a database cluster and starts a server for it.
+// initdb refuses to run as root, so this only works as an ordinary user.
+func startLocalServer() (*localServer, error) {
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		return nil, ErrNoDatabase
+	}
+	postgres, err := exec.LookPath("postgres")
+	if err != nil {
+		return nil, ErrNoDatabase
+	}
+
+	dir, err := ioutil.TempDir("", "teamserver-dbtest-")
+	if err != nil {
+		return nil, err
+	}
+	server := &localServer{
+		dir: dir,
+		dsn: fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", dir),
+	}
+	dataDir := filepath.Join(dir, "data")
+	output, err := exec.Command(initdb, "--pgdata", dataDir, "--username", "postgres",
+		"--auth", "trust", "--encoding", "UTF8", "--no-sync").CombinedOutput()
+	if err != nil {
+		server.stop()
+		return nil, fmt.Errorf("dbtest: initdb failed: %v\n%s", err, output)
+	}
+
+	server.cmd = exec.Command(postgres, "-D", dataDir, "-k", dir,
+		"-c", "listen_addresses=", "-c", "fsync=off", "-c", "full_page_writes=off")
+	logFile, err := os.Create(filepath.Join(dir, "postgres.log"))
+	if err != nil {
+		server.stop()
+		return nil, err
+	}
+	defer logFile.Close()
+	server.cmd.Stdout = logFile
+	server.cmd.Stderr = logFile
+	if err = server.cmd.Start(); err != nil {
+		server.stop()
+		return nil, fmt.Errorf("dbtest: error starting postgres: %v", err)
+	}
+
+	if err = server.waitUntilReady(); err != nil {
+		log, _ := ioutil.ReadFile(filepath.Join(dir, "postgres.log"))
+		server.stop()
+		return nil, fmt.Errorf("%v\n%s", err, log)
+	}
+	return server, nil
+}
+
+func (s *localServer) waitUntilReady() error {
+	db, err := sql.Open("postgres", s.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	deadline := time.Now().Add(localServerStartTimeout)
+	for {
+		if err = db.Ping(); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dbtest: postgres didn't start within %s: %v", localServerStartTimeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stop shuts the server down and deletes its files
+func (s *localServer) stop() error {
+	var err error
+	s.once.Do(func() {
+		if s.cmd != nil && s.cmd.Process != nil {
+			// SIGINT is Postgres' "fast" shutdown: disconnect clients and stop
+			s.cmd.Process.Signal(os.Interrupt)
+			s.cmd.Wait()
+		}
+		err = os.RemoveAll(s.dir)
+	})
+	return err
+}
@@ -0,0 +1,517 @@
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+// RunDatastoreTests checks db behaves as the models.Datastore interface is
+// documented to, such as returning sql.ErrNoRows for missing records. open is
+// called for each test and must return an empty Datastore, so the same tests
+// can prove Postgres and any other implementation behave the same.
+func RunDatastoreTests(t *testing.T, open func(t *testing.T) models.Datastore) {
+	tests := []struct {
+		name string
+		test func(ctx context.Context, t *testing.T, db models.Datastore)
+	}{
+		{"CreateTeam", testCreateTeam},
+		{"GetTeamNotFound", testGetTeamNotFound},
+		{"JoinRequests", testJoinRequests},
+		{"GetTeamWithMembers", testGetTeamWithMembers},
+		{"RevokePublicKey", testRevokePublicKey},
+		{"IdempotentResponses", testIdempotentResponses},
+		{"RateLimitTokens", testRateLimitTokens},
+		{"ReturnRateLimitToken", testReturnRateLimitToken},
+		{"DeleteFullRateLimitBuckets", testDeleteFullRateLimitBuckets},
+		{"ACMECache", testACMECache},
+		{"CountRecords", testCountRecords},
+		{"WithTxRollsBack", testWithTxRollsBack},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(context.Background(), t, open(t))
+		})
+	}
+}
+
+// OpenForTest returns a function for RunDatastoreTests which truncates d
+// before each test
+func OpenForTest(d *Database) func(t *testing.T) models.Datastore {
+	return func(t *testing.T) models.Datastore {
+		if err := d.Truncate(context.Background()); err != nil {
+			t.Fatalf("error truncating database: %v", err)
+		}
+		return d
+	}
+}
+
+// createTeam creates a team with key as its admin, returning the team's UUID
+func createTeam(ctx context.Context, t *testing.T, db models.Datastore, name string, key fixtures.Key) uuid.UUID {
+	var teamUUID *uuid.UUID
+	err := db.WithTx(ctx, func(tx models.Tx) error {
+		if _, err := tx.CreatePublicKey(key.Fingerprint, key.Armored); err != nil {
+			return err
+		}
+		teamID, createdUUID, err := tx.CreateTeam(name)
+		if err != nil {
+			return err
+		}
+		teamUUID = createdUUID
+		_, err = tx.CreateTeamUser(teamID, key.Fingerprint)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error creating team: %v", err)
+	}
+	return *teamUUID
+}
+
+func testCreateTeam(ctx context.Context, t *testing.T, db models.Datastore) {
+	admin := fixtures.Valid
+	teamUUID := createTeam(ctx, t, db, "Kiffix", admin)
+
+	team, err := db.GetTeam(ctx, teamUUID)
+	if err != nil {
+		t.Fatalf("GetTeam: %v", err)
+	}
+	if team.Name != "Kiffix" || team.UUID != teamUUID.String() {
+		t.Errorf("GetTeam: expected Kiffix %s, got %s %s", teamUUID, team.Name, team.UUID)
+	}
+	if team.CreatedAt == nil || team.UpdatedAt == nil {
+		t.Errorf("GetTeam: expected timestamps, got %v and %v", team.CreatedAt, team.UpdatedAt)
+	}
+
+	teams, err := db.AllTeams(ctx)
+	if err != nil {
+		t.Fatalf("AllTeams: %v", err)
+	}
+	if len(teams) != 1 || teams[0].UUID != teamUUID.String() {
+		t.Errorf("AllTeams: expected just the new team, got %d teams", len(teams))
+	}
+
+	members := getMembers(ctx, t, db, team)
+	if len(members) != 1 || members[0].Fingerprint != admin.Fingerprint || !members[0].IsAdmin {
+		t.Errorf("GetTeamMembers: expected %s as the only admin, got %d members", admin.Fingerprint, len(members))
+	}
+
+	publicKey, err := db.GetPublicKey(ctx, admin.Fingerprint)
+	if err != nil {
+		t.Fatalf("GetPublicKey: %v", err)
+	}
+	if publicKey.ArmoredPublicKey != admin.Armored {
+		t.Errorf("GetPublicKey: stored key doesn't match")
+	}
+
+	// posting a copy of the key adds nothing to it, so the stored key is kept
+	reposted := withComment(t, admin.Armored, "reposted")
+	if _, err = db.CreatePublicKey(ctx, admin.Fingerprint, reposted); err != nil {
+		t.Fatalf("CreatePublicKey again: %v", err)
+	}
+	if publicKey, err = db.GetPublicKey(ctx, admin.Fingerprint); err != nil {
+		t.Fatalf("GetPublicKey: %v", err)
+	}
+	if publicKey.ArmoredPublicKey != admin.Armored {
+		t.Errorf("GetPublicKey: expected the stored key to be kept")
+	}
+}
+
+func testGetTeamNotFound(ctx context.Context, t *testing.T, db models.Datastore) {
+	if _, err := db.GetTeam(ctx, uuid.NewV4()); err != sql.ErrNoRows {
+		t.Errorf("GetTeam: expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err := db.GetPublicKey(ctx, fixtures.Valid.Fingerprint); err != sql.ErrNoRows {
+		t.Errorf("GetPublicKey: expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testJoinRequests(ctx context.Context, t *testing.T, db models.Datastore) {
+	admin, joiner := fixtures.Valid, fixtures.Expired
+	teamUUID := createTeam(ctx, t, db, "Kiffix", admin)
+
+	if _, err := db.CreatePublicKey(ctx, joiner.Fingerprint, joiner.Armored); err != nil {
+		t.Fatalf("CreatePublicKey: %v", err)
+	}
+	id, err := db.CreateTeamJoinRequest(ctx, joiner.Fingerprint, teamUUID.String())
+	if err != nil {
+		t.Fatalf("CreateTeamJoinRequest: %v", err)
+	}
+	if _, err = db.CreateTeamJoinRequest(ctx, joiner.Fingerprint, teamUUID.String()); err != sql.ErrNoRows {
+		t.Errorf("CreateTeamJoinRequest again: expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err = db.CreateTeamJoinRequest(ctx, joiner.Fingerprint, uuid.NewV4().String()); err != sql.ErrNoRows {
+		t.Errorf("CreateTeamJoinRequest for missing team: expected sql.ErrNoRows, got %v", err)
+	}
+
+	joinRequest, err := db.GetTeamJoinRequest(ctx, teamUUID.String(), joiner.Fingerprint)
+	if err != nil {
+		t.Fatalf("GetTeamJoinRequest: %v", err)
+	}
+	if joinRequest.ID != id || joinRequest.Fingerprint != joiner.Fingerprint {
+		t.Errorf("GetTeamJoinRequest: expected request %d from %s, got %d from %s",
+			id, joiner.Fingerprint, joinRequest.ID, joinRequest.Fingerprint)
+	}
+	if _, err = db.GetTeamJoinRequest(ctx, teamUUID.String(), admin.Fingerprint); err != sql.ErrNoRows {
+		t.Errorf("GetTeamJoinRequest for admin: expected sql.ErrNoRows, got %v", err)
+	}
+
+	team, err := db.GetTeam(ctx, teamUUID)
+	if err != nil {
+		t.Fatalf("GetTeam: %v", err)
+	}
+	joinRequests := getJoinRequests(ctx, t, db, team)
+	if len(joinRequests) != 1 || joinRequests[0].ID != id {
+		t.Errorf("GetTeamJoinRequests: expected just request %d, got %d requests", id, len(joinRequests))
+	}
+
+	if err = db.RevokePublicKey(ctx, joiner.Fingerprint, joiner.Armored); err != nil {
+		t.Fatalf("RevokePublicKey: %v", err)
+	}
+	if _, err = db.GetTeamJoinRequest(ctx, teamUUID.String(), joiner.Fingerprint); err != sql.ErrNoRows {
+		t.Errorf("GetTeamJoinRequest for revoked key: expected sql.ErrNoRows, got %v", err)
+	}
+	if joinRequests := getJoinRequests(ctx, t, db, team); len(joinRequests) != 0 {
+		t.Errorf("GetTeamJoinRequests: expected revoked key's request to be left out, got %d requests", len(joinRequests))
+	}
+}
+
+func testGetTeamWithMembers(ctx context.Context, t *testing.T, db models.Datastore) {
+	admin, joiner := fixtures.Valid, fixtures.Expired
+	teamUUID := createTeam(ctx, t, db, "Kiffix", admin)
+	if _, err := db.CreatePublicKey(ctx, joiner.Fingerprint, joiner.Armored); err != nil {
+		t.Fatalf("CreatePublicKey: %v", err)
+	}
+	id, err := db.CreateTeamJoinRequest(ctx, joiner.Fingerprint, teamUUID.String())
+	if err != nil {
+		t.Fatalf("CreateTeamJoinRequest: %v", err)
+	}
+
+	team, err := db.GetTeamWithMembers(ctx, teamUUID)
+	if err != nil {
+		t.Fatalf("GetTeamWithMembers: %v", err)
+	}
+	if team.Name != "Kiffix" || team.UUID != teamUUID.String() {
+		t.Errorf("GetTeamWithMembers: expected Kiffix %s, got %s %s", teamUUID, team.Name, team.UUID)
+	}
+	if len(team.Members) != 1 || team.Members[0].Fingerprint != admin.Fingerprint ||
+		team.Members[0].PublicKey != admin.Armored || !team.Members[0].IsAdmin {
+		t.Errorf("GetTeamWithMembers: expected %s as the only admin, got %d members",
+			admin.Fingerprint, len(team.Members))
+	}
+	if len(team.JoinRequests) != 1 || team.JoinRequests[0].ID != id ||
+		team.JoinRequests[0].CreatedAt == nil {
+		t.Errorf("GetTeamWithMembers: expected just request %d, got %d requests", id, len(team.JoinRequests))
+	}
+
+	if _, err = db.GetTeamWithMembers(ctx, uuid.NewV4()); err != sql.ErrNoRows {
+		t.Errorf("GetTeamWithMembers for missing team: expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testRevokePublicKey(ctx context.Context, t *testing.T, db models.Datastore) {
+	admin := fixtures.Valid
+	teamUUID := createTeam(ctx, t, db, "Kiffix", admin)
+
+	if err := db.RevokePublicKey(ctx, admin.Fingerprint, admin.Armored); err != nil {
+		t.Fatalf("RevokePublicKey: %v", err)
+	}
+	publicKeys, err := db.AllPublicKeys(ctx)
+	if err != nil {
+		t.Fatalf("AllPublicKeys: %v", err)
+	}
+	if len(publicKeys) != 0 {
+		t.Errorf("AllPublicKeys: expected revoked key to be left out, got %d keys", len(publicKeys))
+	}
+	revokedKeys, err := db.AllRevokedPublicKeys(ctx)
+	if err != nil {
+		t.Fatalf("AllRevokedPublicKeys: %v", err)
+	}
+	if len(revokedKeys) != 1 || revokedKeys[0].Fingerprint != admin.Fingerprint {
+		t.Errorf("AllRevokedPublicKeys: expected only %s, got %d keys", admin.Fingerprint, len(revokedKeys))
+	}
+	team, err := db.GetTeam(ctx, teamUUID)
+	if err != nil {
+		t.Fatalf("GetTeam: %v", err)
+	}
+	if members := getMembers(ctx, t, db, team); len(members) != 0 {
+		t.Errorf("GetTeamMembers: expected revoked member to be left out, got %d members", len(members))
+	}
+	members, revokedMembers, err := db.GetTeamMembersWithRevoked(ctx, teamUUID)
+	if err != nil {
+		t.Fatalf("GetTeamMembersWithRevoked: %v", err)
+	}
+	if len(members) != 0 || len(revokedMembers) != 1 || revokedMembers[0].Fingerprint != admin.Fingerprint {
+		t.Errorf("GetTeamMembersWithRevoked: expected only %s, revoked, got %d members and %d revoked",
+			admin.Fingerprint, len(members), len(revokedMembers))
+	}
+	if _, _, err = db.GetTeamMembersWithRevoked(ctx, uuid.NewV4()); err != sql.ErrNoRows {
+		t.Errorf("GetTeamMembersWithRevoked for missing team: expected sql.ErrNoRows, got %v", err)
+	}
+
+	if _, err = db.CreatePublicKey(ctx, admin.Fingerprint, admin.Armored); err != models.ErrPublicKeyRevoked {
+		t.Errorf("CreatePublicKey for revoked key: expected models.ErrPublicKeyRevoked, got %v", err)
+	}
+
+	missing := fixtures.Expired
+	if err = db.RevokePublicKey(ctx, missing.Fingerprint, missing.Armored); err != sql.ErrNoRows {
+		t.Errorf("RevokePublicKey for missing key: expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testIdempotentResponses(ctx context.Context, t *testing.T, db models.Datastore) {
+	if _, err := db.GetIdempotentResponse(ctx, "ip:192.0.2.1", "key", "POST", "/v1/teams"); err != sql.ErrNoRows {
+		t.Errorf("GetIdempotentResponse: expected sql.ErrNoRows, got %v", err)
+	}
+	claim := models.IdempotentResponse{Client: "ip:192.0.2.1", Key: "key", Method: "POST", Path: "/v1/teams", RequestHash: "hash"}
+	if stored, err := db.ClaimIdempotencyKey(ctx, &claim, time.Minute); err != nil || stored != nil {
+		t.Fatalf("ClaimIdempotencyKey: expected to claim key, got %+v, %v", stored, err)
+	}
+	stored, err := db.ClaimIdempotencyKey(ctx, &claim, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimIdempotencyKey again: %v", err)
+	}
+	if stored == nil || !stored.Pending || stored.RequestHash != "hash" {
+		t.Errorf("ClaimIdempotencyKey again: expected pending claim, got %+v", stored)
+	}
+
+	response := claim
+	response.StatusCode = 201
+	response.Header = http.Header{"Content-Type": {"application/json"}}
+	response.ResponseBody = `{"teamUuid":"x"}`
+	if err = db.CompleteIdempotentResponse(ctx, &response); err != nil {
+		t.Fatalf("CompleteIdempotentResponse: %v", err)
+	}
+	replaced := response
+	replaced.StatusCode = 500
+	if err = db.CompleteIdempotentResponse(ctx, &replaced); err != models.ErrIdempotencyKeyNotClaimed {
+		t.Errorf("CompleteIdempotentResponse again: expected models.ErrIdempotencyKeyNotClaimed, got %v", err)
+	}
+	if err = db.ReleaseIdempotencyKey(ctx, "ip:192.0.2.1", "key", "POST", "/v1/teams"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	stored, err = db.ClaimIdempotencyKey(ctx, &claim, 0)
+	if err != nil {
+		t.Fatalf("ClaimIdempotencyKey after response: %v", err)
+	}
+	if stored == nil || !reflect.DeepEqual(*stored, response) {
+		t.Errorf("ClaimIdempotencyKey after response: expected the first response %+v, got %+v", response, stored)
+	}
+
+	fromOtherClient := claim
+	fromOtherClient.Client = "ip:198.51.100.1"
+	if stored, err = db.ClaimIdempotencyKey(ctx, &fromOtherClient, time.Minute); err != nil || stored != nil {
+		t.Errorf("ClaimIdempotencyKey from another client: expected to claim key, got %+v, %v", stored, err)
+	}
+
+	other := models.IdempotentResponse{Client: "ip:192.0.2.1", Key: "other", Method: "POST", Path: "/v1/teams", RequestHash: "hash"}
+	if _, err = db.ClaimIdempotencyKey(ctx, &other, time.Minute); err != nil {
+		t.Fatalf("ClaimIdempotencyKey: %v", err)
+	}
+	if stored, err = db.ClaimIdempotencyKey(ctx, &other, 0); err != nil || stored != nil {
+		t.Errorf("ClaimIdempotencyKey for stale claim: expected to claim key, got %+v, %v", stored, err)
+	}
+	if err = db.ReleaseIdempotencyKey(ctx, "ip:192.0.2.1", "other", "POST", "/v1/teams"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if _, err = db.GetIdempotentResponse(ctx, "ip:192.0.2.1", "other", "POST", "/v1/teams"); err != sql.ErrNoRows {
+		t.Errorf("GetIdempotentResponse after release: expected sql.ErrNoRows, got %v", err)
+	}
+
+	if deleted, err := db.DeleteIdempotentResponses(ctx, time.Hour); err != nil || deleted != 0 {
+		t.Errorf("DeleteIdempotentResponses: expected nothing deleted, got %d, %v", deleted, err)
+	}
+	if deleted, err := db.DeleteIdempotentResponses(ctx, -time.Hour); err != nil || deleted != 1 {
+		t.Errorf("DeleteIdempotentResponses: expected the completed response deleted, got %d, %v", deleted, err)
+	}
+	if _, err = db.GetIdempotentResponse(ctx, "ip:192.0.2.1", "key", "POST", "/v1/teams"); err != sql.ErrNoRows {
+		t.Errorf("GetIdempotentResponse after delete: expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err = db.GetIdempotentResponse(ctx, "ip:198.51.100.1", "key", "POST", "/v1/teams"); err != nil {
+		t.Errorf("GetIdempotentResponse for pending claim after delete: %v", err)
+	}
+}
+
+func testRateLimitTokens(ctx context.Context, t *testing.T, db models.Datastore) {
+	for i, expectAllowed := range []bool{true, true, false} {
+		allowed, retryAfter, err := db.TakeRateLimitToken(ctx, "POST /teams ip:192.0.2.1", 0.01, 2)
+		if err != nil {
+			t.Fatalf("TakeRateLimitToken: %v", err)
+		}
+		if allowed != expectAllowed {
+			t.Errorf("TakeRateLimitToken %d: expected allowed=%v, got %v", i+1, expectAllowed, allowed)
+		}
+		if !allowed && retryAfter <= 0 {
+			t.Errorf("TakeRateLimitToken %d: expected a time to retry after, got %s", i+1, retryAfter)
+		}
+	}
+}
+
+func testReturnRateLimitToken(ctx context.Context, t *testing.T, db models.Datastore) {
+	const key = "POST /teams ip:192.0.2.1"
+	if err := db.ReturnRateLimitToken(ctx, key, 2); err != nil {
+		t.Fatalf("ReturnRateLimitToken: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := db.TakeRateLimitToken(ctx, key, 0.01, 2); err != nil {
+			t.Fatalf("TakeRateLimitToken: %v", err)
+		}
+	}
+	if err := db.ReturnRateLimitToken(ctx, key, 2); err != nil {
+		t.Fatalf("ReturnRateLimitToken: %v", err)
+	}
+	for i, expectAllowed := range []bool{true, false} {
+		allowed, _, err := db.TakeRateLimitToken(ctx, key, 0.01, 2)
+		if err != nil {
+			t.Fatalf("TakeRateLimitToken: %v", err)
+		}
+		if allowed != expectAllowed {
+			t.Errorf("TakeRateLimitToken %d after returning a token: expected allowed=%v, got %v",
+				i+1, expectAllowed, allowed)
+		}
+	}
+}
+
+func testDeleteFullRateLimitBuckets(ctx context.Context, t *testing.T, db models.Datastore) {
+	if _, _, err := db.TakeRateLimitToken(ctx, "fast", 1000, 1); err != nil {
+		t.Fatalf("TakeRateLimitToken: %v", err)
+	}
+	if _, _, err := db.TakeRateLimitToken(ctx, "slow", 0.01, 1); err != nil {
+		t.Fatalf("TakeRateLimitToken: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	deleted, err := db.DeleteFullRateLimitBuckets(ctx)
+	if err != nil {
+		t.Fatalf("DeleteFullRateLimitBuckets: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("DeleteFullRateLimitBuckets: expected only the refilled bucket deleted, got %d", deleted)
+	}
+	allowed, _, err := db.TakeRateLimitToken(ctx, "slow", 0.01, 1)
+	if err != nil {
+		t.Fatalf("TakeRateLimitToken: %v", err)
+	}
+	if allowed {
+		t.Error("TakeRateLimitToken: expected the bucket which hasn't refilled to be kept")
+	}
+}
+
+func testACMECache(ctx context.Context, t *testing.T, db models.Datastore) {
+	if _, err := db.GetACMECacheEntry(ctx, "example.com"); err != sql.ErrNoRows {
+		t.Errorf("GetACMECacheEntry: expected sql.ErrNoRows for a missing entry, got %v", err)
+	}
+	for _, data := range []string{"first", "second"} {
+		if err := db.PutACMECacheEntry(ctx, "example.com", []byte(data)); err != nil {
+			t.Fatalf("PutACMECacheEntry: %v", err)
+		}
+		got, err := db.GetACMECacheEntry(ctx, "example.com")
+		if err != nil || string(got) != data {
+			t.Errorf("GetACMECacheEntry: expected %q, got %q, %v", data, got, err)
+		}
+	}
+	if err := db.DeleteACMECacheEntry(ctx, "example.com"); err != nil {
+		t.Fatalf("DeleteACMECacheEntry: %v", err)
+	}
+	if _, err := db.GetACMECacheEntry(ctx, "example.com"); err != sql.ErrNoRows {
+		t.Errorf("GetACMECacheEntry: expected sql.ErrNoRows after deleting, got %v", err)
+	}
+}
+
+func testCountRecords(ctx context.Context, t *testing.T, db models.Datastore) {
+	admin, joiner := fixtures.Valid, fixtures.Expired
+	teamUUID := createTeam(ctx, t, db, "Kiffix", admin)
+	if _, err := db.CreatePublicKey(ctx, joiner.Fingerprint, joiner.Armored); err != nil {
+		t.Fatalf("CreatePublicKey: %v", err)
+	}
+	if _, err := db.CreateTeamJoinRequest(ctx, joiner.Fingerprint, teamUUID.String()); err != nil {
+		t.Fatalf("CreateTeamJoinRequest: %v", err)
+	}
+
+	counts, err := db.CountRecords(ctx)
+	if err != nil {
+		t.Fatalf("CountRecords: %v", err)
+	}
+	expected := models.RecordCounts{Teams: 1, Members: 1, PendingJoinRequests: 1}
+	if *counts != expected {
+		t.Errorf("CountRecords: expected %+v, got %+v", expected, *counts)
+	}
+}
+
+func testWithTxRollsBack(ctx context.Context, t *testing.T, db models.Datastore) {
+	failure := errors.New("failure")
+	err := db.WithTx(ctx, func(tx models.Tx) error {
+		if _, _, err := tx.CreateTeam("Kiffix"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("WithTx: expected fn's error, got %v", err)
+	}
+	teams, err := db.AllTeams(ctx)
+	if err != nil {
+		t.Fatalf("AllTeams: %v", err)
+	}
+	if len(teams) != 0 {
+		t.Errorf("WithTx: expected the team to be rolled back, got %d teams", len(teams))
+	}
+}
+
+func getMembers(ctx context.Context, t *testing.T, db models.Datastore, team *models.Team) []*models.Member {
+	members, err := db.GetTeamMembers(ctx, teamID(t, team))
+	if err != nil {
+		t.Fatalf("GetTeamMembers: %v", err)
+	}
+	return members
+}
+
+func getJoinRequests(ctx context.Context, t *testing.T, db models.Datastore, team *models.Team) []*models.JoinRequest {
+	joinRequests, err := db.GetTeamJoinRequests(ctx, teamID(t, team))
+	if err != nil {
+		t.Fatalf("GetTeamJoinRequests: %v", err)
+	}
+	return joinRequests
+}
+
+// withComment re-armors armoredPublicKey with a comment header, giving a
+// different armored form of the same key
+func withComment(t *testing.T, armoredPublicKey string, comment string) string {
+	block, err := armor.Decode(strings.NewReader(armoredPublicKey))
+	if err != nil {
+		t.Fatalf("error decoding armored key: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, block.Type, map[string]string{"Comment": comment})
+	if err != nil {
+		t.Fatalf("error armoring key: %v", err)
+	}
+	if _, err = io.Copy(w, block.Body); err != nil {
+		t.Fatalf("error armoring key: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("error armoring key: %v", err)
+	}
+	return buf.String()
+}
+
+func teamID(t *testing.T, team *models.Team) int {
+	id, err := strconv.Atoi(team.ID)
+	if err != nil {
+		t.Fatalf("team ID %q isn't a number: %v", team.ID, err)
+	}
+	return id
+}
@@ -0,0 +1,819 @@
+// Package fakedb is an in-memory models.Datastore for testing handlers without
+// Postgres. It records every call made to it and can be told to fail calls to
+// a method, so tests can check what a handler asked for and how it copes with
+// database errors.
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+// A Call is a method called on a DB, with the arguments it was passed other
+// than the context. Methods called on the Tx given to WithTx's fn are named
+// like "Tx.CreateTeam".
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// DB implements models.Datastore in memory. It behaves as models.DB does,
+// including returning sql.ErrNoRows for missing records.
+type DB struct {
+	mu       sync.Mutex
+	calls    []Call
+	failures map[string]error
+	data     data
+}
+
+// data is everything stored, copied by WithTx so it can be rolled back
+type data struct {
+	lastID       int64
+	teams        []team
+	publicKeys   []publicKey
+	teamUsers    []teamUser
+	joinRequests []joinRequest
+	idempotent   map[string]idempotentResponse
+	buckets      map[string]bucket
+	acmeCache    map[string][]byte
+}
+
+type team struct {
+	timestamps
+	id   int64
+	name string
+	uuid string
+}
+
+type publicKey struct {
+	timestamps
+	id          int64
+	fingerprint models.Fingerprint
+	armored     string
+	isRevoked   bool
+}
+
+type teamUser struct {
+	timestamps
+	id          int64
+	teamID      int64
+	fingerprint models.Fingerprint
+	isAdmin     bool
+}
+
+type joinRequest struct {
+	timestamps
+	id          int64
+	teamID      int64
+	fingerprint models.Fingerprint
+}
+
+// timestamps are a row's created_at and updated_at columns
+type timestamps struct {
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+func newTimestamps() timestamps {
+	now := time.Now()
+	return timestamps{createdAt: now, updatedAt: now}
+}
+
+// pointers returns copies of the timestamps for a model
+func (ts timestamps) pointers() (*time.Time, *time.Time) {
+	createdAt, updatedAt := ts.createdAt, ts.updatedAt
+	return &createdAt, &updatedAt
+}
+
+// idempotentResponse is a stored response and when it was last updated, to
+// tell when a pending one is stale and when a completed one can be deleted
+type idempotentResponse struct {
+	response  models.IdempotentResponse
+	updatedAt time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// New returns an empty DB
+func New() *DB {
+	return &DB{
+		failures: map[string]error{},
+		data: data{
+			idempotent: map[string]idempotentResponse{},
+			buckets:    map[string]bucket{},
+			acmeCache:  map[string][]byte{},
+		},
+	}
+}
+
+// Fail makes every call to method return err, until Fail is called again with
+// a nil err
+func (db *DB) Fail(method string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err == nil {
+		delete(db.failures, method)
+	} else {
+		db.failures[method] = err
+	}
+}
+
+// Calls returns the calls made so far, in order
+func (db *DB) Calls() []Call {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]Call{}, db.calls...)
+}
+
+// Called returns how many times method has been called
+func (db *DB) Called(method string) int {
+	count := 0
+	for _, call := range db.Calls() {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// record notes a call to method, returning the error it should fail with.
+// db.mu must be held.
+func (db *DB) record(ctx context.Context, method string, args ...interface{}) error {
+	db.calls = append(db.calls, Call{Method: method, Args: args})
+	if err := db.failures[method]; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// AllTeams returns every team
+func (db *DB) AllTeams(ctx context.Context) ([]*models.Team, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "AllTeams"); err != nil {
+		return nil, err
+	}
+	teams := make([]*models.Team, 0)
+	for _, t := range db.data.teams {
+		teams = append(teams, t.model())
+	}
+	return teams, nil
+}
+
+// CreateTeam adds a team with a new UUID
+func (db *DB) CreateTeam(ctx context.Context, teamName string) (teamID int64, teamUUID *uuid.UUID, err error) {
+	err = db.WithTx(ctx, func(tx models.Tx) (err error) {
+		teamID, teamUUID, err = tx.CreateTeam(teamName)
+		return err
+	})
+	return teamID, teamUUID, err
+}
+
+// CreateTeamUser makes fingerprint an admin of the team
+func (db *DB) CreateTeamUser(ctx context.Context, teamID int64, fingerprint models.Fingerprint) (teamUserID int64, err error) {
+	err = db.WithTx(ctx, func(tx models.Tx) (err error) {
+		teamUserID, err = tx.CreateTeamUser(teamID, fingerprint)
+		return err
+	})
+	return teamUserID, err
+}
+
+// CreatePublicKey stores a public key, merging it into the existing one if
+// there's already a key with the fingerprint, or returns
+// models.ErrPublicKeyRevoked if that key has been revoked
+func (db *DB) CreatePublicKey(ctx context.Context, fingerprint models.Fingerprint, armoredPublicKey string) (publicKeyID int64, err error) {
+	err = db.WithTx(ctx, func(tx models.Tx) (err error) {
+		publicKeyID, err = tx.CreatePublicKey(fingerprint, armoredPublicKey)
+		return err
+	})
+	return publicKeyID, err
+}
+
+// GetTeam returns the team with the given UUID, or sql.ErrNoRows
+func (db *DB) GetTeam(ctx context.Context, teamUUID uuid.UUID) (*models.Team, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetTeam", teamUUID); err != nil {
+		return nil, err
+	}
+	t := db.data.findTeam(teamUUID.String())
+	if t == nil {
+		return nil, sql.ErrNoRows
+	}
+	return t.model(), nil
+}
+
+// GetTeamWithMembers returns the team with the given UUID with its members and
+// join requests, or sql.ErrNoRows
+func (db *DB) GetTeamWithMembers(ctx context.Context, teamUUID uuid.UUID) (*models.Team, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetTeamWithMembers", teamUUID); err != nil {
+		return nil, err
+	}
+	t := db.data.findTeam(teamUUID.String())
+	if t == nil {
+		return nil, sql.ErrNoRows
+	}
+	team := t.model()
+	team.Members = db.data.members(t.id, false)
+	team.JoinRequests = db.data.joinRequestsFor(t.id)
+	return team, nil
+}
+
+// CreateTeamJoinRequest adds a request from fingerprint to join the team,
+// returning sql.ErrNoRows if there's no such team or it's already been asked
+func (db *DB) CreateTeamJoinRequest(ctx context.Context, fingerprint models.Fingerprint, teamUUID string) (teamJoinRequestID int64, err error) {
+	err = db.WithTx(ctx, func(tx models.Tx) (err error) {
+		teamJoinRequestID, err = tx.CreateTeamJoinRequest(fingerprint, teamUUID)
+		return err
+	})
+	return teamJoinRequestID, err
+}
+
+// GetTeamMembers returns the team's members whose keys aren't revoked
+func (db *DB) GetTeamMembers(ctx context.Context, teamID int) ([]*models.Member, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetTeamMembers", teamID); err != nil {
+		return nil, err
+	}
+	return db.data.members(int64(teamID), false), nil
+}
+
+// GetTeamMembersWithRevoked returns the members of the team with the given
+// UUID whose keys aren't revoked and those whose keys are, or sql.ErrNoRows
+func (db *DB) GetTeamMembersWithRevoked(ctx context.Context, teamUUID uuid.UUID) ([]*models.Member, []*models.Member, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetTeamMembersWithRevoked", teamUUID); err != nil {
+		return nil, nil, err
+	}
+	t := db.data.findTeam(teamUUID.String())
+	if t == nil {
+		return nil, nil, sql.ErrNoRows
+	}
+	return db.data.members(t.id, false), db.data.members(t.id, true), nil
+}
+
+// GetTeamJoinRequests returns the team's join requests whose keys aren't
+// revoked
+func (db *DB) GetTeamJoinRequests(ctx context.Context, teamID int) ([]*models.JoinRequest, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetTeamJoinRequests", teamID); err != nil {
+		return nil, err
+	}
+	return db.data.joinRequestsFor(int64(teamID)), nil
+}
+
+// GetTeamJoinRequest returns the request from fingerprint to join the team, or
+// sql.ErrNoRows if there isn't one or the key has been revoked
+func (db *DB) GetTeamJoinRequest(ctx context.Context, teamUUID string, fingerprint models.Fingerprint) (*models.JoinRequest, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetTeamJoinRequest", teamUUID, fingerprint); err != nil {
+		return nil, err
+	}
+	return db.data.getTeamJoinRequest(teamUUID, fingerprint)
+}
+
+// AllPublicKeys returns every key that hasn't been revoked
+func (db *DB) AllPublicKeys(ctx context.Context) ([]*models.PublicKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "AllPublicKeys"); err != nil {
+		return nil, err
+	}
+	return db.data.allPublicKeys(false), nil
+}
+
+// AllRevokedPublicKeys returns every key that has been revoked
+func (db *DB) AllRevokedPublicKeys(ctx context.Context) ([]*models.PublicKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "AllRevokedPublicKeys"); err != nil {
+		return nil, err
+	}
+	return db.data.allPublicKeys(true), nil
+}
+
+// GetPublicKey returns the key with the given fingerprint, or sql.ErrNoRows
+func (db *DB) GetPublicKey(ctx context.Context, fingerprint models.Fingerprint) (*models.PublicKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetPublicKey", fingerprint); err != nil {
+		return nil, err
+	}
+	k := db.data.findPublicKey(fingerprint)
+	if k == nil {
+		return nil, sql.ErrNoRows
+	}
+	return k.model(), nil
+}
+
+// RevokePublicKey replaces the key and marks it revoked in every team,
+// returning sql.ErrNoRows if there's no such key
+func (db *DB) RevokePublicKey(ctx context.Context, fingerprint models.Fingerprint, armoredPublicKey string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "RevokePublicKey", fingerprint, armoredPublicKey); err != nil {
+		return err
+	}
+	if _, err := models.ParseKeyMetadata(armoredPublicKey); err != nil {
+		return err
+	}
+	k := db.data.findPublicKey(fingerprint)
+	if k == nil {
+		return sql.ErrNoRows
+	}
+	k.armored = armoredPublicKey
+	k.isRevoked = true
+	k.updatedAt = time.Now()
+	return nil
+}
+
+// GetIdempotentResponse returns the stored response, or sql.ErrNoRows
+func (db *DB) GetIdempotentResponse(ctx context.Context, client string, key string, method string, path string) (*models.IdempotentResponse, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetIdempotentResponse", client, key, method, path); err != nil {
+		return nil, err
+	}
+	stored, ok := db.data.idempotent[idempotencyKey(client, key, method, path)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	response := stored.response
+	return &response, nil
+}
+
+// ClaimIdempotencyKey stores a pending response for claim's client, key,
+// method and path, returning nil, or returns the response already stored
+// unless it's pending and older than staleAfter
+func (db *DB) ClaimIdempotencyKey(ctx context.Context, claim *models.IdempotentResponse, staleAfter time.Duration) (*models.IdempotentResponse, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "ClaimIdempotencyKey", claim, staleAfter); err != nil {
+		return nil, err
+	}
+	key := idempotencyKey(claim.Client, claim.Key, claim.Method, claim.Path)
+	if stored, ok := db.data.idempotent[key]; ok {
+		if !stored.response.Pending || time.Since(stored.updatedAt) < staleAfter {
+			response := stored.response
+			return &response, nil
+		}
+	}
+	db.data.idempotent[key] = idempotentResponse{
+		response: models.IdempotentResponse{
+			Client:      claim.Client,
+			Key:         claim.Key,
+			Method:      claim.Method,
+			Path:        claim.Path,
+			RequestHash: claim.RequestHash,
+			Pending:     true,
+		},
+		updatedAt: time.Now(),
+	}
+	return nil, nil
+}
+
+// CompleteIdempotentResponse stores response in place of the pending one with
+// the same client, key, method, path and request hash, returning
+// models.ErrIdempotencyKeyNotClaimed if there isn't one
+func (db *DB) CompleteIdempotentResponse(ctx context.Context, response *models.IdempotentResponse) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "CompleteIdempotentResponse", response); err != nil {
+		return err
+	}
+	key := idempotencyKey(response.Client, response.Key, response.Method, response.Path)
+	stored, ok := db.data.idempotent[key]
+	if !ok || !stored.response.Pending || stored.response.RequestHash != response.RequestHash {
+		return models.ErrIdempotencyKeyNotClaimed
+	}
+	completed := *response
+	completed.Pending = false
+	db.data.idempotent[key] = idempotentResponse{response: completed, updatedAt: time.Now()}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the pending response for client, key, method
+// and path
+func (db *DB) ReleaseIdempotencyKey(ctx context.Context, client string, key string, method string, path string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "ReleaseIdempotencyKey", client, key, method, path); err != nil {
+		return err
+	}
+	k := idempotencyKey(client, key, method, path)
+	if stored, ok := db.data.idempotent[k]; ok && stored.response.Pending {
+		delete(db.data.idempotent, k)
+	}
+	return nil
+}
+
+// DeleteIdempotentResponses deletes stored responses last updated before
+// olderThan ago, leaving pending ones
+func (db *DB) DeleteIdempotentResponses(ctx context.Context, olderThan time.Duration) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "DeleteIdempotentResponses", olderThan); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for k, stored := range db.data.idempotent {
+		if !stored.response.Pending && time.Since(stored.updatedAt) > olderThan {
+			delete(db.data.idempotent, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func idempotencyKey(client string, key string, method string, path string) string {
+	return strconv.Quote(client) + " " + strconv.Quote(key) + " " + method + " " + path
+}
+
+// TakeRateLimitToken takes a token from the bucket identified by key, as
+// models.DB does
+func (db *DB) TakeRateLimitToken(ctx context.Context, key string, ratePerSecond float64, burst int) (bool, time.Duration, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "TakeRateLimitToken", key, ratePerSecond, burst); err != nil {
+		return false, 0, err
+	}
+	now := time.Now()
+	tokens := float64(burst)
+	if b, ok := db.data.buckets[key]; ok {
+		tokens = math.Min(tokens, b.tokens+ratePerSecond*now.Sub(b.updatedAt).Seconds())
+	}
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	db.data.buckets[key] = bucket{
+		tokens:    tokens,
+		updatedAt: now,
+		fullAt:    now.Add(time.Duration(float64(burst) / ratePerSecond * float64(time.Second))),
+	}
+	if allowed {
+		return true, 0, nil
+	}
+	wait := math.Ceil((1 - tokens) / ratePerSecond * float64(time.Second))
+	return false, time.Duration(wait), nil
+}
+
+// ReturnRateLimitToken puts back a token taken from the bucket identified by
+// key
+func (db *DB) ReturnRateLimitToken(ctx context.Context, key string, burst int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "ReturnRateLimitToken", key, burst); err != nil {
+		return err
+	}
+	if b, ok := db.data.buckets[key]; ok {
+		b.tokens = math.Min(float64(burst), b.tokens+1)
+		db.data.buckets[key] = b
+	}
+	return nil
+}
+
+// DeleteFullRateLimitBuckets deletes buckets which have refilled
+func (db *DB) DeleteFullRateLimitBuckets(ctx context.Context) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "DeleteFullRateLimitBuckets"); err != nil {
+		return 0, err
+	}
+	deleted := int64(0)
+	now := time.Now()
+	for key, b := range db.data.buckets {
+		if b.fullAt.Before(now) {
+			delete(db.data.buckets, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetACMECacheEntry returns the data stored under key, or sql.ErrNoRows
+func (db *DB) GetACMECacheEntry(ctx context.Context, key string) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "GetACMECacheEntry", key); err != nil {
+		return nil, err
+	}
+	data, ok := db.data.acmeCache[key]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return append([]byte{}, data...), nil
+}
+
+// PutACMECacheEntry stores data under key
+func (db *DB) PutACMECacheEntry(ctx context.Context, key string, data []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "PutACMECacheEntry", key, data); err != nil {
+		return err
+	}
+	db.data.acmeCache[key] = append([]byte{}, data...)
+	return nil
+}
+
+// DeleteACMECacheEntry deletes the data stored under key
+func (db *DB) DeleteACMECacheEntry(ctx context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "DeleteACMECacheEntry", key); err != nil {
+		return err
+	}
+	delete(db.data.acmeCache, key)
+	return nil
+}
+
+// CountRecords counts teams, members and pending join requests, leaving out
+// revoked keys
+func (db *DB) CountRecords(ctx context.Context) (*models.RecordCounts, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "CountRecords"); err != nil {
+		return nil, err
+	}
+	counts := models.RecordCounts{Teams: len(db.data.teams)}
+	for _, u := range db.data.teamUsers {
+		if key := db.data.findPublicKey(u.fingerprint); key != nil && !key.isRevoked {
+			counts.Members++
+		}
+	}
+	for _, r := range db.data.joinRequests {
+		if key := db.data.findPublicKey(r.fingerprint); key != nil && !key.isRevoked {
+			counts.PendingJoinRequests++
+		}
+	}
+	return &counts, nil
+}
+
+// WithTx runs fn, undoing everything it did if it returns an error. Other
+// calls wait until fn has returned, so fn mustn't call db itself.
+func (db *DB) WithTx(ctx context.Context, fn func(models.Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.record(ctx, "WithTx"); err != nil {
+		return err
+	}
+	saved := db.data.copy()
+	if err := fn(&tx{db, ctx}); err != nil {
+		db.data = saved
+		return err
+	}
+	return nil
+}
+
+// tx implements models.Tx for WithTx, which holds db.mu while it's in use
+type tx struct {
+	db  *DB
+	ctx context.Context
+}
+
+func (t *tx) CreateTeam(teamName string) (int64, *uuid.UUID, error) {
+	if err := t.db.record(t.ctx, "Tx.CreateTeam", teamName); err != nil {
+		return 0, nil, err
+	}
+	teamUUID := uuid.NewV4()
+	id := t.db.data.nextID()
+	t.db.data.teams = append(t.db.data.teams, team{
+		timestamps: newTimestamps(),
+		id:         id,
+		name:       teamName,
+		uuid:       teamUUID.String(),
+	})
+	return id, &teamUUID, nil
+}
+
+func (t *tx) CreateTeamUser(teamID int64, fingerprint models.Fingerprint) (int64, error) {
+	if err := t.db.record(t.ctx, "Tx.CreateTeamUser", teamID, fingerprint); err != nil {
+		return 0, err
+	}
+	if t.db.data.findTeamByID(teamID) == nil {
+		return 0, fmt.Errorf("fakedb: no team with id %d", teamID)
+	}
+	if t.db.data.findPublicKey(fingerprint) == nil {
+		return 0, fmt.Errorf("fakedb: no public key %s", fingerprint)
+	}
+	id := t.db.data.nextID()
+	t.db.data.teamUsers = append(t.db.data.teamUsers, teamUser{
+		timestamps:  newTimestamps(),
+		id:          id,
+		teamID:      teamID,
+		fingerprint: fingerprint,
+		isAdmin:     true,
+	})
+	return id, nil
+}
+
+func (t *tx) CreatePublicKey(fingerprint models.Fingerprint, armoredPublicKey string) (int64, error) {
+	if err := t.db.record(t.ctx, "Tx.CreatePublicKey", fingerprint, armoredPublicKey); err != nil {
+		return 0, err
+	}
+	if _, err := models.ParseKeyMetadata(armoredPublicKey); err != nil {
+		return 0, err
+	}
+	if k := t.db.data.findPublicKey(fingerprint); k != nil {
+		if k.isRevoked {
+			return 0, models.ErrPublicKeyRevoked
+		}
+		merged, changed, err := models.MergePublicKey(k.armored, armoredPublicKey)
+		if err != nil || !changed {
+			return k.id, err
+		}
+		k.armored = merged
+		k.updatedAt = time.Now()
+		return k.id, nil
+	}
+	id := t.db.data.nextID()
+	t.db.data.publicKeys = append(t.db.data.publicKeys, publicKey{
+		timestamps:  newTimestamps(),
+		id:          id,
+		fingerprint: fingerprint,
+		armored:     armoredPublicKey,
+	})
+	return id, nil
+}
+
+func (t *tx) CreateTeamJoinRequest(fingerprint models.Fingerprint, teamUUID string) (int64, error) {
+	if err := t.db.record(t.ctx, "Tx.CreateTeamJoinRequest", fingerprint, teamUUID); err != nil {
+		return 0, err
+	}
+	team := t.db.data.findTeam(teamUUID)
+	if team == nil {
+		return 0, sql.ErrNoRows
+	}
+	if t.db.data.findPublicKey(fingerprint) == nil {
+		return 0, fmt.Errorf("fakedb: no public key %s", fingerprint)
+	}
+	for _, r := range t.db.data.joinRequests {
+		if r.teamID == team.id && r.fingerprint == fingerprint {
+			return 0, sql.ErrNoRows
+		}
+	}
+	id := t.db.data.nextID()
+	t.db.data.joinRequests = append(t.db.data.joinRequests, joinRequest{
+		timestamps:  newTimestamps(),
+		id:          id,
+		teamID:      team.id,
+		fingerprint: fingerprint,
+	})
+	return id, nil
+}
+
+func (t *tx) GetTeamJoinRequest(teamUUID string, fingerprint models.Fingerprint) (*models.JoinRequest, error) {
+	if err := t.db.record(t.ctx, "Tx.GetTeamJoinRequest", teamUUID, fingerprint); err != nil {
+		return nil, err
+	}
+	return t.db.data.getTeamJoinRequest(teamUUID, fingerprint)
+}
+
+func (d *data) nextID() int64 {
+	d.lastID++
+	return d.lastID
+}
+
+// copy returns a copy of d which shares nothing that can be modified
+func (d *data) copy() data {
+	c := *d
+	c.teams = append([]team{}, d.teams...)
+	c.publicKeys = append([]publicKey{}, d.publicKeys...)
+	c.teamUsers = append([]teamUser{}, d.teamUsers...)
+	c.joinRequests = append([]joinRequest{}, d.joinRequests...)
+	c.idempotent = map[string]idempotentResponse{}
+	for k, v := range d.idempotent {
+		c.idempotent[k] = v
+	}
+	c.buckets = map[string]bucket{}
+	for k, v := range d.buckets {
+		c.buckets[k] = v
+	}
+	c.acmeCache = map[string][]byte{}
+	for k, v := range d.acmeCache {
+		c.acmeCache[k] = v
+	}
+	return c
+}
+
+func (d *data) findTeam(teamUUID string) *team {
+	for i := range d.teams {
+		if d.teams[i].uuid == teamUUID {
+			return &d.teams[i]
+		}
+	}
+	return nil
+}
+
+func (d *data) findTeamByID(id int64) *team {
+	for i := range d.teams {
+		if d.teams[i].id == id {
+			return &d.teams[i]
+		}
+	}
+	return nil
+}
+
+func (d *data) findPublicKey(fingerprint models.Fingerprint) *publicKey {
+	for i := range d.publicKeys {
+		if d.publicKeys[i].fingerprint == fingerprint {
+			return &d.publicKeys[i]
+		}
+	}
+	return nil
+}
+
+// members returns the team's members whose keys are or aren't revoked
+func (d *data) members(teamID int64, revoked bool) []*models.Member {
+	members := make([]*models.Member, 0)
+	for _, u := range d.teamUsers {
+		if u.teamID != teamID {
+			continue
+		}
+		if key := d.findPublicKey(u.fingerprint); key != nil && key.isRevoked == revoked {
+			members = append(members, u.model(key))
+		}
+	}
+	return members
+}
+
+func (d *data) allPublicKeys(revoked bool) []*models.PublicKey {
+	publicKeys := make([]*models.PublicKey, 0)
+	for _, k := range d.publicKeys {
+		if k.isRevoked == revoked {
+			publicKeys = append(publicKeys, k.model())
+		}
+	}
+	return publicKeys
+}
+
+// joinRequestsFor returns the team's join requests whose keys aren't revoked
+func (d *data) joinRequestsFor(teamID int64) []*models.JoinRequest {
+	joinRequests := make([]*models.JoinRequest, 0)
+	for _, r := range d.joinRequests {
+		if r.teamID != teamID {
+			continue
+		}
+		if key := d.findPublicKey(r.fingerprint); key != nil && !key.isRevoked {
+			joinRequests = append(joinRequests, r.model(key))
+		}
+	}
+	return joinRequests
+}
+
+func (d *data) getTeamJoinRequest(teamUUID string, fingerprint models.Fingerprint) (*models.JoinRequest, error) {
+	team := d.findTeam(teamUUID)
+	if team == nil {
+		return nil, sql.ErrNoRows
+	}
+	for _, r := range d.joinRequests {
+		if r.teamID == team.id && r.fingerprint == fingerprint {
+			if key := d.findPublicKey(fingerprint); key != nil && !key.isRevoked {
+				return r.model(key), nil
+			}
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (t team) model() *models.Team {
+	team := models.Team{ID: strconv.FormatInt(t.id, 10), Name: t.name, UUID: t.uuid}
+	team.CreatedAt, team.UpdatedAt = t.pointers()
+	return &team
+}
+
+func (k publicKey) model() *models.PublicKey {
+	publicKey := models.PublicKey{Fingerprint: k.fingerprint, ArmoredPublicKey: k.armored}
+	publicKey.CreatedAt, publicKey.UpdatedAt = k.pointers()
+	return &publicKey
+}
+
+func (u teamUser) model(key *publicKey) *models.Member {
+	member := models.Member{Fingerprint: u.fingerprint, PublicKey: key.armored, IsAdmin: u.isAdmin}
+	member.CreatedAt, member.UpdatedAt = u.pointers()
+	return &member
+}
+
+func (r joinRequest) model(key *publicKey) *models.JoinRequest {
+	joinRequest := models.JoinRequest{ID: r.id, Fingerprint: r.fingerprint, PublicKey: key.armored}
+	joinRequest.CreatedAt, joinRequest.UpdatedAt = r.pointers()
+	return &joinRequest
+}
@@ -0,0 +1,17 @@
+package fakedb_test
+
+import (
+	"testing"
+
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/dbtest"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+// TestDatastore checks the fake behaves as Postgres does, so handler tests
+// using it can be trusted
+func TestDatastore(t *testing.T) {
+	dbtest.RunDatastoreTests(t, func(t *testing.T) models.Datastore {
+		return fakedb.New()
+	})
+}
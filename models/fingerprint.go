@@ -0,0 +1,101 @@
+package models
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A Fingerprint identifies an OpenPGP public key. It's held in its canonical
+// form: compact uppercase hex, which is also how it's stored in the database.
+type Fingerprint string
+
+const (
+	v4FingerprintLength = 20
+	v5FingerprintLength = 32
+)
+
+// ParseFingerprint takes a v4 or v5 fingerprint in any common representation
+// (spaced, compact, 0x-prefixed, upper or lowercase) and returns it in
+// canonical form.
+func ParseFingerprint(fingerprint string) (Fingerprint, error) {
+	compact := strings.Join(strings.Fields(fingerprint), "")
+	if strings.HasPrefix(compact, "0x") || strings.HasPrefix(compact, "0X") {
+		compact = compact[2:]
+	}
+	b, err := hex.DecodeString(compact)
+	if err != nil {
+		return "", fmt.Errorf("invalid fingerprint: %s", fingerprint)
+	}
+	return FingerprintFromBytes(b)
+}
+
+// FingerprintFromBytes returns the Fingerprint for the raw bytes of a v4 or v5
+// fingerprint.
+func FingerprintFromBytes(b []byte) (Fingerprint, error) {
+	if len(b) != v4FingerprintLength && len(b) != v5FingerprintLength {
+		return "", fmt.Errorf("invalid fingerprint length: %d bytes", len(b))
+	}
+	return Fingerprint(fmt.Sprintf("%X", b)), nil
+}
+
+// String returns the canonical form of the fingerprint
+func (f Fingerprint) String() string {
+	return string(f)
+}
+
+// Display returns the fingerprint in groups of four characters with a double
+// space halfway, as GnuPG displays it, e.g. `AAAA BBBB ...  FFFF`
+func (f Fingerprint) Display() string {
+	groups := make([]string, 0, len(f)/4)
+	for i := 0; i+4 <= len(f); i += 4 {
+		groups = append(groups, string(f[i:i+4]))
+	}
+	if len(groups) == 0 {
+		return ""
+	}
+	half := len(groups) / 2
+	return strings.Join(groups[:half], " ") + "  " + strings.Join(groups[half:], " ")
+}
+
+// KeyID returns the long (64-bit) key ID for the fingerprint: the last 16
+// characters of a v4 fingerprint, or the first 16 of a v5 one.
+func (f Fingerprint) KeyID() string {
+	if len(f) == v5FingerprintLength*2 {
+		return string(f[:16])
+	}
+	if len(f) < 16 {
+		return string(f)
+	}
+	return string(f[len(f)-16:])
+}
+
+// MarshalJSON writes the fingerprint as an object containing both the display
+// and compact forms, along with the long key ID.
+func (f Fingerprint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"display": f.Display(),
+		"compact": f.String(),
+		"keyId":   f.KeyID(),
+	})
+}
+
+// UnmarshalJSON accepts either a string in any form ParseFingerprint accepts
+// or the object written by MarshalJSON.
+func (f *Fingerprint) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var forms map[string]string
+		if err := json.Unmarshal(data, &forms); err != nil {
+			return fmt.Errorf("invalid fingerprint: %s", data)
+		}
+		s = forms["compact"]
+	}
+	parsed, err := ParseFingerprint(s)
+	if err != nil {
+		return err
+	}
+	*f = parsed
+	return nil
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrIdempotencyKeyNotClaimed is returned when storing a response for an
+// Idempotency-Key which is no longer claimed by the request, because the claim
+// went stale and another request took it.
+var ErrIdempotencyKeyNotClaimed = errors.New("idempotency key is not claimed by this request")
+
+// An IdempotentResponse is the response originally given to a request made
+// with an Idempotency-Key header, stored so it can be replayed when the
+// request is retried. Keys are chosen by clients, so each Client has its own.
+// While the original request is still being handled it's Pending, with no
+// response.
+type IdempotentResponse struct {
+	Client       string
+	Key          string
+	Method       string
+	Path         string
+	RequestHash  string
+	Pending      bool
+	StatusCode   int
+	Header       http.Header
+	ResponseBody string
+}
+
+// GetIdempotentResponse returns the stored response for the given client,
+// idempotency key, method and path, returning sql.ErrNoRows if there isn't one.
+func (db *DB) GetIdempotentResponse(ctx context.Context, client string, key string, method string, path string) (*IdempotentResponse, error) {
+	return getIdempotentResponse(ctx, db, client, key, method, path)
+}
+
+func getIdempotentResponse(ctx context.Context, q queryer, client string, key string, method string, path string) (*IdempotentResponse, error) {
+	sqlStatement := `SELECT client, key, method, path, request_hash, status_code,
+		response_headers, response_body FROM idempotency_keys
+		WHERE client=$1 AND key=$2 AND method=$3 AND path=$4`
+	response := IdempotentResponse{}
+	var statusCode sql.NullInt64
+	var header, body sql.NullString
+	err := q.QueryRowContext(ctx, sqlStatement, client, key, method, path).Scan(
+		&response.Client, &response.Key, &response.Method, &response.Path, &response.RequestHash,
+		&statusCode, &header, &body)
+	if err != nil {
+		return nil, err
+	}
+	response.Pending = !statusCode.Valid
+	response.StatusCode = int(statusCode.Int64)
+	response.ResponseBody = body.String
+	if header.Valid {
+		if err = json.Unmarshal([]byte(header.String), &response.Header); err != nil {
+			return nil, fmt.Errorf("error reading response headers: %v", err)
+		}
+	}
+	return &response, nil
+}
+
+// ClaimIdempotencyKey stores a pending response for claim's client, key,
+// method and path, so concurrent requests with the same key can tell one is already being
+// handled. It returns nil if the key was claimed, otherwise the response
+// already stored, which may be pending. A pending response older than
+// staleAfter is assumed to belong to a request that never finished, and is
+// claimed again.
+func (db *DB) ClaimIdempotencyKey(ctx context.Context, claim *IdempotentResponse, staleAfter time.Duration) (*IdempotentResponse, error) {
+	for {
+		var id int64
+		err := db.QueryRowContext(ctx, `INSERT INTO idempotency_keys (client, key, method, path, request_hash)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (client, key, method, path) DO UPDATE SET request_hash=$5, updated_at=NOW()
+			WHERE idempotency_keys.status_code IS NULL
+			AND idempotency_keys.updated_at < NOW() - $6 * INTERVAL '1 second'
+			RETURNING id`,
+			claim.Client, claim.Key, claim.Method, claim.Path, claim.RequestHash, staleAfter.Seconds()).Scan(&id)
+		if err == nil {
+			return nil, nil
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+		existing, err := getIdempotentResponse(ctx, db, claim.Client, claim.Key, claim.Method, claim.Path)
+		if err != sql.ErrNoRows {
+			return existing, err
+		}
+		// The claim was released since the insert, so try again
+	}
+}
+
+// CompleteIdempotentResponse stores the response to a request which claimed
+// its Idempotency-Key with ClaimIdempotencyKey. It returns
+// ErrIdempotencyKeyNotClaimed if the claim has since been taken by another
+// request or released.
+func (db *DB) CompleteIdempotentResponse(ctx context.Context, response *IdempotentResponse) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, `UPDATE idempotency_keys
+		SET status_code=$6, response_headers=$7, response_body=$8, updated_at=NOW()
+		WHERE client=$1 AND key=$2 AND method=$3 AND path=$4 AND request_hash=$5
+		AND status_code IS NULL`,
+		response.Client, response.Key, response.Method, response.Path, response.RequestHash,
+		response.StatusCode, string(header), response.ResponseBody)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrIdempotencyKeyNotClaimed
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes a pending response, so a request whose
+// response isn't stored can be retried with the same Idempotency-Key.
+func (db *DB) ReleaseIdempotencyKey(ctx context.Context, client string, key string, method string, path string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys
+		WHERE client=$1 AND key=$2 AND method=$3 AND path=$4 AND status_code IS NULL`,
+		client, key, method, path)
+	return err
+}
+
+// DeleteIdempotentResponses deletes stored responses last updated before
+// olderThan ago, after which their requests are handled again if they're
+// retried. Pending responses are left for ClaimIdempotencyKey to reclaim. It
+// returns how many were deleted.
+func (db *DB) DeleteIdempotentResponses(ctx context.Context, olderThan time.Duration) (int64, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys
+		WHERE status_code IS NOT NULL AND updated_at < NOW() - $1 * INTERVAL '1 second'`,
+		olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// A JoinRequest represents a pending request from a Fluidkeys user to join a
+// team
+type JoinRequest struct {
+	ID          int64       `json:"id,omitempty"`
+	Fingerprint Fingerprint `json:"fingerprint,omitempty"`
+	PublicKey   string      `json:"publicKey,omitempty"`
+	CreatedAt   *time.Time  `json:"createdAt,omitempty"`
+	UpdatedAt   *time.Time  `json:"updatedAt,omitempty"`
+}
+
+// GetTeamJoinRequests returns all join requests for a particular team id,
+// excluding those whose keys have been revoked
+func (db *DB) GetTeamJoinRequests(ctx context.Context, teamID int) ([]*JoinRequest, error) {
+	joinRequests := make([]*JoinRequest, 0)
+	rows, err := db.QueryContext(ctx, `SELECT tjr.id, tjr.fingerprint, pk.armoredpublickey,
+		tjr.created_at, tjr.updated_at FROM public_keys pk, team_join_requests tjr
+		WHERE team_id=$1 AND pk.fingerprint=tjr.fingerprint AND NOT pk.is_revoked`,
+		teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		joinRequest := JoinRequest{}
+		err = rows.Scan(&joinRequest.ID, &joinRequest.Fingerprint,
+			&joinRequest.PublicKey, &joinRequest.CreatedAt, &joinRequest.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		joinRequests = append(joinRequests, &joinRequest)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return joinRequests, nil
+}
+
+// GetTeamJoinRequest returns the request to join the team with the given UUID
+// from the key with the given fingerprint, returning sql.ErrNoRows if there
+// isn't one or the key has been revoked.
+func (db *DB) GetTeamJoinRequest(ctx context.Context, uuid string, fingerprint Fingerprint) (*JoinRequest, error) {
+	return getTeamJoinRequest(ctx, db, uuid, fingerprint)
+}
+
+func getTeamJoinRequest(ctx context.Context, q queryer, uuid string, fingerprint Fingerprint) (*JoinRequest, error) {
+	sqlStatement := `SELECT tjr.id, tjr.fingerprint, pk.armoredpublickey,
+		tjr.created_at, tjr.updated_at FROM public_keys pk, team_join_requests tjr, teams t
+		WHERE t.uuid=$1 AND tjr.team_id=t.id AND tjr.fingerprint=$2
+		AND pk.fingerprint=tjr.fingerprint AND NOT pk.is_revoked`
+	joinRequest := JoinRequest{}
+	err := q.QueryRowContext(ctx, sqlStatement, uuid, fingerprint).Scan(&joinRequest.ID,
+		&joinRequest.Fingerprint, &joinRequest.PublicKey, &joinRequest.CreatedAt,
+		&joinRequest.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &joinRequest, nil
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+)
+
+// KeyMetadata is the information extracted from an armored public key when it's
+// stored, so it can be queried without re-parsing the key
+type KeyMetadata struct {
+	KeyID      string     `json:"keyId"`
+	Algorithm  string     `json:"algorithm"`
+	BitLength  *int       `json:"bitLength,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	IsRevoked  bool       `json:"isRevoked"`
+	CanEncrypt bool       `json:"canEncrypt"`
+	Subkeys    []*Subkey  `json:"subkeys"`
+	UserIDs    []string   `json:"userIds"`
+}
+
+// A Subkey is the metadata of one of a public key's subkeys
+type Subkey struct {
+	Fingerprint Fingerprint `json:"fingerprint"`
+	KeyID       string      `json:"keyId"`
+	Algorithm   string      `json:"algorithm"`
+	BitLength   *int        `json:"bitLength,omitempty"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	ExpiresAt   *time.Time  `json:"expiresAt,omitempty"`
+	IsRevoked   bool        `json:"isRevoked"`
+	CanEncrypt  bool        `json:"canEncrypt"`
+	CanSign     bool        `json:"canSign"`
+}
+
+// ParseKeyMetadata reads a single armored public key and extracts its
+// metadata.
+func ParseKeyMetadata(armoredPublicKey string) (*KeyMetadata, error) {
+	entity, err := readPublicKey(armoredPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := KeyMetadata{
+		KeyID:     entity.PrimaryKey.KeyIdString(),
+		Algorithm: algorithmName(entity.PrimaryKey.PubKeyAlgo),
+		BitLength: bitLength(entity.PrimaryKey),
+		CreatedAt: entity.PrimaryKey.CreationTime,
+		IsRevoked: len(entity.Revocations) > 0,
+		Subkeys:   make([]*Subkey, 0),
+		UserIDs:   make([]string, 0),
+	}
+	if identity := primaryIdentity(entity); identity != nil {
+		metadata.ExpiresAt = keyExpiry(entity.PrimaryKey, identity.SelfSignature)
+		metadata.CanEncrypt = entity.PrimaryKey.PubKeyAlgo.CanEncrypt() &&
+			flaggedForEncryption(identity.SelfSignature)
+		if identity.SelfSignature.RevocationReason != nil {
+			metadata.IsRevoked = true
+		}
+	}
+	metadata.UserIDs = append(metadata.UserIDs, identityNames(entity)...)
+
+	for _, subkey := range entity.Subkeys {
+		subkeyFingerprint, err := FingerprintFromBytes(subkey.PublicKey.Fingerprint[:])
+		if err != nil {
+			return nil, err
+		}
+		metadata.Subkeys = append(metadata.Subkeys, &Subkey{
+			Fingerprint: subkeyFingerprint,
+			KeyID:       subkey.PublicKey.KeyIdString(),
+			Algorithm:   algorithmName(subkey.PublicKey.PubKeyAlgo),
+			BitLength:   bitLength(subkey.PublicKey),
+			CreatedAt:   subkey.PublicKey.CreationTime,
+			ExpiresAt:   keyExpiry(subkey.PublicKey, subkey.Sig),
+			IsRevoked:   subkey.Sig.RevocationReason != nil,
+			CanEncrypt:  subkey.PublicKey.PubKeyAlgo.CanEncrypt() && flaggedForEncryption(subkey.Sig),
+			CanSign: subkey.PublicKey.PubKeyAlgo.CanSign() && subkey.Sig.FlagsValid &&
+				subkey.Sig.FlagSign,
+		})
+	}
+	return &metadata, nil
+}
+
+// BackfillKeyMetadata extracts and stores the metadata for every public key in
+// the database, returning the number of keys updated.
+func (db *DB) BackfillKeyMetadata(ctx context.Context) (int, error) {
+	publicKeys := make([]*PublicKey, 0)
+	rows, err := db.QueryContext(ctx, `SELECT fingerprint, armoredpublickey FROM public_keys`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		publicKey := PublicKey{}
+		err = rows.Scan(&publicKey.Fingerprint, &publicKey.ArmoredPublicKey)
+		if err != nil {
+			return 0, err
+		}
+		publicKeys = append(publicKeys, &publicKey)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, publicKey := range publicKeys {
+		metadata, err := ParseKeyMetadata(publicKey.ArmoredPublicKey)
+		if err != nil {
+			return i, fmt.Errorf("%s: %v", publicKey.Fingerprint, err)
+		}
+		err = db.inTx(ctx, func(sqlTx *sql.Tx) error {
+			return storeKeyMetadata(ctx, sqlTx, publicKey.Fingerprint, metadata)
+		})
+		if err != nil {
+			return i, fmt.Errorf("%s: %v", publicKey.Fingerprint, err)
+		}
+	}
+	return len(publicKeys), nil
+}
+
+// storeKeyMetadata writes the metadata for the public key with the given
+// fingerprint, replacing any subkeys and user IDs already stored for it.
+func storeKeyMetadata(ctx context.Context, tx *sql.Tx, fingerprint Fingerprint, metadata *KeyMetadata) error {
+	_, err := tx.ExecContext(ctx, `UPDATE public_keys SET algorithm=$2, bit_length=$3,
+		key_created_at=$4, key_expires_at=$5, is_revoked=(is_revoked OR $6),
+		updated_at=NOW()
+		WHERE fingerprint=$1`,
+		fingerprint, metadata.Algorithm, metadata.BitLength,
+		metadata.CreatedAt, metadata.ExpiresAt, metadata.IsRevoked)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM public_key_subkeys WHERE fingerprint=$1`, fingerprint)
+	if err != nil {
+		return err
+	}
+	for _, subkey := range metadata.Subkeys {
+		_, err = tx.ExecContext(ctx, `INSERT INTO public_key_subkeys (fingerprint,
+			subkey_fingerprint, key_id, algorithm, bit_length, key_created_at,
+			key_expires_at, is_revoked, can_encrypt, can_sign)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			fingerprint, subkey.Fingerprint, subkey.KeyID, subkey.Algorithm,
+			subkey.BitLength, subkey.CreatedAt, subkey.ExpiresAt,
+			subkey.IsRevoked, subkey.CanEncrypt, subkey.CanSign)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM public_key_user_ids WHERE fingerprint=$1`, fingerprint)
+	if err != nil {
+		return err
+	}
+	for _, userID := range metadata.UserIDs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO public_key_user_ids (fingerprint, user_id)
+			VALUES ($1, $2)`, fingerprint, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flaggedForEncryption returns true if the self-signature allows the key to
+// be used for encryption. A key without flags may be used for anything.
+func flaggedForEncryption(sig *packet.Signature) bool {
+	return !sig.FlagsValid || sig.FlagEncryptCommunications || sig.FlagEncryptStorage
+}
+
+func algorithmName(algorithm packet.PublicKeyAlgorithm) string {
+	switch algorithm {
+	case packet.PubKeyAlgoRSA:
+		return "RSA"
+	case packet.PubKeyAlgoRSAEncryptOnly:
+		return "RSA-E"
+	case packet.PubKeyAlgoRSASignOnly:
+		return "RSA-S"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	default:
+		return fmt.Sprintf("unknown (%d)", algorithm)
+	}
+}
+
+// bitLength returns nil for algorithms (such as elliptic curves) where the
+// bit length isn't known.
+func bitLength(key *packet.PublicKey) *int {
+	length, err := key.BitLength()
+	if err != nil {
+		return nil
+	}
+	bits := int(length)
+	return &bits
+}
+
+// primaryIdentity returns the Identity marked as primary, or the first identity
+// by name if none are so marked. If several are marked primary, the one with
+// the most recent self-signature wins, as in GnuPG.
+func primaryIdentity(entity *openpgp.Entity) *openpgp.Identity {
+	var firstIdentity, primary *openpgp.Identity
+	for _, name := range identityNames(entity) {
+		identity := entity.Identities[name]
+		if firstIdentity == nil {
+			firstIdentity = identity
+		}
+		if identity.SelfSignature.IsPrimaryId == nil || !*identity.SelfSignature.IsPrimaryId {
+			continue
+		}
+		if primary == nil || identity.SelfSignature.CreationTime.After(primary.SelfSignature.CreationTime) {
+			primary = identity
+		}
+	}
+	if primary != nil {
+		return primary
+	}
+	return firstIdentity
+}
+
+// identityNames returns the names of the entity's identities in order, since
+// they're held in a map
+func identityNames(entity *openpgp.Entity) []string {
+	names := make([]string, 0, len(entity.Identities))
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keyExpiry returns the time the key expires according to its self-signature,
+// or nil if it never expires. Key lifetime is counted from the key's creation
+// time, not the signature's.
+func keyExpiry(key *packet.PublicKey, selfSignature *packet.Signature) *time.Time {
+	if selfSignature.KeyLifetimeSecs == nil || *selfSignature.KeyLifetimeSecs == 0 {
+		return nil
+	}
+	expiry := key.CreationTime.Add(time.Duration(*selfSignature.KeyLifetimeSecs) * time.Second)
+	return &expiry
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+)
+
+func TestPrimaryIdentity(t *testing.T) {
+	created := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		identities []*openpgp.Identity
+		want       string
+	}{
+		{
+			"none marked primary",
+			[]*openpgp.Identity{
+				identity("c <c@example.com>", nil, created),
+				identity("a <a@example.com>", nil, created),
+				identity("b <b@example.com>", nil, created),
+			},
+			"a <a@example.com>",
+		},
+		{
+			"one marked primary",
+			[]*openpgp.Identity{
+				identity("a <a@example.com>", nil, created),
+				identity("b <b@example.com>", boolPtr(true), created),
+				identity("c <c@example.com>", boolPtr(false), created),
+			},
+			"b <b@example.com>",
+		},
+		{
+			"several marked primary",
+			[]*openpgp.Identity{
+				identity("a <a@example.com>", boolPtr(true), created),
+				identity("b <b@example.com>", boolPtr(true), created.Add(time.Hour)),
+				identity("c <c@example.com>", boolPtr(true), created),
+			},
+			"b <b@example.com>",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entity := &openpgp.Entity{Identities: map[string]*openpgp.Identity{}}
+			for _, identity := range test.identities {
+				entity.Identities[identity.Name] = identity
+			}
+			// map iteration order varies between runs, so check it doesn't
+			// change the answer
+			for i := 0; i < 20; i++ {
+				if got := primaryIdentity(entity); got.Name != test.want {
+					t.Fatalf("expected %s, got %s", test.want, got.Name)
+				}
+			}
+		})
+	}
+}
+
+func identity(name string, isPrimary *bool, signed time.Time) *openpgp.Identity {
+	return &openpgp.Identity{
+		Name:          name,
+		SelfSignature: &packet.Signature{IsPrimaryId: isPrimary, CreationTime: signed},
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -1,24 +1,70 @@
 package models
 
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
 // A Member represents a Fluidkeys user on the teamserver
 type Member struct {
-	PublicKey string `json:"publicKey,omitempty"`
-	IsAdmin   bool   `json:"isAdmin,omitempty"`
+	Fingerprint Fingerprint `json:"fingerprint,omitempty"`
+	PublicKey   string      `json:"publicKey,omitempty"`
+	IsAdmin     bool        `json:"isAdmin,omitempty"`
+	CreatedAt   *time.Time  `json:"createdAt,omitempty"`
+	UpdatedAt   *time.Time  `json:"updatedAt,omitempty"`
+}
+
+// GetTeamMembers returns all users for a particular team id, excluding those
+// whose keys have been revoked
+func (db *DB) GetTeamMembers(ctx context.Context, teamID int) ([]*Member, error) {
+	return getTeamMembers(ctx, db, teamID, false)
+}
+
+// GetTeamMembersWithRevoked returns the users of the team with the given UUID
+// whose keys aren't revoked and, separately, those whose keys are. Both are
+// read in one transaction so they agree. If there's no such team it returns
+// sql.ErrNoRows.
+func (db *DB) GetTeamMembersWithRevoked(ctx context.Context, teamUUID uuid.UUID) (members []*Member, revokedMembers []*Member, err error) {
+	sqlTx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sqlTx.Rollback()
+
+	var teamID int
+	err = sqlTx.QueryRowContext(ctx, `SELECT id FROM teams WHERE uuid=$1`, teamUUID).Scan(&teamID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if members, err = getTeamMembers(ctx, sqlTx, teamID, false); err != nil {
+		return nil, nil, err
+	}
+	if revokedMembers, err = getTeamMembers(ctx, sqlTx, teamID, true); err != nil {
+		return nil, nil, err
+	}
+	if err = sqlTx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return members, revokedMembers, nil
 }
 
-// GetTeamMembers returns all users for a particular team id
-func (db *DB) GetTeamMembers(teamID int) ([]*Member, error) {
+func getTeamMembers(ctx context.Context, q queryer, teamID int, revoked bool) ([]*Member, error) {
 	members := make([]*Member, 0)
-	rows, err := db.Query(`SELECT pk.armoredpublickey, tu.is_admin FROM
+	rows, err := q.QueryContext(ctx, `SELECT tu.fingerprint, pk.armoredpublickey, tu.is_admin,
+		tu.created_at, tu.updated_at FROM
 		public_keys pk, team_users tu
-		WHERE team_id=$1 AND pk.fingerprint=tu.fingerprint`, teamID)
+		WHERE team_id=$1 AND pk.fingerprint=tu.fingerprint AND pk.is_revoked=$2`, teamID, revoked)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		member := Member{}
-		err = rows.Scan(&member.PublicKey, &member.IsAdmin)
+		err = rows.Scan(&member.Fingerprint, &member.PublicKey, &member.IsAdmin,
+			&member.CreatedAt, &member.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrPublicKeyRevoked is returned when storing a public key which is already
+// stored and has been revoked, so can't be used again
+var ErrPublicKeyRevoked = errors.New("public key has been revoked")
+
+// A PublicKey represents an OpenPGP public key stored on the teamserver
+type PublicKey struct {
+	Fingerprint      Fingerprint `json:"fingerprint,omitempty"`
+	ArmoredPublicKey string      `json:"armoredPublicKey,omitempty"`
+	CreatedAt        *time.Time  `json:"createdAt,omitempty"`
+	UpdatedAt        *time.Time  `json:"updatedAt,omitempty"`
+}
+
+// AllPublicKeys reads all the public keys in the database that haven't been
+// revoked
+func (db *DB) AllPublicKeys(ctx context.Context) ([]*PublicKey, error) {
+	return db.allPublicKeys(ctx, false)
+}
+
+// AllRevokedPublicKeys reads all the public keys in the database that have
+// been revoked, which AllPublicKeys leaves out
+func (db *DB) AllRevokedPublicKeys(ctx context.Context) ([]*PublicKey, error) {
+	return db.allPublicKeys(ctx, true)
+}
+
+func (db *DB) allPublicKeys(ctx context.Context, revoked bool) ([]*PublicKey, error) {
+	publicKeys := make([]*PublicKey, 0)
+	rows, err := db.QueryContext(ctx, `SELECT fingerprint, armoredpublickey, created_at, updated_at
+		FROM public_keys WHERE is_revoked=$1`, revoked)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		publicKey := PublicKey{}
+		err = rows.Scan(&publicKey.Fingerprint, &publicKey.ArmoredPublicKey,
+			&publicKey.CreatedAt, &publicKey.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, &publicKey)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return publicKeys, nil
+}
+
+// GetPublicKey retrieves the public key with the given fingerprint from the
+// database, returning sql.ErrNoRows if there isn't one.
+func (db *DB) GetPublicKey(ctx context.Context, fingerprint Fingerprint) (*PublicKey, error) {
+	sqlStatement := `SELECT fingerprint, armoredpublickey, created_at, updated_at
+		FROM public_keys WHERE fingerprint=$1`
+	publicKey := PublicKey{}
+	err := db.QueryRowContext(ctx, sqlStatement, fingerprint).Scan(
+		&publicKey.Fingerprint, &publicKey.ArmoredPublicKey,
+		&publicKey.CreatedAt, &publicKey.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &publicKey, nil
+}
+
+// RevokePublicKey replaces the stored public key with the given armored key
+// (which should include the revocation signature) and marks it as revoked,
+// which leaves it out of every team it belongs to. It returns sql.ErrNoRows if
+// there's no such key.
+func (db *DB) RevokePublicKey(ctx context.Context, fingerprint Fingerprint, armoredPublicKey string) error {
+	metadata, err := ParseKeyMetadata(armoredPublicKey)
+	if err != nil {
+		return err
+	}
+	return db.inTx(ctx, func(sqlTx *sql.Tx) error {
+		result, err := sqlTx.ExecContext(ctx, `UPDATE public_keys
+			SET armoredpublickey=$2, is_revoked=true, updated_at=NOW()
+			WHERE fingerprint=$1`,
+			fingerprint, armoredPublicKey)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+		return storeKeyMetadata(ctx, sqlTx, fingerprint, metadata)
+	})
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+)
+
+// MergePublicKey returns the stored armored key with the user IDs, subkeys,
+// signatures and newer self-signatures from the posted key added to it. Anyone
+// can post a copy of a key, so posting one can only add to what's stored:
+// anything missing from the posted copy, or signed earlier in it, is kept as
+// stored. changed is false if the posted key adds nothing.
+func MergePublicKey(stored string, posted string) (merged string, changed bool, err error) {
+	storedEntity, err := readPublicKey(stored)
+	if err != nil {
+		return "", false, err
+	}
+	postedEntity, err := readPublicKey(posted)
+	if err != nil {
+		return "", false, err
+	}
+	if storedEntity.PrimaryKey.Fingerprint != postedEntity.PrimaryKey.Fingerprint {
+		return "", false, fmt.Errorf("can't merge keys with different primary keys")
+	}
+
+	for _, revocation := range postedEntity.Revocations {
+		if !containsSignature(storedEntity.Revocations, revocation) {
+			storedEntity.Revocations = append(storedEntity.Revocations, revocation)
+			changed = true
+		}
+	}
+	for name, postedIdentity := range postedEntity.Identities {
+		storedIdentity, ok := storedEntity.Identities[name]
+		if !ok {
+			storedEntity.Identities[name] = postedIdentity
+			changed = true
+			continue
+		}
+		if isNewerSelfSignature(storedIdentity.SelfSignature, postedIdentity.SelfSignature) {
+			storedIdentity.SelfSignature = postedIdentity.SelfSignature
+			changed = true
+		}
+		for _, signature := range postedIdentity.Signatures {
+			if !containsSignature(storedIdentity.Signatures, signature) {
+				storedIdentity.Signatures = append(storedIdentity.Signatures, signature)
+				changed = true
+			}
+		}
+	}
+	for _, postedSubkey := range postedEntity.Subkeys {
+		i := findSubkey(storedEntity.Subkeys, postedSubkey.PublicKey)
+		if i == -1 {
+			storedEntity.Subkeys = append(storedEntity.Subkeys, postedSubkey)
+			changed = true
+		} else if isNewerSelfSignature(storedEntity.Subkeys[i].Sig, postedSubkey.Sig) {
+			storedEntity.Subkeys[i].Sig = postedSubkey.Sig
+			changed = true
+		}
+	}
+	if !changed {
+		return stored, false, nil
+	}
+
+	merged, err = armorPublicKey(storedEntity)
+	if err != nil {
+		return "", false, err
+	}
+	return merged, true, nil
+}
+
+// readPublicKey reads a single armored public key
+func readPublicKey(armoredPublicKey string) (*openpgp.Entity, error) {
+	entityList, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("error reading armored key ring: %v", err)
+	}
+	if len(entityList) != 1 {
+		return nil, fmt.Errorf("expected 1 openpgp.Entity, got %d", len(entityList))
+	}
+	return entityList[0], nil
+}
+
+// isNewerSelfSignature returns true if posted should replace stored. A
+// revocation is never replaced.
+func isNewerSelfSignature(stored *packet.Signature, posted *packet.Signature) bool {
+	if stored.RevocationReason != nil || stored.SigType == packet.SigTypeSubkeyRevocation {
+		return false
+	}
+	return posted.CreationTime.After(stored.CreationTime)
+}
+
+func containsSignature(signatures []*packet.Signature, signature *packet.Signature) bool {
+	for _, s := range signatures {
+		if s.SigType == signature.SigType && s.CreationTime.Equal(signature.CreationTime) &&
+			issuerKeyID(s) == issuerKeyID(signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func issuerKeyID(signature *packet.Signature) uint64 {
+	if signature.IssuerKeyId == nil {
+		return 0
+	}
+	return *signature.IssuerKeyId
+}
+
+func findSubkey(subkeys []openpgp.Subkey, publicKey *packet.PublicKey) int {
+	for i, subkey := range subkeys {
+		if subkey.PublicKey.Fingerprint == publicKey.Fingerprint {
+			return i
+		}
+	}
+	return -1
+}
+
+// armorPublicKey serializes entity with its revocations, which
+// Entity.Serialize leaves out, writing user IDs in order so the same key is
+// always armored the same way.
+func armorPublicKey(entity *openpgp.Entity) (string, error) {
+	out := bytes.Buffer{}
+	w, err := armor.Encode(&out, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err = entity.PrimaryKey.Serialize(w); err != nil {
+		return "", err
+	}
+	for _, revocation := range entity.Revocations {
+		if err = revocation.Serialize(w); err != nil {
+			return "", err
+		}
+	}
+
+	names := make([]string, 0, len(entity.Identities))
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		identity := entity.Identities[name]
+		if err = identity.UserId.Serialize(w); err != nil {
+			return "", err
+		}
+		if err = identity.SelfSignature.Serialize(w); err != nil {
+			return "", err
+		}
+		for _, signature := range identity.Signatures {
+			if err = signature.Serialize(w); err != nil {
+				return "", err
+			}
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if err = subkey.PublicKey.Serialize(w); err != nil {
+			return "", err
+		}
+		if err = subkey.Sig.Serialize(w); err != nil {
+			return "", err
+		}
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/packet"
+)
+
+func TestMergePublicKey(t *testing.T) {
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	entity, err := openpgp.NewEntity("Original", "", "original@example.com", &packet.Config{
+		RSABits: 1024,
+		Time:    func() time.Time { return created },
+	})
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	original := armorForTest(t, entity)
+
+	withoutSubkeys := *entity
+	withoutSubkeys.Subkeys = nil
+	stripped := armorForTest(t, &withoutSubkeys)
+
+	withNewIdentity := withIdentity(entity, signedIdentity(t, entity, "New <new@example.com>", created.Add(time.Minute)))
+	added := armorForTest(t, withNewIdentity)
+
+	originalName := primaryIdentity(entity).Name
+	resigned := withIdentity(&withoutSubkeys, signedIdentity(t, entity, originalName, created.Add(time.Minute)))
+	newerWithoutSubkeys := armorForTest(t, resigned)
+
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	t.Run("posting a copy with parts missing keeps the stored key", func(t *testing.T) {
+		merged, changed, err := MergePublicKey(original, stripped)
+		if err != nil || changed || merged != original {
+			t.Errorf("expected stored key unchanged, got changed=%v, %v", changed, err)
+		}
+	})
+
+	t.Run("posting an older copy keeps the stored key", func(t *testing.T) {
+		merged, changed, err := MergePublicKey(added, original)
+		if err != nil || changed || merged != added {
+			t.Errorf("expected stored key unchanged, got changed=%v, %v", changed, err)
+		}
+	})
+
+	t.Run("posting a new user ID adds it", func(t *testing.T) {
+		merged, changed, err := MergePublicKey(original, added)
+		if err != nil || !changed {
+			t.Fatalf("expected key to change, got changed=%v, %v", changed, err)
+		}
+		metadata := parseForTest(t, merged)
+		if len(metadata.UserIDs) != 2 || len(metadata.Subkeys) != 1 {
+			t.Errorf("expected 2 user IDs and 1 subkey, got %v and %d subkeys", metadata.UserIDs, len(metadata.Subkeys))
+		}
+	})
+
+	t.Run("posting a newer self-signature keeps stored subkeys", func(t *testing.T) {
+		merged, changed, err := MergePublicKey(original, newerWithoutSubkeys)
+		if err != nil || !changed {
+			t.Fatalf("expected key to change, got changed=%v, %v", changed, err)
+		}
+		mergedEntity, err := readPublicKey(merged)
+		if err != nil {
+			t.Fatalf("error reading merged key: %v", err)
+		}
+		if len(mergedEntity.Subkeys) != 1 {
+			t.Errorf("expected the stored subkey to be kept, got %d subkeys", len(mergedEntity.Subkeys))
+		}
+		if got := mergedEntity.Identities[originalName].SelfSignature.CreationTime; !got.Equal(created.Add(time.Minute)) {
+			t.Errorf("expected the newer self-signature, got one made at %v", got)
+		}
+	})
+
+	t.Run("posting another key is an error", func(t *testing.T) {
+		if _, _, err := MergePublicKey(original, armorForTest(t, other)); err == nil {
+			t.Error("expected an error merging different keys")
+		}
+	})
+}
+
+// signedIdentity returns a user ID for entity, self-signed at signed
+func signedIdentity(t *testing.T, entity *openpgp.Entity, name string, signed time.Time) *openpgp.Identity {
+	userID := &packet.UserId{Id: name}
+	selfSignature := &packet.Signature{
+		SigType:      packet.SigTypePositiveCert,
+		PubKeyAlgo:   entity.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: signed,
+		IssuerKeyId:  &entity.PrimaryKey.KeyId,
+		FlagsValid:   true,
+		FlagSign:     true,
+		FlagCertify:  true,
+	}
+	if err := selfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+		t.Fatalf("error signing user ID: %v", err)
+	}
+	return &openpgp.Identity{Name: name, UserId: userID, SelfSignature: selfSignature}
+}
+
+// withIdentity returns a copy of entity with identity added, replacing any
+// with the same name
+func withIdentity(entity *openpgp.Entity, identity *openpgp.Identity) *openpgp.Entity {
+	copied := *entity
+	copied.Identities = map[string]*openpgp.Identity{identity.Name: identity}
+	for name, existing := range entity.Identities {
+		if name != identity.Name {
+			copied.Identities[name] = existing
+		}
+	}
+	return &copied
+}
+
+func armorForTest(t *testing.T, entity *openpgp.Entity) string {
+	armored, err := armorPublicKey(entity)
+	if err != nil {
+		t.Fatalf("error armoring key: %v", err)
+	}
+	return armored
+}
+
+func parseForTest(t *testing.T, armored string) *KeyMetadata {
+	metadata, err := ParseKeyMetadata(armored)
+	if err != nil {
+		t.Fatalf("error parsing key: %v", err)
+	}
+	return metadata
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// TakeRateLimitToken takes a token from the rate limit bucket identified by key,
+// which refills at ratePerSecond up to burst tokens. It returns whether a token
+// was available and, if not, how long until one will be. Buckets are stored
+// in the database so limits hold across every server process.
+func (db *DB) TakeRateLimitToken(ctx context.Context, key string, ratePerSecond float64, burst int) (bool, time.Duration, error) {
+	// The refilled token count is calculated in a single statement so
+	// concurrent requests can't both take the last token. full_at is when an
+	// empty bucket would be full, which is never earlier than this one will be.
+	sqlStatement := `
+		INSERT INTO rate_limit_buckets (key, tokens, allowed, updated_at, full_at)
+		VALUES ($1, $3::float8 - 1, TRUE, NOW(), NOW() + $3::float8 / $2::float8 * INTERVAL '1 second')
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST($3::float8, rate_limit_buckets.tokens + $2::float8 *
+					EXTRACT(EPOCH FROM NOW() - rate_limit_buckets.updated_at))
+				- CASE WHEN LEAST($3::float8, rate_limit_buckets.tokens + $2::float8 *
+					EXTRACT(EPOCH FROM NOW() - rate_limit_buckets.updated_at)) >= 1
+					THEN 1 ELSE 0 END,
+			allowed = LEAST($3::float8, rate_limit_buckets.tokens + $2::float8 *
+				EXTRACT(EPOCH FROM NOW() - rate_limit_buckets.updated_at)) >= 1,
+			updated_at = NOW(),
+			full_at = NOW() + $3::float8 / $2::float8 * INTERVAL '1 second'
+		RETURNING tokens, allowed`
+	var tokens float64
+	var allowed bool
+	err := db.QueryRowContext(ctx, sqlStatement, key, ratePerSecond, burst).Scan(&tokens, &allowed)
+	if err != nil {
+		return false, 0, err
+	}
+	if allowed {
+		return true, 0, nil
+	}
+	wait := math.Ceil((1 - tokens) / ratePerSecond * float64(time.Second))
+	return false, time.Duration(wait), nil
+}
+
+// ReturnRateLimitToken puts back a token taken from the bucket identified by
+// key, such as when the request it was taken for was refused by another
+// limit. The bucket never holds more than burst tokens.
+func (db *DB) ReturnRateLimitToken(ctx context.Context, key string, burst int) error {
+	_, err := db.ExecContext(ctx, `UPDATE rate_limit_buckets
+		SET tokens = LEAST($2::float8, tokens + 1) WHERE key=$1`, key, burst)
+	return err
+}
+
+// DeleteFullRateLimitBuckets deletes buckets which have refilled, which are the
+// same as no bucket at all, returning how many were deleted
+func (db *DB) DeleteFullRateLimitBuckets(ctx context.Context) (int64, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM rate_limit_buckets WHERE full_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
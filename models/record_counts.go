@@ -0,0 +1,31 @@
+package models
+
+import (
+	"context"
+)
+
+// RecordCounts is how many teams, members and pending join requests are
+// stored, for monitoring
+type RecordCounts struct {
+	Teams               int
+	Members             int
+	PendingJoinRequests int
+}
+
+// CountRecords counts the teams, members and pending join requests. As in
+// GetTeamMembers and GetTeamJoinRequests, revoked keys aren't counted.
+func (db *DB) CountRecords(ctx context.Context) (*RecordCounts, error) {
+	sqlStatement := `SELECT
+		(SELECT COUNT(*) FROM teams),
+		(SELECT COUNT(*) FROM team_users tu, public_keys pk
+			WHERE pk.fingerprint=tu.fingerprint AND NOT pk.is_revoked),
+		(SELECT COUNT(*) FROM team_join_requests tjr, public_keys pk
+			WHERE pk.fingerprint=tjr.fingerprint AND NOT pk.is_revoked)`
+	counts := RecordCounts{}
+	err := db.QueryRowContext(ctx, sqlStatement).Scan(&counts.Teams, &counts.Members,
+		&counts.PendingJoinRequests)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// SchemaVersion is the number of the latest migration the models depend on.
+// Bump it when adding a migration, which must also update schema_version.
+const SchemaVersion = 15
+
+// CheckSchemaVersion returns an error if the database hasn't had every
+// migration up to SchemaVersion applied. A newer schema is allowed, since
+// migrations are applied before new code is deployed.
+func (db *DB) CheckSchemaVersion(ctx context.Context) error {
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("schema is at version %d, expected at least %d", version, SchemaVersion)
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package models
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/satori/go.uuid"
 )
 
@@ -11,6 +17,8 @@ type Team struct {
 	UUID         string         `json:"uuid,omitempty"`
 	Members      []*Member      `json:"members,omitempty"`
 	JoinRequests []*JoinRequest `json:"joinRequests,omitempty"`
+	CreatedAt    *time.Time     `json:"createdAt,omitempty"`
+	UpdatedAt    *time.Time     `json:"updatedAt,omitempty"`
 }
 
 // A TeamUUID represents a simple json structure used in response
@@ -30,6 +38,18 @@ type RequestPOST struct {
 	PublicKey string `json:"publicKey,omitempty"`
 }
 
+// A PayloadPOST represents a simple json structure containing an armored
+// OpenPGP message to be checked before it's relayed to a team
+type PayloadPOST struct {
+	Payload string `json:"payload,omitempty"`
+}
+
+// A RevokePOST represents a simple json structure containing an armored key
+// revocation signature
+type RevokePOST struct {
+	RevocationSignature string `json:"revocationSignature,omitempty"`
+}
+
 // A TeamSummary represents a simplified team output
 type TeamSummary struct {
 	*Team
@@ -40,16 +60,16 @@ type TeamSummary struct {
 type omit *struct{}
 
 // AllTeams reads all the teams in the database
-func (db *DB) AllTeams() ([]*Team, error) {
+func (db *DB) AllTeams(ctx context.Context) ([]*Team, error) {
 	teams := make([]*Team, 0)
-	rows, err := db.Query(`SELECT id, name, uuid FROM teams`)
+	rows, err := db.QueryContext(ctx, `SELECT id, name, uuid, created_at, updated_at FROM teams`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		team := Team{}
-		err = rows.Scan(&team.ID, &team.Name, &team.UUID)
+		err = rows.Scan(&team.ID, &team.Name, &team.UUID, &team.CreatedAt, &team.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -64,100 +84,109 @@ func (db *DB) AllTeams() ([]*Team, error) {
 
 // CreateTeam inserts a record for the given teamName in the database returning
 // the ID of the record
-func (db *DB) CreateTeam(teamName string) (int64, *uuid.UUID, error) {
-	uuid := uuid.NewV4()
-	sqlStatement := `INSERT INTO teams (name, uuid) VALUES ($1, $2) RETURNING id`
-	writeDB, err := db.Begin()
-	if err != nil {
-		writeDB.Rollback()
-		return 0, nil, err
-	}
-	var teamID int64
-	err = writeDB.QueryRow(sqlStatement, teamName, uuid).Scan(&teamID)
-	if err != nil {
-		writeDB.Rollback()
-		return 0, nil, err
-	}
-	return teamID, &uuid, writeDB.Commit()
+func (db *DB) CreateTeam(ctx context.Context, teamName string) (teamID int64, teamUUID *uuid.UUID, err error) {
+	err = db.WithTx(ctx, func(tx Tx) (err error) {
+		teamID, teamUUID, err = tx.CreateTeam(teamName)
+		return err
+	})
+	return teamID, teamUUID, err
 }
 
 // CreateTeamUser inserts a record for the given user in the database, returning
 // the ID.
-func (db *DB) CreateTeamUser(teamID int64, fingerprint string) (int64, error) {
-	sqlStatement := `INSERT INTO team_users (team_id, fingerprint, is_admin) VALUES ($1, $2, $3) RETURNING id`
-	writeDB, err := db.Begin()
-	if err != nil {
-		writeDB.Rollback()
-		return 0, err
-	}
-	var teamUserID int64
-	err = writeDB.QueryRow(sqlStatement, teamID, fingerprint, true).Scan(&teamUserID)
-	if err != nil {
-		writeDB.Rollback()
-		return 0, err
-	}
-	return teamUserID, writeDB.Commit()
+func (db *DB) CreateTeamUser(ctx context.Context, teamID int64, fingerprint Fingerprint) (teamUserID int64, err error) {
+	err = db.WithTx(ctx, func(tx Tx) (err error) {
+		teamUserID, err = tx.CreateTeamUser(teamID, fingerprint)
+		return err
+	})
+	return teamUserID, err
 }
 
-// CreatePublicKey takes a fingerprint and publickey and creates a record in the
-// database, returning the ID.
-func (db *DB) CreatePublicKey(fingerprint string, publicKey string) (int64, error) {
-	sqlStatement := `INSERT INTO public_keys (fingerprint, armoredPublicKey)
-		VALUES ($1, $2) ON CONFLICT ON CONSTRAINT public_keys_pkey
-		DO UPDATE SET fingerprint = $1 RETURNING id`
-	// TODO: To ensure we get the return id, I've added the 'ON CONFLICT' clause
-	// I don't really think this is the best approach, but for now it works.
-	writeDB, err := db.Begin()
-	if err != nil {
-		writeDB.Rollback()
-		return 0, err
-	}
-	var publicKeyID int64
-	err = writeDB.QueryRow(sqlStatement, fingerprint, publicKey).Scan(&publicKeyID)
+// CreatePublicKey takes a fingerprint and publickey and creates a record in
+// the database along with the key's metadata, or merges it into the stored
+// key, returning the ID. It returns ErrPublicKeyRevoked if the key is stored
+// already and has been revoked.
+func (db *DB) CreatePublicKey(ctx context.Context, fingerprint Fingerprint, publicKey string) (publicKeyID int64, err error) {
+	err = db.WithTx(ctx, func(tx Tx) (err error) {
+		publicKeyID, err = tx.CreatePublicKey(fingerprint, publicKey)
+		return err
+	})
+	return publicKeyID, err
+}
+
+// GetTeam uses a uuid to retrieve a single team from the database, returning
+// sql.ErrNoRows if there isn't one.
+func (db *DB) GetTeam(ctx context.Context, uuid uuid.UUID) (*Team, error) {
+	sqlStatement := `SELECT id, name, uuid, created_at, updated_at FROM teams
+		WHERE uuid=$1`
+	team := Team{}
+	err := db.QueryRowContext(ctx, sqlStatement, uuid).Scan(&team.ID, &team.Name, &team.UUID,
+		&team.CreatedAt, &team.UpdatedAt)
 	if err != nil {
-		writeDB.Rollback()
-		return 0, err
+		return nil, err
 	}
-	return publicKeyID, writeDB.Commit()
+	return &team, nil
 }
 
-// GetTeam uses a uuid to retrieve a single team from the database.
-func (db *DB) GetTeam(uuid uuid.UUID) (*Team, error) {
-	sqlStatement := `SELECT id, name, uuid FROM teams WHERE uuid=$1`
-	rows, err := db.Query(sqlStatement, uuid)
+// GetTeamWithMembers returns the team with the given uuid along with its
+// members and join requests, leaving out revoked keys as GetTeamMembers and
+// GetTeamJoinRequests do. They're read in a single query in a read-only
+// snapshot, returning sql.ErrNoRows if there's no such team.
+func (db *DB) GetTeamWithMembers(ctx context.Context, uuid uuid.UUID) (*Team, error) {
+	sqlTx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer sqlTx.Rollback()
+
+	// Timestamps are converted to timestamptz so their JSON includes a zone,
+	// which encoding/json needs to parse them
+	sqlStatement := `SELECT t.id, t.name, t.uuid, t.created_at, t.updated_at,
+		COALESCE((SELECT json_agg(json_build_object(
+				'fingerprint', tu.fingerprint,
+				'publicKey', pk.armoredpublickey,
+				'isAdmin', tu.is_admin,
+				'createdAt', tu.created_at AT TIME ZONE 'UTC',
+				'updatedAt', tu.updated_at AT TIME ZONE 'UTC') ORDER BY tu.id)
+			FROM team_users tu, public_keys pk
+			WHERE tu.team_id=t.id AND pk.fingerprint=tu.fingerprint AND NOT pk.is_revoked
+		), '[]'),
+		COALESCE((SELECT json_agg(json_build_object(
+				'id', tjr.id,
+				'fingerprint', tjr.fingerprint,
+				'publicKey', pk.armoredpublickey,
+				'createdAt', tjr.created_at AT TIME ZONE 'UTC',
+				'updatedAt', tjr.updated_at AT TIME ZONE 'UTC') ORDER BY tjr.id)
+			FROM team_join_requests tjr, public_keys pk
+			WHERE tjr.team_id=t.id AND pk.fingerprint=tjr.fingerprint AND NOT pk.is_revoked
+		), '[]')
+		FROM teams t WHERE t.uuid=$1`
 	team := Team{}
-	for rows.Next() {
-		err = rows.Scan(&team.ID, &team.Name, &team.UUID)
-		if err != nil {
-			return nil, err
-		}
-	}
-	err = rows.Err()
+	var members, joinRequests []byte
+	err = sqlTx.QueryRowContext(ctx, sqlStatement, uuid).Scan(&team.ID, &team.Name, &team.UUID,
+		&team.CreatedAt, &team.UpdatedAt, &members, &joinRequests)
 	if err != nil {
 		return nil, err
 	}
+	if err = json.Unmarshal(members, &team.Members); err != nil {
+		return nil, fmt.Errorf("error reading team members: %v", err)
+	}
+	if err = json.Unmarshal(joinRequests, &team.JoinRequests); err != nil {
+		return nil, fmt.Errorf("error reading join requests: %v", err)
+	}
+	if err = sqlTx.Commit(); err != nil {
+		return nil, err
+	}
 	return &team, nil
 }
 
 // CreateTeamJoinRequest creates a record team_join_requests record in the
-// database, finding the team id using the passed UUID.
-func (db *DB) CreateTeamJoinRequest(fingerprint string, uuid string) (int64, error) {
-	sqlStatement := `INSERT INTO team_join_requests (team_id, fingerprint)
-		SELECT t.id, $2 FROM teams t WHERE uuid=$1 RETURNING id`
-	writeDB, err := db.Begin()
-	if err != nil {
-		writeDB.Rollback()
-		return 0, err
-	}
-	var teamJoinRequestID int64
-	err = writeDB.QueryRow(sqlStatement, uuid, fingerprint).Scan(&teamJoinRequestID)
-	if err != nil {
-		writeDB.Rollback()
-		return 0, err
-	}
-	return teamJoinRequestID, writeDB.Commit()
+// database, finding the team id using the passed UUID. If there's already a
+// request from the fingerprint, or no such team, it returns sql.ErrNoRows.
+func (db *DB) CreateTeamJoinRequest(ctx context.Context, fingerprint Fingerprint, uuid string) (teamJoinRequestID int64, err error) {
+	err = db.WithTx(ctx, func(tx Tx) (err error) {
+		teamJoinRequestID, err = tx.CreateTeamJoinRequest(fingerprint, uuid)
+		return err
+	})
+	return teamJoinRequestID, err
 }
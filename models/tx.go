@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/lib/pq"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Tx is the set of model operations that can be composed into a single
+// transaction using Datastore.WithTx. They run with the context WithTx was
+// given.
+type Tx interface {
+	CreateTeam(string) (int64, *uuid.UUID, error)
+	CreateTeamUser(int64, Fingerprint) (int64, error)
+	CreatePublicKey(Fingerprint, string) (int64, error)
+	CreateTeamJoinRequest(Fingerprint, string) (int64, error)
+	GetTeamJoinRequest(string, Fingerprint) (*JoinRequest, error)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx, so reads can be shared
+// between DB and tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// tx implements Tx on top of a database transaction
+type tx struct {
+	*sql.Tx
+	ctx context.Context
+}
+
+// maxTxAttempts is how many times a transaction is tried before a deadlock is
+// returned to the caller
+const maxTxAttempts = 3
+
+// txRetryBackoff is how long to wait before retrying a transaction, multiplied
+// by the number of attempts so far
+const txRetryBackoff = 10 * time.Millisecond
+
+// WithTx runs fn inside a database transaction, committing if fn returns nil
+// and rolling back if it returns an error or panics. If ctx is cancelled the
+// transaction is rolled back. fn is called again if the transaction fails
+// because of a concurrent one, so it must only set its results.
+func (db *DB) WithTx(ctx context.Context, fn func(Tx) error) error {
+	return db.inTx(ctx, func(sqlTx *sql.Tx) error {
+		return fn(&tx{sqlTx, ctx})
+	})
+}
+
+// inTx runs fn in a transaction as described for WithTx, retrying when
+// Postgres aborts the transaction because of a conflict with a concurrent one
+func (db *DB) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return retryTx(ctx, db.log, func() error { return db.tryTx(ctx, fn) })
+}
+
+// retryTx calls try until it succeeds, returns an error which isn't
+// retryable, has been called maxTxAttempts times or ctx is done
+func retryTx(ctx context.Context, logger *logging.Logger, try func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := try()
+		if err == nil || !isRetryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+		logger.Debug("retrying transaction", logging.Fields{"attempt": attempt, "error": err})
+		select {
+		case <-time.After(time.Duration(attempt) * txRetryBackoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (db *DB) tryTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	sqlTx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			db.rollback(sqlTx, p)
+			panic(p)
+		}
+	}()
+	if err = fn(sqlTx); err != nil {
+		db.rollback(sqlTx, err)
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// isRetryable returns true if err means the transaction was aborted because of
+// a concurrent transaction, and would likely succeed if tried again. Only
+// deadlocks are: transactions run at Postgres' default READ COMMITTED
+// isolation, where statements wait for concurrent writers rather than failing
+// with serialization_failure (40001), which only happens at REPEATABLE READ or
+// SERIALIZABLE.
+func isRetryable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40P01" // deadlock_detected
+}
+
+// CreateTeam inserts a record for the given teamName returning the ID and UUID
+// of the new team
+func (t *tx) CreateTeam(teamName string) (int64, *uuid.UUID, error) {
+	uuid := uuid.NewV4()
+	sqlStatement := `INSERT INTO teams (name, uuid) VALUES ($1, $2) RETURNING id`
+	var teamID int64
+	err := t.QueryRowContext(t.ctx, sqlStatement, teamName, uuid).Scan(&teamID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return teamID, &uuid, nil
+}
+
+// CreateTeamUser inserts a record making the given fingerprint an admin of the
+// team, returning the ID.
+func (t *tx) CreateTeamUser(teamID int64, fingerprint Fingerprint) (int64, error) {
+	sqlStatement := `INSERT INTO team_users (team_id, fingerprint, is_admin) VALUES ($1, $2, $3) RETURNING id`
+	var teamUserID int64
+	err := t.QueryRowContext(t.ctx, sqlStatement, teamID, fingerprint, true).Scan(&teamUserID)
+	if err != nil {
+		return 0, err
+	}
+	return teamUserID, nil
+}
+
+// CreatePublicKey takes a fingerprint and publickey and creates a record along
+// with the key's metadata, returning the ID. If the key is stored already,
+// anything new in the posted copy is merged into it (see MergePublicKey) and
+// its metadata updated, unless it has been revoked, when ErrPublicKeyRevoked
+// is returned.
+func (t *tx) CreatePublicKey(fingerprint Fingerprint, publicKey string) (int64, error) {
+	metadata, err := ParseKeyMetadata(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	sqlStatement := `INSERT INTO public_keys (fingerprint, armoredPublicKey)
+		VALUES ($1, $2) ON CONFLICT ON CONSTRAINT public_keys_pkey DO NOTHING RETURNING id`
+	var publicKeyID int64
+	err = t.QueryRowContext(t.ctx, sqlStatement, fingerprint, publicKey).Scan(&publicKeyID)
+	if err == sql.ErrNoRows {
+		return t.mergePublicKey(fingerprint, publicKey)
+	} else if err != nil {
+		return 0, err
+	}
+	err = storeKeyMetadata(t.ctx, t.Tx, fingerprint, metadata)
+	if err != nil {
+		return 0, err
+	}
+	return publicKeyID, nil
+}
+
+// mergePublicKey merges publicKey into the stored key with the same
+// fingerprint, returning the stored key's ID
+func (t *tx) mergePublicKey(fingerprint Fingerprint, publicKey string) (int64, error) {
+	var publicKeyID int64
+	var stored string
+	var isRevoked bool
+	err := t.QueryRowContext(t.ctx, `SELECT id, armoredpublickey, is_revoked FROM public_keys
+		WHERE fingerprint=$1 FOR UPDATE`, fingerprint).Scan(&publicKeyID, &stored, &isRevoked)
+	if err != nil {
+		return 0, err
+	}
+	if isRevoked {
+		return 0, ErrPublicKeyRevoked
+	}
+	merged, changed, err := MergePublicKey(stored, publicKey)
+	if err != nil || !changed {
+		return publicKeyID, err
+	}
+	metadata, err := ParseKeyMetadata(merged)
+	if err != nil {
+		return 0, err
+	}
+	_, err = t.ExecContext(t.ctx, `UPDATE public_keys SET armoredpublickey=$2, updated_at=NOW()
+		WHERE fingerprint=$1`, fingerprint, merged)
+	if err != nil {
+		return 0, err
+	}
+	if err = storeKeyMetadata(t.ctx, t.Tx, fingerprint, metadata); err != nil {
+		return 0, err
+	}
+	return publicKeyID, nil
+}
+
+// CreateTeamJoinRequest creates a team_join_requests record, finding the team
+// id using the passed UUID. If there's already a request from the fingerprint,
+// or no such team, it returns sql.ErrNoRows.
+func (t *tx) CreateTeamJoinRequest(fingerprint Fingerprint, uuid string) (int64, error) {
+	sqlStatement := `INSERT INTO team_join_requests (team_id, fingerprint, created_at)
+		SELECT t.id, $2, NOW() FROM teams t WHERE uuid=$1
+		ON CONFLICT (team_id, fingerprint) DO NOTHING RETURNING id`
+	var teamJoinRequestID int64
+	err := t.QueryRowContext(t.ctx, sqlStatement, uuid, fingerprint).Scan(&teamJoinRequestID)
+	if err != nil {
+		return 0, err
+	}
+	return teamJoinRequestID, nil
+}
+
+// GetTeamJoinRequest returns the request to join the team with the given UUID
+// from the key with the given fingerprint, returning sql.ErrNoRows if there
+// isn't one or the key has been revoked.
+func (t *tx) GetTeamJoinRequest(uuid string, fingerprint Fingerprint) (*JoinRequest, error) {
+	return getTeamJoinRequest(t.ctx, t, uuid, fingerprint)
+}
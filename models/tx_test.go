@@ -0,0 +1,54 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/lib/pq"
+)
+
+func TestRetryTx(t *testing.T) {
+	deadlock := &pq.Error{Code: "40P01"}
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"succeeds first time", []error{nil}, 1, nil},
+		{"deadlock then success", []error{deadlock, nil}, 2, nil},
+		{"deadlocks every time", []error{deadlock, deadlock, deadlock, nil}, maxTxAttempts, deadlock},
+		{"serialization failure isn't retried", []error{&pq.Error{Code: "40001"}, nil}, 1, &pq.Error{Code: "40001"}},
+		{"other error isn't retried", []error{errors.New("connection lost"), nil}, 1, errors.New("connection lost")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := retryTx(context.Background(), logging.Discard(), func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if attempts != test.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", test.wantAttempts, attempts)
+			}
+			if (err == nil) != (test.wantErr == nil) || (err != nil && err.Error() != test.wantErr.Error()) {
+				t.Errorf("expected error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRetryTxStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	err := retryTx(ctx, logging.Discard(), func() error {
+		attempts++
+		return &pq.Error{Code: "40P01"}
+	})
+	if attempts != 1 || err == nil {
+		t.Errorf("expected to give up after 1 attempt with the deadlock, got %d attempts, %v", attempts, err)
+	}
+}
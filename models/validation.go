@@ -0,0 +1,120 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxTeamNameLength is the length of the teams.name column
+const maxTeamNameLength = 255
+
+// MaxArmoredLength is far longer than any armored public key or revocation
+// signature without embedded photos. Longer ones fail validation.
+const MaxArmoredLength = 64 * 1024
+
+// A FieldError explains why the value of one field in a request is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// A ValidationError lists every invalid field in a request
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, fieldError := range e.Errors {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field string, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// err returns e if any fields are invalid, or nil
+func (e *ValidationError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate checks the team name and public key are present and will fit in
+// the database
+func (p TeamsPOST) Validate() error {
+	v := &ValidationError{}
+	validateTeamName(v, "teamName", p.Name)
+	validateArmored(v, "publicKey", p.PublicKey, publicKeyBlock)
+	return v.err()
+}
+
+// Validate checks the public key is present
+func (p RequestPOST) Validate() error {
+	v := &ValidationError{}
+	validateArmored(v, "publicKey", p.PublicKey, publicKeyBlock)
+	return v.err()
+}
+
+// Validate checks the payload is present
+func (p PayloadPOST) Validate() error {
+	v := &ValidationError{}
+	validateArmored(v, "payload", p.Payload, messageBlock)
+	return v.err()
+}
+
+// Validate checks the revocation signature is present. GnuPG exports
+// revocation certificates as a public key block, so either is accepted.
+func (p RevokePOST) Validate() error {
+	v := &ValidationError{}
+	validateArmored(v, "revocationSignature", p.RevocationSignature, signatureBlock, publicKeyBlock)
+	return v.err()
+}
+
+func validateTeamName(v *ValidationError, field string, name string) {
+	switch {
+	case strings.TrimSpace(name) == "":
+		v.add(field, "must not be empty")
+	case !utf8.ValidString(name):
+		v.add(field, "must be valid UTF-8")
+	case utf8.RuneCountInString(name) > maxTeamNameLength:
+		v.add(field, "must be at most %d characters", maxTeamNameLength)
+	case strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) }) != -1:
+		v.add(field, "must not contain control or non-printing characters")
+	}
+}
+
+// Armor header lines for the kinds of OpenPGP data sent to the server. Private
+// keys are deliberately missing.
+const (
+	publicKeyBlock = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	messageBlock   = "-----BEGIN PGP MESSAGE-----"
+	signatureBlock = "-----BEGIN PGP SIGNATURE-----"
+)
+
+// validateArmored checks armored is present and contains one of the given
+// armor header lines
+func validateArmored(v *ValidationError, field string, armored string, headers ...string) {
+	switch {
+	case strings.TrimSpace(armored) == "":
+		v.add(field, "must not be empty")
+	case len(armored) > MaxArmoredLength:
+		v.add(field, "must be at most %d bytes", MaxArmoredLength)
+	case !containsAny(armored, headers):
+		v.add(field, "must be ASCII-armored, starting %s", strings.Join(headers, " or "))
+	}
+}
+
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
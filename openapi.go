@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fluidkeys/teamserver/models"
+)
+
+// A Message is the JSON body written by writeJSONMessage, used for errors
+// and simple acknowledgements. Errors lists invalid fields when a request body
+// fails validation.
+type Message struct {
+	Message string              `json:"message"`
+	Errors  []models.FieldError `json:"errors,omitempty"`
+}
+
+// openAPISpec generates an OpenAPI 3 document describing every route
+// registered with the router. Request and response schemas are generated
+// from the Go types attached to each route so the document can't drift from
+// what the handlers actually read and write.
+func openAPISpec(router *Router) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	for _, route := range router.Routes() {
+		operation := map[string]interface{}{
+			"summary":   route.Description,
+			"responses": openAPIResponses(route, schemas),
+		}
+		if route.deprecated {
+			operation["deprecated"] = true
+		}
+		if parameters := openAPIParameters(route); len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.requestBody != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": requestSchema(route.requestBody, schemas),
+					},
+				},
+			}
+		}
+
+		pathItem, ok := paths[route.Pattern].(map[string]interface{})
+		if !ok {
+			pathItem = map[string]interface{}{}
+			paths[route.Pattern] = pathItem
+		}
+		pathItem[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Fluidkeys Teamserver",
+			"version": "1.1.0",
+			"description": "Routes under /v1 only change by adding optional request fields " +
+				"and response fields, which clients must ignore if they don't know them. " +
+				"Other changes are made in a new version, e.g. under /v2.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+}
+
+func openAPIParameters(route *Route) []interface{} {
+	parameters := []interface{}{}
+	for _, segment := range route.segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		name := segment[1 : len(segment)-1]
+		schema := map[string]interface{}{"type": "string"}
+		if name == "uuid" {
+			schema["format"] = "uuid"
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   schema,
+		})
+	}
+	return parameters
+}
+
+// A mediaType documents a response body which isn't JSON, such as metrics in
+// the Prometheus text format, as text of that media type
+type mediaType string
+
+func openAPIResponses(route *Route, schemas map[string]interface{}) map[string]interface{} {
+	responses := map[string]interface{}{}
+	statuses := []int{}
+	for status := range route.responses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+
+	for _, status := range statuses {
+		response := map[string]interface{}{
+			"description": http.StatusText(status),
+		}
+		if text, ok := route.responses[status].(mediaType); ok {
+			response["content"] = map[string]interface{}{
+				string(text): map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				},
+			}
+		} else if body := route.responses[status]; body != nil {
+			response["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": schemaFor(reflect.TypeOf(body), schemas),
+				},
+			}
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	responses["default"] = map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": schemaFor(reflect.TypeOf(Message{}), schemas),
+			},
+		},
+	}
+	return responses
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	fingerprintType = reflect.TypeOf(models.Fingerprint(""))
+)
+
+// schemaFor returns the JSON schema for values of type t as encoding/json
+// would marshal them. Named struct types are added to schemas and referenced.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case fingerprintType:
+		// see models.Fingerprint.MarshalJSON
+		return map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"display": map[string]interface{}{"type": "string"},
+				"compact": map[string]interface{}{"type": "string"},
+				"keyId":   map[string]interface{}{"type": "string"},
+			},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaFor(t.Elem(), schemas),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaFor(t.Elem(), schemas),
+		}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = map[string]interface{}{} // placeholder for recursive types
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	default:
+		panic(fmt.Sprintf("no JSON schema for %s", t))
+	}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for name, field := range jsonFields(t) {
+		properties[name] = schemaFor(field.Type, schemas)
+		if !field.omitEmpty {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// requestSchema returns the schema for a request body type. Fields its
+// Validate method rejects when they're left out are required, so the schema
+// follows the validation rules rather than repeating them.
+func requestSchema(body interface{}, schemas map[string]interface{}) map[string]interface{} {
+	t := reflect.TypeOf(body)
+	schema := schemaFor(t, schemas)
+	required := requiredFields(t)
+	if len(required) == 0 {
+		return schema
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	named, ok := schemas[t.Name()].(map[string]interface{})
+	if !ok {
+		return schema
+	}
+	if alreadyRequired, ok := named["required"].([]string); ok {
+		required = append(required, alreadyRequired...)
+	}
+	named["required"] = uniqueSorted(required)
+	return schema
+}
+
+// requiredFields validates the zero value of type t, returning the fields
+// reported invalid
+func requiredFields(t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	v, ok := reflect.New(t).Elem().Interface().(validator)
+	if !ok {
+		return nil
+	}
+	validationError, ok := v.Validate().(*models.ValidationError)
+	if !ok {
+		return nil
+	}
+	required := []string{}
+	for _, fieldError := range validationError.Errors {
+		required = append(required, fieldError.Field)
+	}
+	return required
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := []string{}
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+type jsonField struct {
+	reflect.StructField
+	omitEmpty bool
+}
+
+// jsonFields returns the fields encoding/json would write for struct type t,
+// keyed by JSON name. Fields of embedded structs are promoted unless shadowed
+// by a field of the same name in the outer struct, and fields whose type is a
+// pointer to an empty struct (which are always nil, see models.TeamSummary)
+// are left out.
+func jsonFields(t reflect.Type) map[string]jsonField {
+	fields := map[string]jsonField{}
+	shadowed := map[string]bool{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			continue
+		}
+		name, omitEmpty, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		shadowed[name] = true
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct &&
+			field.Type.Elem().NumField() == 0 {
+			continue
+		}
+		fields[name] = jsonField{field, omitEmpty}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		embedded := field.Type
+		if embedded.Kind() == reflect.Ptr {
+			embedded = embedded.Elem()
+		}
+		for name, embeddedField := range jsonFields(embedded) {
+			if !shadowed[name] {
+				fields[name] = embeddedField
+			}
+		}
+	}
+	return fields
+}
+
+func jsonName(field reflect.StructField) (name string, omitEmpty bool, ok bool) {
+	if field.PkgPath != "" {
+		return "", false, false // unexported
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = field.Name
+	}
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty, true
+}
+
+func handleOpenAPI(router *Router) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		out, err := json.Marshal(openAPISpec(router))
+		if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, out)
+	})
+}
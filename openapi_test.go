@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/dbtest"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestRequestSchemasRequireValidatedFields(t *testing.T) {
+	spec := openAPISpec(newTestEnv(fakedb.New()).router)
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	for name, want := range map[string][]string{
+		"TeamsPOST":   {"publicKey", "teamName"},
+		"RequestPOST": {"publicKey"},
+		"PayloadPOST": {"payload"},
+		"RevokePOST":  {"revocationSignature"},
+	} {
+		schema := schemas[name].(map[string]interface{})
+		got, _ := schema["required"].([]string)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("expected %s to require %v, got %v", name, want, got)
+		}
+	}
+}
+
+// TestHandlersMatchOpenAPISpec runs every route's handler, checking the
+// status is documented and the response body matches its schema
+func TestHandlersMatchOpenAPISpec(t *testing.T) {
+	tests := routeTests(t)
+
+	spec := openAPISpec(newRouteTestEnv(fakedb.New()).router)
+	paths := spec["paths"].(map[string]interface{})
+
+	covered := map[string]bool{}
+	for _, test := range tests {
+		covered[test.route] = true
+		t.Run(test.route+" "+test.name, func(t *testing.T) {
+			fields := strings.SplitN(test.route, " ", 2)
+			operation := paths[fields[1]].(map[string]interface{})[strings.ToLower(fields[0])].(map[string]interface{})
+
+			db := fakedb.New()
+			teamUUID := createTestTeam(t, db, "Existing", fixtures.Valid).String()
+			if test.setup != nil {
+				test.setup(t, db, teamUUID)
+			}
+			if test.body != "" && test.wantStatus < 300 {
+				schema := operation["requestBody"].(map[string]interface{})["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"]
+				checkMatchesSchema(t, spec, "request body", schema, test.body)
+			}
+
+			res := doRequest(newRouteTestEnv(db), fields[0], strings.Replace(test.path, "{uuid}", teamUUID, 1), test.body)
+
+			if res.Code != test.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+			responses := operation["responses"].(map[string]interface{})
+			response, ok := responses[strconv.Itoa(res.Code)].(map[string]interface{})
+			if !ok {
+				if res.Code < 400 {
+					t.Fatalf("status %d isn't documented", res.Code)
+				}
+				response = responses["default"].(map[string]interface{})
+			}
+			content, ok := response["content"].(map[string]interface{})
+			if !ok {
+				if res.Body.Len() != 0 {
+					t.Errorf("expected no body, got %s", res.Body)
+				}
+				return
+			}
+			mediaType, _, err := mime.ParseMediaType(res.Header().Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("error reading Content-Type %q: %v", res.Header().Get("Content-Type"), err)
+			}
+			var media map[string]interface{}
+			for documented, documentedMedia := range content {
+				if documentedType, _, _ := mime.ParseMediaType(documented); documentedType == mediaType {
+					media = documentedMedia.(map[string]interface{})
+				}
+			}
+			if media == nil {
+				t.Fatalf("response Content-Type %s isn't documented", mediaType)
+			}
+			if mediaType == "application/json" {
+				checkMatchesSchema(t, spec, "response body", media["schema"], res.Body.String())
+			}
+		})
+	}
+
+	checkRoutesCovered(t, newRouteTestEnv(fakedb.New()).router, covered)
+}
+
+// TestHandlersWithPostgres runs every route's handler against Postgres,
+// truncating the database between requests
+func TestHandlersWithPostgres(t *testing.T) {
+	database := openTestDatabase(t)
+	open := dbtest.OpenForTest(database)
+
+	covered := map[string]bool{}
+	for _, test := range routeTests(t) {
+		covered[test.route] = true
+		t.Run(test.route+" "+test.name, func(t *testing.T) {
+			db := open(t)
+			teamUUID := createTestTeam(t, db, "Existing", fixtures.Valid).String()
+			if test.setup != nil {
+				test.setup(t, db, teamUUID)
+			}
+
+			method := strings.SplitN(test.route, " ", 2)[0]
+			res := doRequest(newRouteTestEnv(db), method, strings.Replace(test.path, "{uuid}", teamUUID, 1), test.body)
+
+			if res.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+		})
+	}
+	checkRoutesCovered(t, newRouteTestEnv(database).router, covered)
+}
+
+// newRouteTestEnv returns an Env over db like newTestEnv, without rate limits
+// so every request in a test reaches its handler
+func newRouteTestEnv(db models.Datastore) *Env {
+	cfg := config.Default()
+	cfg.RateLimits.Enabled = false
+	return newEnv(db, cfg, newServerMetrics(nil, logging.Discard()), logging.Discard())
+}
+
+// A routeTest is a request to one route and the status it should get, made
+// against a team with the Valid key as its member
+type routeTest struct {
+	route      string
+	name       string
+	path       string
+	setup      func(t *testing.T, db models.Datastore, teamUUID string)
+	body       string
+	wantStatus int
+}
+
+// routeTests returns a request to every route, for checking handlers against
+// the spec and each datastore
+func routeTests(t *testing.T) []routeTest {
+	valid := readEntity(t, fixtures.Valid)
+	payload := payloadJSON(armorMessage(t, encryptTo(t, valid.Subkeys[0].PublicKey)))
+	revocation := jsonBody(models.RevokePOST{RevocationSignature: armoredRevocation(t, fixtures.Revoked)})
+
+	return []routeTest{
+		{"GET /v1/teams", "list teams", "/v1/teams", nil, "", http.StatusOK},
+		{"POST /v1/teams", "create team", "/v1/teams", nil,
+			jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: fixtures.Valid.Armored}), http.StatusOK},
+		{"POST /v1/teams", "missing fields", "/v1/teams", nil, `{}`, http.StatusBadRequest},
+		{"GET /v1/teams/{uuid}", "get team", "/v1/teams/{uuid}", nil, "", http.StatusOK},
+		{"GET /v1/teams/{uuid}", "unknown team", "/v1/teams/" + uuid.NewV4().String(), nil, "", http.StatusNotFound},
+		{"GET /v1/teams/{uuid}/summary", "get summary", "/v1/teams/{uuid}/summary", nil, "", http.StatusOK},
+		{"GET /v1/teams/{uuid}/summary", "invalid UUID", "/v1/teams/not-a-uuid/summary", nil, "", http.StatusBadRequest},
+		{"POST /v1/teams/{uuid}/request", "request to join", "/v1/teams/{uuid}/request", nil,
+			jsonBody(models.RequestPOST{PublicKey: fixtures.Valid.Armored}), http.StatusCreated},
+		{"POST /v1/teams/{uuid}/request", "request to join again", "/v1/teams/{uuid}/request",
+			func(t *testing.T, db models.Datastore, teamUUID string) {
+				ctx := context.Background()
+				if _, err := db.CreatePublicKey(ctx, fixtures.Valid.Fingerprint, fixtures.Valid.Armored); err != nil {
+					t.Fatalf("error creating key: %v", err)
+				}
+				if _, err := db.CreateTeamJoinRequest(ctx, fixtures.Valid.Fingerprint, teamUUID); err != nil {
+					t.Fatalf("error creating join request: %v", err)
+				}
+			},
+			jsonBody(models.RequestPOST{PublicKey: fixtures.Valid.Armored}), http.StatusOK},
+		{"GET /v1/teams/{uuid}/health", "get health", "/v1/teams/{uuid}/health", nil, "", http.StatusOK},
+		{"POST /v1/teams/{uuid}/payload", "check payload", "/v1/teams/{uuid}/payload", nil, payload, http.StatusOK},
+		{"POST /v1/teams/{uuid}/payload", "payload to unknown team",
+			"/v1/teams/" + uuid.NewV4().String() + "/payload", nil, payload, http.StatusNotFound},
+		{"POST /v1/keys/{fingerprint}/revoke", "revoke key",
+			"/v1/keys/" + fixtures.Revoked.Fingerprint.String() + "/revoke",
+			func(t *testing.T, db models.Datastore, teamUUID string) {
+				if _, err := db.CreatePublicKey(context.Background(), fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored); err != nil {
+					t.Fatalf("error creating key: %v", err)
+				}
+			},
+			revocation, http.StatusOK},
+		{"POST /v1/keys/{fingerprint}/revoke", "unknown key",
+			"/v1/keys/" + fixtures.Revoked.Fingerprint.String() + "/revoke", nil,
+			revocation, http.StatusNotFound},
+		{"GET /docs", "list routes", "/docs", nil, "", http.StatusOK},
+		{"GET /openapi.json", "get spec", "/openapi.json", nil, "", http.StatusOK},
+		{"GET /healthz", "check up", "/healthz", nil, "", http.StatusOK},
+		{"GET /readyz", "check ready", "/readyz", nil, "", http.StatusOK},
+		{"GET /metrics", "get metrics", "/metrics", nil, "", http.StatusOK},
+	}
+}
+
+// checkRoutesCovered fails the test if a route which isn't deprecated has no
+// test in covered
+func checkRoutesCovered(t *testing.T, router *Router, covered map[string]bool) {
+	t.Helper()
+	for _, route := range router.Routes() {
+		if !route.deprecated && !covered[route.Method+" "+route.Pattern] {
+			t.Errorf("no test for %s %s", route.Method, route.Pattern)
+		}
+	}
+}
+
+// armoredRevocation returns key's revocation signature on its own, as GnuPG
+// exports it
+func armoredRevocation(t *testing.T, key fixtures.Key) string {
+	entity := readEntity(t, key)
+	if len(entity.Revocations) == 0 {
+		t.Fatalf("%s has no revocation signature", key.Fingerprint)
+	}
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.SignatureType, nil)
+	if err != nil {
+		t.Fatalf("error armoring revocation: %v", err)
+	}
+	if err := entity.Revocations[0].Serialize(w); err != nil {
+		t.Fatalf("error writing revocation: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error armoring revocation: %v", err)
+	}
+	return buf.String()
+}
+
+// checkMatchesSchema fails the test if the JSON document doesn't match schema
+func checkMatchesSchema(t *testing.T, spec map[string]interface{}, what string, schema interface{}, document string) {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		t.Fatalf("%s isn't JSON: %v: %s", what, err, document)
+	}
+	for _, problem := range schemaProblems(spec, schema.(map[string]interface{}), value, "$") {
+		t.Errorf("%s doesn't match the spec: %s", what, problem)
+	}
+}
+
+// schemaProblems validates value against the subset of JSON schema that
+// openAPISpec generates
+func schemaProblems(spec map[string]interface{}, schema map[string]interface{}, value interface{}, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		return schemaProblems(spec, schemas[name].(map[string]interface{}), value, at)
+	}
+
+	switch schema["type"] {
+	case nil:
+		return nil
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected object, got %T", at, value)}
+		}
+		return objectProblems(spec, schema, object, at)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected array, got %T", at, value)}
+		}
+		problems := []string{}
+		for i, item := range array {
+			itemAt := fmt.Sprintf("%s[%d]", at, i)
+			problems = append(problems, schemaProblems(spec, schema["items"].(map[string]interface{}), item, itemAt)...)
+		}
+		return problems
+	case "string":
+		if _, ok := value.(string); !ok {
+			return []string{fmt.Sprintf("%s: expected string, got %T", at, value)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: expected boolean, got %T", at, value)}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{fmt.Sprintf("%s: expected number, got %T", at, value)}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			return []string{fmt.Sprintf("%s: expected integer, got %v", at, value)}
+		}
+	}
+	return nil
+}
+
+func objectProblems(spec map[string]interface{}, schema map[string]interface{}, object map[string]interface{}, at string) []string {
+	problems := []string{}
+	required, _ := schema["required"].([]string)
+	for _, name := range required {
+		if _, ok := object[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing required property %q", at, name))
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	additional, _ := schema["additionalProperties"].(map[string]interface{})
+	names := []string{}
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertySchema, ok := properties[name].(map[string]interface{})
+		if !ok {
+			propertySchema = additional
+		}
+		if propertySchema == nil {
+			problems = append(problems, fmt.Sprintf("%s: undocumented property %q", at, name))
+			continue
+		}
+		problems = append(problems, schemaProblems(spec, propertySchema, object[name], at+"."+name)...)
+	}
+	return problems
+}
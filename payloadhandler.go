@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+// PayloadHandler is used to server up HTTP requests to
+// `/teams/{uuid}/payload`
+type PayloadHandler struct{}
+
+// Handler takes a team UUID and database and checks the posted payload is
+// encrypted only to members of the team, so clients can refuse to relay one
+// which isn't.
+func (h *PayloadHandler) Handler(uuidString string, db models.Datastore) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		uuid, err := uuid.FromString(uuidString)
+		if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var payloadPost models.PayloadPOST
+		err = decodeJSON(res, req, &payloadPost)
+		if err != nil {
+			writeRequestError(res, req, err)
+			return
+		}
+
+		err = validateTeamPayload(req.Context(), uuid, []byte(payloadPost.Payload), db)
+		if err == sql.ErrNoRows {
+			writeJSONMessage(res, http.StatusNotFound, "team not found")
+			return
+		} else if err != nil {
+			writeRequestError(res, req, err)
+			return
+		}
+		writeJSONMessage(res, http.StatusOK, "payload is encrypted only to team members")
+	})
+}
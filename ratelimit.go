@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+)
+
+// A rateLimitStore holds token buckets, each refilling at ratePerSecond up to
+// burst tokens
+type rateLimitStore interface {
+	// TakeRateLimitToken takes a token from the bucket identified by key,
+	// returning whether one was available and, if not, how long until one
+	// will be
+	TakeRateLimitToken(ctx context.Context, key string, ratePerSecond float64, burst int) (bool, time.Duration, error)
+
+	// ReturnRateLimitToken puts back a token taken from the bucket
+	// identified by key, up to burst tokens
+	ReturnRateLimitToken(ctx context.Context, key string, burst int) error
+}
+
+// A rateLimitKeyFunc identifies who a request is from, such as by IP address or
+// public key. It returns "" if the request can't be identified that way, along
+// with the request to pass on, which may carry what was learned about it.
+type rateLimitKeyFunc func(req *http.Request) (string, *http.Request)
+
+// rateLimiter limits how often the same client can make requests to a route
+type rateLimiter struct {
+	config config.RateLimits
+	store  rateLimitStore
+}
+
+// newRateLimiter returns a rate limiter storing buckets in memory or, so limits
+// are shared by every server process, in db
+func newRateLimiter(rateLimits config.RateLimits, db models.Datastore) *rateLimiter {
+	var store rateLimitStore = newMemoryRateLimitStore()
+	if rateLimits.Store == "postgres" {
+		store = db
+	}
+	return &rateLimiter{config: rateLimits, store: store}
+}
+
+// limit wraps handler so each client identified by one of keyFuncs can only
+// make requests to route at the configured rate. Requests over the limit get a
+// 429 Too Many Requests response with a Retry-After header, and don't use up
+// any of the other clients' allowances.
+func (l *rateLimiter) limit(route string, handler http.Handler, keyFuncs ...rateLimitKeyFunc) http.Handler {
+	if !l.config.Enabled {
+		return handler
+	}
+	limit, ok := l.config.Routes[route]
+	if !ok {
+		limit = config.RateLimit{
+			RequestsPerMinute: l.config.RequestsPerMinute,
+			Burst:             l.config.Burst,
+		}
+	}
+	ratePerSecond := float64(limit.RequestsPerMinute) / 60
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		taken := []string{}
+		for _, keyFunc := range keyFuncs {
+			var key string
+			key, req = keyFunc(req)
+			if key == "" {
+				continue
+			}
+			bucket := route + " " + key
+			allowed, retryAfter, err := l.store.TakeRateLimitToken(req.Context(), bucket, ratePerSecond, limit.Burst)
+			if err != nil {
+				// Fail open: a broken rate limit store shouldn't take the
+				// whole API down with it
+				logging.FromContext(req.Context()).Error("error checking rate limit",
+					logging.Fields{"route": route, "error": err})
+				continue
+			}
+			if !allowed {
+				l.returnTokens(req, taken, limit.Burst)
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				res.Header().Set("Retry-After", strconv.Itoa(seconds))
+				writeJSONMessage(res, http.StatusTooManyRequests,
+					fmt.Sprintf("too many requests, retry after %d seconds", seconds))
+				return
+			}
+			taken = append(taken, bucket)
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// returnTokens puts back the tokens taken from buckets for a request which was
+// refused
+func (l *rateLimiter) returnTokens(req *http.Request, buckets []string, burst int) {
+	for _, bucket := range buckets {
+		if err := l.store.ReturnRateLimitToken(req.Context(), bucket, burst); err != nil {
+			logging.FromContext(req.Context()).Error("error returning rate limit token",
+				logging.Fields{"bucket": bucket, "error": err})
+		}
+	}
+}
+
+// postgresRateLimitSweepInterval is how often full buckets are deleted from the
+// database when limits are stored there
+const postgresRateLimitSweepInterval = 10 * time.Minute
+
+// sweepRateLimitBuckets deletes refilled rate limit buckets from db every
+// interval until ctx is cancelled
+func sweepRateLimitBuckets(ctx context.Context, db models.Datastore, interval time.Duration, logger *logging.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if _, err := db.DeleteFullRateLimitBuckets(ctx); err != nil && ctx.Err() == nil {
+			logger.Error("error deleting full rate limit buckets", logging.Fields{"error": err})
+		}
+	}
+}
+
+// byIP identifies requests by the client's IP address. If trustForwardedFor is
+// set, the address a proxy such as Heroku's router puts in X-Forwarded-For is
+// used instead of the address of the connection.
+func byIP(trustForwardedFor bool) rateLimitKeyFunc {
+	return func(req *http.Request) (string, *http.Request) {
+		if trustForwardedFor {
+			if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+				// The proxy appends the address it received the request from
+				addresses := strings.Split(forwardedFor, ",")
+				return "ip:" + strings.TrimSpace(addresses[len(addresses)-1]), req
+			}
+		}
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return "ip:" + req.RemoteAddr, req
+		}
+		return "ip:" + host, req
+	}
+}
+
+// byPostedKey identifies requests by the fingerprint of the armored public key
+// in the publicKey field of the JSON request body. The body is left unread for
+// the handler, and the parsed key is passed on so the handler doesn't parse it
+// again. Bodies too large for decodeJSON and keys too long to pass validation
+// aren't parsed, leaving the handler to refuse them.
+func byPostedKey(req *http.Request) (string, *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxJSONBodyBytes+1))
+	req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+	if err != nil || len(body) > maxJSONBodyBytes {
+		return "", req
+	}
+	var posted struct {
+		PublicKey string `json:"publicKey"`
+	}
+	if json.Unmarshal(body, &posted) != nil || posted.PublicKey == "" ||
+		len(posted.PublicKey) > models.MaxArmoredLength {
+		return "", req
+	}
+	fingerprint, err := getFingerprintFromPublicKey(req.Context(), posted.PublicKey)
+	req = req.WithContext(context.WithValue(req.Context(), parsedPublicKeyKey{},
+		&parsedPublicKey{armored: posted.PublicKey, fingerprint: fingerprint, err: err}))
+	if err != nil {
+		return "", req
+	}
+	return "key:" + fingerprint.String(), req
+}
+
+// byPathFingerprint identifies requests by the fingerprint in the request path
+func byPathFingerprint(req *http.Request) (string, *http.Request) {
+	fingerprint, err := models.ParseFingerprint(pathParam(req, "fingerprint"))
+	if err != nil {
+		return "", req
+	}
+	return "key:" + fingerprint.String(), req
+}
+
+// memoryRateLimitStore holds token buckets in memory, so limits only apply
+// within a single server process
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	sweepAt time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket will be full again
+}
+
+// memoryRateLimitSweepInterval is how often full buckets, which are the same
+// as no bucket at all, are removed from memory
+const memoryRateLimitSweepInterval = time.Minute
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (s *memoryRateLimitStore) TakeRateLimitToken(ctx context.Context, key string, ratePerSecond float64, burst int) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = bucket
+	}
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+elapsed*ratePerSecond)
+	bucket.updated = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	bucket.full = now.Add(secondsDuration((float64(burst) - bucket.tokens) / ratePerSecond))
+	if allowed {
+		return true, 0, nil
+	}
+	return false, secondsDuration((1 - bucket.tokens) / ratePerSecond), nil
+}
+
+func (s *memoryRateLimitStore) ReturnRateLimitToken(ctx context.Context, key string, burst int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bucket, ok := s.buckets[key]; ok {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+1)
+	}
+	return nil
+}
+
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Before(s.sweepAt) {
+		return
+	}
+	for key, bucket := range s.buckets {
+		if !now.Before(bucket.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.sweepAt = now.Add(memoryRateLimitSweepInterval)
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
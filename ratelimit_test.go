@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+func TestRateLimitReturnsTokensWhenRefused(t *testing.T) {
+	for _, store := range []string{"memory", "postgres"} {
+		t.Run(store, func(t *testing.T) {
+			limiter := newRateLimiter(config.RateLimits{
+				Enabled:           true,
+				RequestsPerMinute: 1,
+				Burst:             1,
+				Store:             store,
+			}, fakedb.New())
+			handler := limiter.limit("POST /teams", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusOK)
+			}), byIP(false), byPostedKey)
+			post := func(remoteAddr string, key fixtures.Key) int {
+				req := httptest.NewRequest("POST", "/v1/teams",
+					strings.NewReader(jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: key.Armored})))
+				req.RemoteAddr = remoteAddr
+				res := httptest.NewRecorder()
+				handler.ServeHTTP(res, req)
+				return res.Code
+			}
+
+			if status := post("192.0.2.1:1234", fixtures.Valid); status != http.StatusOK {
+				t.Fatalf("expected first request to be allowed, got %d", status)
+			}
+			// refused by the key's limit, so the IP address's token is put back
+			if status := post("192.0.2.2:1234", fixtures.Valid); status != http.StatusTooManyRequests {
+				t.Fatalf("expected second request with the same key to be refused, got %d", status)
+			}
+			if status := post("192.0.2.2:1234", fixtures.Expired); status != http.StatusOK {
+				t.Errorf("expected request from the second address with another key to be allowed, got %d", status)
+			}
+		})
+	}
+}
+
+func TestRateLimitPassesParsedKeyToHandler(t *testing.T) {
+	limiter := newRateLimiter(config.Default().RateLimits, fakedb.New())
+	var fingerprint models.Fingerprint
+	var parsed bool
+	handler := limiter.limit("POST /teams", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, parsed = req.Context().Value(parsedPublicKeyKey{}).(*parsedPublicKey)
+		fingerprint, _ = postedKeyFingerprint(req, fixtures.Valid.Armored)
+	}), byPostedKey)
+
+	req := httptest.NewRequest("POST", "/v1/teams",
+		strings.NewReader(jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: fixtures.Valid.Armored})))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !parsed {
+		t.Error("expected the parsed key in the request context")
+	}
+	if fingerprint != fixtures.Valid.Fingerprint {
+		t.Errorf("expected fingerprint %s, got %s", fixtures.Valid.Fingerprint, fingerprint)
+	}
+}
+
+func TestByPostedKeySkipsOversizedInput(t *testing.T) {
+	tooLongKey := fixtures.Valid.Armored + strings.Repeat(" ", models.MaxArmoredLength)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"body too large", jsonBody(models.TeamsPOST{Name: strings.Repeat("a", maxJSONBodyBytes), PublicKey: fixtures.Valid.Armored})},
+		{"key too long", jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: tooLongKey})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/teams", strings.NewReader(test.body))
+
+			key, req := byPostedKey(req)
+
+			if key != "" {
+				t.Errorf("expected request not to be identified, got %q", key)
+			}
+			if _, parsed := req.Context().Value(parsedPublicKeyKey{}).(*parsedPublicKey); parsed {
+				t.Error("expected the key not to be parsed")
+			}
+			if body, _ := ioutil.ReadAll(req.Body); string(body) != test.body {
+				t.Error("expected the whole body to be left for the handler")
+			}
+		})
+	}
+}
+
+func TestSweepRateLimitBuckets(t *testing.T) {
+	db := fakedb.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, _, err := db.TakeRateLimitToken(ctx, "POST /teams ip:192.0.2.1", 1000, 1); err != nil {
+		t.Fatalf("error taking token: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		sweepRateLimitBuckets(ctx, db, time.Millisecond, logging.Discard())
+		close(stopped)
+	}()
+	for i := 0; db.Called("DeleteFullRateLimitBuckets") == 0; i++ {
+		if i == 500 {
+			t.Fatal("buckets were never swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("sweep didn't stop when its context was cancelled")
+	}
+	if deleted, err := db.DeleteFullRateLimitBuckets(context.Background()); err != nil || deleted != 0 {
+		t.Errorf("expected the full bucket to have been swept already, deleted %d, %v", deleted, err)
+	}
+}
@@ -1,42 +1,90 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 
+	"github.com/fluidkeys/teamserver/config"
 	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
 )
 
 // RequestHandler is used to receive requests to join teams
-type RequestHandler struct{}
+type RequestHandler struct {
+	KeyPolicy config.KeyPolicy
+}
 
 // Handler takes a team UUID and database and then creates the appropriate
 // record in the database.
 func (h *RequestHandler) Handler(uuidString string, db models.Datastore) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		decoder := json.NewDecoder(req.Body)
+		teamUUID, err := uuid.FromString(uuidString)
+		if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
 		var teamPost models.RequestPOST
-		err := decoder.Decode(&teamPost)
+		err = decodeJSON(res, req, &teamPost)
 		if err != nil {
-			panic(err)
+			writeRequestError(res, req, err)
+			return
 		}
 
-		fingerprint, err := getFingerprintFromPublicKey(teamPost.PublicKey)
+		fingerprint, err := postedKeyFingerprint(req, teamPost.PublicKey)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		setRequestFingerprint(req, fingerprint)
+		if err = checkKeyPolicy(teamPost.PublicKey, h.KeyPolicy); err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		_, err = db.CreatePublicKey(fingerprint, teamPost.PublicKey)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+		var status int
+		var joinRequest *models.JoinRequest
+		err = db.WithTx(req.Context(), func(tx models.Tx) error {
+			status = http.StatusCreated
+			_, err := tx.CreatePublicKey(fingerprint, teamPost.PublicKey)
+			if err != nil {
+				return err
+			}
+			joinRequest, err = tx.GetTeamJoinRequest(teamUUID.String(), fingerprint)
+			if err == nil {
+				// A retried request returns the existing pending request
+				status = http.StatusOK
+				return nil
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+			_, err = tx.CreateTeamJoinRequest(fingerprint, teamUUID.String())
+			if err == sql.ErrNoRows {
+				// Lost a race with a concurrent request from the same key, or
+				// there's no such team: find out which.
+				status = http.StatusOK
+			} else if err != nil {
+				return err
+			}
+			joinRequest, err = tx.GetTeamJoinRequest(teamUUID.String(), fingerprint)
+			return err
+		})
+		if err == sql.ErrNoRows {
+			writeJSONMessage(res, http.StatusNotFound, "team not found")
+			return
+		} else if err == models.ErrPublicKeyRevoked {
+			writeJSONMessage(res, http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
+			internalServerError(res, req, err)
 			return
 		}
-		_, err = db.CreateTeamJoinRequest(fingerprint, uuidString)
+
+		out, err := json.Marshal(joinRequest)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			internalServerError(res, req, err)
 			return
 		}
-		res.WriteHeader(http.StatusCreated)
+		writeJSON(res, status, out)
 	})
 }
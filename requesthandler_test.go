@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestJoinRequestWithRevokedKey(t *testing.T) {
+	db := fakedb.New()
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Valid)
+	ctx := context.Background()
+	if _, err := db.CreatePublicKey(ctx, fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored); err != nil {
+		t.Fatalf("error creating key: %v", err)
+	}
+	if _, err := db.CreateTeamJoinRequest(ctx, fixtures.Revoked.Fingerprint, teamUUID.String()); err != nil {
+		t.Fatalf("error creating join request: %v", err)
+	}
+	if err := db.RevokePublicKey(ctx, fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored); err != nil {
+		t.Fatalf("error revoking key: %v", err)
+	}
+
+	if _, err := db.GetTeamJoinRequest(ctx, teamUUID.String(), fixtures.Revoked.Fingerprint); err == nil {
+		t.Errorf("expected revoked key's join request to be left out")
+	}
+	res := doRequest(newTestEnv(db), "POST", "/v1/teams/"+teamUUID.String()+"/request",
+		jsonBody(models.RequestPOST{PublicKey: fixtures.Revoked.Armored}))
+	if res.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestJoinRequestRollsBackOnFailure(t *testing.T) {
+	db := fakedb.New()
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Valid)
+	db.Fail("Tx.CreateTeamJoinRequest", errors.New("connection lost"))
+
+	res := doRequest(newTestEnv(db), "POST", "/v1/teams/"+teamUUID.String()+"/request",
+		jsonBody(models.RequestPOST{PublicKey: fixtures.Expired.Armored}))
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d: %s", res.Code, res.Body)
+	}
+	if _, err := db.GetPublicKey(context.Background(), fixtures.Expired.Fingerprint); err != sql.ErrNoRows {
+		t.Errorf("expected public key to be rolled back, got %v", err)
+	}
+}
+
+func TestJoinRequestsWithPostgres(t *testing.T) {
+	db := openTestDatabase(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		uuid       func(teamUUID string) string
+		key        fixtures.Key
+		wantStatus int
+	}{
+		{"invalid UUID", func(string) string { return "not-a-uuid" }, fixtures.Valid, http.StatusBadRequest},
+		{"unknown team", func(string) string { return uuid.NewV4().String() }, fixtures.Valid, http.StatusNotFound},
+		{"new request", func(teamUUID string) string { return teamUUID }, fixtures.Valid, http.StatusCreated},
+		{"retried request", func(teamUUID string) string { return teamUUID }, fixtures.Valid, http.StatusOK},
+		{"upper case UUID", func(teamUUID string) string { return strings.ToUpper(teamUUID) }, fixtures.Valid, http.StatusOK},
+		{"revoked key", func(teamUUID string) string { return teamUUID }, fixtures.Revoked, http.StatusForbidden},
+	}
+
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Expired)
+	if _, err := db.CreatePublicKey(ctx, fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored); err != nil {
+		t.Fatalf("error creating key: %v", err)
+	}
+	if err := db.RevokePublicKey(ctx, fixtures.Revoked.Fingerprint, fixtures.Revoked.Armored); err != nil {
+		t.Fatalf("error revoking key: %v", err)
+	}
+
+	env := newTestEnv(db)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := doRequest(env, "POST", "/v1/teams/"+test.uuid(teamUUID.String())+"/request",
+				jsonBody(models.RequestPOST{PublicKey: test.key.Armored}))
+			if res.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+		})
+	}
+
+	team, err := db.GetTeam(ctx, teamUUID)
+	if err != nil {
+		t.Fatalf("error getting team: %v", err)
+	}
+	teamID, err := strconv.Atoi(team.ID)
+	if err != nil {
+		t.Fatalf("error reading team ID: %v", err)
+	}
+	requests, err := db.GetTeamJoinRequests(ctx, teamID)
+	if err != nil || len(requests) != 1 || requests[0].Fingerprint != fixtures.Valid.Fingerprint {
+		t.Errorf("expected a single join request from %s, got %v, %v", fixtures.Valid.Fingerprint, requests, err)
+	}
+}
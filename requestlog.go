@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/tracing"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength stops clients filling the logs with huge request IDs
+const maxRequestIDLength = 128
+
+// requestInfo collects what handlers learn about a request so it can be
+// included in the request's log line
+type requestInfo struct {
+	id          string
+	route       string
+	fingerprint models.Fingerprint
+	err         error
+	unlogged    bool
+}
+
+type requestInfoKey struct{}
+
+// logRequests gives every request an ID, taken from the X-Request-ID header
+// if the client (or a proxy) sent one, and writes a log line for every
+// response. The request's context carries a logger which includes the request
+// ID in every line written.
+func logRequests(logger *logging.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(req)}
+		res.Header().Set(requestIDHeader, info.id)
+
+		requestLogger := logger.With(logging.Fields{"requestId": info.id})
+		ctx := context.WithValue(req.Context(), requestInfoKey{}, info)
+		ctx = logging.NewContext(ctx, requestLogger)
+
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req.WithContext(ctx))
+		if info.unlogged {
+			return
+		}
+
+		fields := logging.Fields{
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"route":      info.route,
+			"status":     recorder.status,
+			"bytes":      recorder.bytes,
+			"durationMs": float64(time.Since(start).Nanoseconds()) / 1e6,
+			"remoteAddr": req.RemoteAddr,
+		}
+		if span := tracing.SpanFromContext(req.Context()); span != nil {
+			fields["traceId"] = span.Context().TraceID.String()
+		}
+		if info.fingerprint != "" {
+			fields["fingerprint"] = info.fingerprint.String()
+		}
+		if info.err != nil {
+			fields["error"] = info.err
+		}
+		if recorder.status >= 500 {
+			requestLogger.Error("request failed", fields)
+		} else {
+			requestLogger.Info("request", fields)
+		}
+	})
+}
+
+// requestID returns the request ID sent by the client if it's reasonable, or a
+// new random one
+func requestID(req *http.Request) string {
+	id := req.Header.Get(requestIDHeader)
+	if id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func getRequestInfo(req *http.Request) *requestInfo {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{} // not logged, so anything set is thrown away
+}
+
+// setRequestRoute records the pattern of the route handling req, and names the
+// request's span after it
+func setRequestRoute(req *http.Request, pattern string) {
+	getRequestInfo(req).route = pattern
+	span := tracing.SpanFromContext(req.Context())
+	span.SetName(req.Method + " " + pattern)
+	span.SetAttribute("http.route", pattern)
+}
+
+// skipRequestLog leaves req out of the request log
+func skipRequestLog(req *http.Request) {
+	getRequestInfo(req).unlogged = true
+}
+
+// setRequestFingerprint records the fingerprint of the key req was made with
+func setRequestFingerprint(req *http.Request, fingerprint models.Fingerprint) {
+	getRequestInfo(req).fingerprint = fingerprint
+}
+
+// internalServerError logs err with the request and tells the client something
+// went wrong, without leaking details such as database errors. If the request
+// ran out of time, the client is told to try again later.
+func internalServerError(res http.ResponseWriter, req *http.Request, err error) {
+	info := getRequestInfo(req)
+	info.err = err
+	message, status := "internal server error", http.StatusInternalServerError
+	if req.Context().Err() == context.DeadlineExceeded {
+		message, status = "request timed out", http.StatusServiceUnavailable
+	}
+	if info.id != "" {
+		message += ", request ID " + info.id
+	}
+	writeJSONMessage(res, status, message)
+}
+
+// statusRecorder remembers the status code and size of the response written
+// through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.status = statusCode
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
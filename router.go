@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Router dispatches requests to handlers registered against a method and a
+// path pattern. Patterns are made of literal segments and `{name}` parameters
+// which match a single path segment, e.g. `/teams/{uuid}/summary`.
+type Router struct {
+	routes []*Route
+}
+
+// A Route is a method and path pattern handled by the Router, along with a
+// description used to generate API documentation
+type Route struct {
+	Method      string
+	Pattern     string
+	Description string
+	handler     http.Handler
+	segments    []string
+	requestBody interface{}
+	responses   map[int]interface{}
+	deprecated  bool
+	unlogged    bool
+}
+
+type routeMatch struct {
+	route  *Route
+	params map[string]string
+}
+
+type pathParamsKey struct{}
+
+// Handle registers handler for requests with the given method whose path
+// matches pattern, returning the Route so its request and responses can be
+// documented.
+func (r *Router) Handle(method string, pattern string, description string, handler http.HandlerFunc) *Route {
+	route := &Route{
+		Method:      method,
+		Pattern:     pattern,
+		Description: description,
+		handler:     handler,
+		segments:    splitPath(pattern),
+		responses:   map[int]interface{}{},
+	}
+	r.routes = append(r.routes, route)
+	return route
+}
+
+// A RouteGroup registers routes on a Router under a common path prefix, such
+// as an API version
+type RouteGroup struct {
+	router     *Router
+	prefix     string
+	deprecated *deprecation
+}
+
+// deprecation describes when a group of routes is going away and what
+// replaces it
+type deprecation struct {
+	sunset          time.Time
+	successorPrefix string
+}
+
+// Group returns a RouteGroup that registers routes under prefix
+func (r *Router) Group(prefix string) *RouteGroup {
+	return &RouteGroup{router: r, prefix: prefix}
+}
+
+// Deprecated returns a RouteGroup for routes that will be removed at sunset.
+// Responses carry Deprecation and Sunset headers, and a Link to the same path
+// under successorPrefix, so clients can warn their users.
+func (r *Router) Deprecated(prefix string, sunset time.Time, successorPrefix string) *RouteGroup {
+	return &RouteGroup{
+		router:     r,
+		prefix:     prefix,
+		deprecated: &deprecation{sunset, successorPrefix},
+	}
+}
+
+// Handle registers handler under the group's prefix
+func (g *RouteGroup) Handle(method string, pattern string, description string, handler http.HandlerFunc) *Route {
+	if g.deprecated == nil {
+		return g.router.Handle(method, g.prefix+pattern, description, handler)
+	}
+	deprecated := g.deprecated
+	route := g.router.Handle(method, g.prefix+pattern, description,
+		func(res http.ResponseWriter, req *http.Request) {
+			successor := deprecated.successorPrefix + strings.TrimPrefix(req.URL.Path, g.prefix)
+			res.Header().Set("Deprecation", "true")
+			res.Header().Set("Sunset", deprecated.sunset.UTC().Format(http.TimeFormat))
+			res.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+			handler(res, req)
+		})
+	route.deprecated = true
+	return route
+}
+
+// Request documents the type the route decodes its JSON request body into
+func (route *Route) Request(body interface{}) *Route {
+	route.requestBody = body
+	return route
+}
+
+// Response documents the type of JSON body the route writes with the given
+// status code. body may be nil for responses without one, or a mediaType for
+// a body which isn't JSON.
+func (route *Route) Response(status int, body interface{}) *Route {
+	route.responses[status] = body
+	return route
+}
+
+// Unlogged leaves requests to the route out of the request log, for routes
+// polled so often they'd drown out everything else, such as health checks
+func (route *Route) Unlogged() *Route {
+	route.unlogged = true
+	return route
+}
+
+// Routes returns every registered route in the order they were registered
+func (r *Router) Routes() []*Route {
+	return r.routes
+}
+
+func (r *Router) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	segments := splitPath(req.URL.Path)
+
+	allowed := map[string]*routeMatch{}
+	pattern := ""
+	for _, route := range r.routes {
+		if params, ok := route.match(segments); ok {
+			if pattern == "" {
+				pattern = route.Pattern
+			}
+			if _, exists := allowed[route.Method]; !exists {
+				allowed[route.Method] = &routeMatch{route, params}
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		writeJSONMessage(res, http.StatusNotFound, "not found")
+		return
+	}
+
+	if _, ok := allowed["GET"]; ok {
+		if _, ok := allowed["HEAD"]; !ok {
+			allowed["HEAD"] = allowed["GET"]
+		}
+	}
+	res.Header().Set("Allow", allowHeader(allowed))
+	// set even if the method isn't allowed, so metrics count the request
+	// against the route rather than as unmatched
+	setRequestRoute(req, pattern)
+
+	match, ok := allowed[req.Method]
+	switch {
+	case ok && req.Method == "HEAD" && match.route.Method == "GET":
+		// Run the GET handler but throw away the body
+		res = headResponseWriter{res}
+	case ok:
+	case req.Method == "OPTIONS":
+		res.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeJSONMessage(res, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if match.route.Pattern != pattern {
+		setRequestRoute(req, match.route.Pattern)
+	}
+	if match.route.unlogged {
+		skipRequestLog(req)
+	}
+	ctx := context.WithValue(req.Context(), pathParamsKey{}, match.params)
+	match.route.handler.ServeHTTP(res, req.WithContext(ctx))
+}
+
+// pathParam returns the value of the named parameter in the path of the route
+// that matched the request
+func pathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+func (route *Route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range route.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// splitPath cleans p of relative components and trailing slashes and splits it
+// into segments
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return []string{}
+	}
+	return strings.Split(p[1:], "/")
+}
+
+func allowHeader(allowed map[string]*routeMatch) string {
+	methods := []string{"OPTIONS"}
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// headResponseWriter discards the body written by a GET handler when it's
+// serving a HEAD request
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return ioutil.Discard.Write(b)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/fluidkeys/teamserver/models"
+)
+
+// legacyRoutesSunset is when the unversioned routes, kept for Fluidkeys clients
+// installed before the API was versioned, will be removed
+var legacyRoutesSunset = time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC)
+
+// newRouter registers every route served by the teamserver. It's the single
+// place routes are defined, and also drives the API documentation served at
+// `/docs` and `/openapi.json`.
+func newRouter(env *Env) *Router {
+	router := &Router{}
+	registerV1Routes(router.Group("/v1"), env)
+	if env.config.Features.LegacyRoutes {
+		registerV1Routes(router.Deprecated("", legacyRoutesSunset, "/v1"), env)
+	}
+
+	router.Handle("GET", "/docs", "List the API's routes",
+		func(res http.ResponseWriter, req *http.Request) {
+			handleDocs(router).ServeHTTP(res, req)
+		}).
+		Response(http.StatusOK, []RouteDoc{})
+	router.Handle("GET", "/openapi.json", "Get the OpenAPI specification for the API",
+		func(res http.ResponseWriter, req *http.Request) {
+			handleOpenAPI(router).ServeHTTP(res, req)
+		}).
+		Response(http.StatusOK, map[string]interface{}{})
+	router.Handle("GET", "/healthz", "Check the server is up",
+		handleHealthz).
+		Unlogged().
+		Response(http.StatusOK, Health{})
+	router.Handle("GET", "/readyz", "Check the server is ready to serve requests",
+		env.readiness.handleReadyz).
+		Unlogged().
+		Response(http.StatusOK, Health{}).
+		Response(http.StatusServiceUnavailable, Health{})
+	if env.config.Features.Metrics {
+		router.Handle("GET", "/metrics", "Get metrics in the Prometheus text format",
+			env.metrics.registry.ServeHTTP).
+			Response(http.StatusOK, mediaType("text/plain; version=0.0.4"))
+	}
+	return router
+}
+
+// registerV1Routes registers version 1 of the API. The request and response
+// shapes of these routes are frozen except for additions: new optional request
+// fields and new response fields, such as teams' createdAt and updatedAt, can
+// be added, as clients ignore fields they don't know. Removing, renaming or
+// changing the meaning of a field belongs in a new version registered
+// alongside this one, e.g. under `/v2`.
+func registerV1Routes(router *RouteGroup, env *Env) {
+	teams := env.TeamsHandler
+	keys := env.KeysHandler
+	limit := env.rateLimiter.limit
+	byClientIP := byIP(env.config.RateLimits.TrustForwardedFor)
+
+	router.Handle("GET", "/teams", "List all teams",
+		func(res http.ResponseWriter, req *http.Request) {
+			teams.handleIndexGet(env.db).ServeHTTP(res, req)
+		}).
+		Response(http.StatusOK, []*models.Team{})
+	router.Handle("POST", "/teams", "Create a team with the posted public key as admin",
+		limit("POST /teams", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			idempotent(teams.handleIndexPost(env.db), env.db, byClientIP).ServeHTTP(res, req)
+		}), byClientIP, byPostedKey).ServeHTTP).
+		Request(models.TeamsPOST{}).
+		Response(http.StatusOK, models.TeamUUID{}).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusForbidden, Message{}).
+		Response(http.StatusConflict, Message{}).
+		Response(http.StatusRequestEntityTooLarge, Message{}).
+		Response(http.StatusUnsupportedMediaType, Message{}).
+		Response(http.StatusUnprocessableEntity, Message{}).
+		Response(http.StatusTooManyRequests, Message{})
+	router.Handle("GET", "/teams/{uuid}", "Get a team with its members and join requests",
+		func(res http.ResponseWriter, req *http.Request) {
+			teams.handleGet(pathParam(req, "uuid"), env.db).ServeHTTP(res, req)
+		}).
+		Response(http.StatusOK, models.Team{}).
+		Response(http.StatusNotModified, nil).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusNotFound, Message{})
+	router.Handle("GET", "/teams/{uuid}/summary", "Get a summary of a team",
+		func(res http.ResponseWriter, req *http.Request) {
+			teams.SummaryHandler.Handler(pathParam(req, "uuid"), env.db).ServeHTTP(res, req)
+		}).
+		Response(http.StatusOK, models.TeamSummary{}).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusNotFound, Message{})
+	router.Handle("POST", "/teams/{uuid}/request", "Request to join a team with the posted public key",
+		limit("POST /teams/{uuid}/request", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			idempotent(teams.RequestHandler.Handler(pathParam(req, "uuid"), env.db), env.db, byClientIP).ServeHTTP(res, req)
+		}), byClientIP, byPostedKey).ServeHTTP).
+		Request(models.RequestPOST{}).
+		Response(http.StatusCreated, models.JoinRequest{}).
+		Response(http.StatusOK, models.JoinRequest{}).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusForbidden, Message{}).
+		Response(http.StatusNotFound, Message{}).
+		Response(http.StatusConflict, Message{}).
+		Response(http.StatusRequestEntityTooLarge, Message{}).
+		Response(http.StatusUnsupportedMediaType, Message{}).
+		Response(http.StatusUnprocessableEntity, Message{}).
+		Response(http.StatusTooManyRequests, Message{})
+	router.Handle("GET", "/teams/{uuid}/health", "List team members whose keys are expired, revoked or expiring soon",
+		func(res http.ResponseWriter, req *http.Request) {
+			teams.TeamHealthHandler.Handler(pathParam(req, "uuid"), env.db).ServeHTTP(res, req)
+		}).
+		Response(http.StatusOK, TeamHealth{}).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusNotFound, Message{})
+	router.Handle("POST", "/teams/{uuid}/payload", "Check the posted payload is encrypted only to team members",
+		limit("POST /teams/{uuid}/payload", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			teams.PayloadHandler.Handler(pathParam(req, "uuid"), env.db).ServeHTTP(res, req)
+		}), byClientIP).ServeHTTP).
+		Request(models.PayloadPOST{}).
+		Response(http.StatusOK, Message{}).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusNotFound, Message{}).
+		Response(http.StatusRequestEntityTooLarge, Message{}).
+		Response(http.StatusUnsupportedMediaType, Message{}).
+		Response(http.StatusTooManyRequests, Message{})
+	router.Handle("POST", "/keys/{fingerprint}/revoke", "Revoke a key with the posted revocation signature",
+		limit("POST /keys/{fingerprint}/revoke", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			keys.handleRevokePost(pathParam(req, "fingerprint"), env.db).ServeHTTP(res, req)
+		}), byClientIP, byPathFingerprint).ServeHTTP).
+		Request(models.RevokePOST{}).
+		Response(http.StatusOK, Message{}).
+		Response(http.StatusBadRequest, Message{}).
+		Response(http.StatusNotFound, Message{}).
+		Response(http.StatusRequestEntityTooLarge, Message{}).
+		Response(http.StatusUnsupportedMediaType, Message{}).
+		Response(http.StatusTooManyRequests, Message{})
+}
+
+// A RouteDoc documents a single route in the API
+type RouteDoc struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+func handleDocs(router *Router) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		docs := make([]RouteDoc, 0)
+		for _, route := range router.Routes() {
+			docs = append(docs, RouteDoc{route.Method, route.Pattern, route.Description})
+		}
+		out, err := json.Marshal(docs)
+		if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, out)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/logging"
+)
+
+// server is an http.Server and how to start it listening
+type server struct {
+	*http.Server
+	tls bool
+}
+
+func (s *server) listen() error {
+	var err error
+	if s.tls {
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		err = s.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// serve serves env until the process receives SIGTERM or SIGINT, then
+// stops accepting connections and waits for in-flight requests to complete,
+// up to the configured shutdown timeout. It returns early if a server fails.
+func serve(cfg *config.Config, env *Env, logger *logging.Logger) error {
+	ctx, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+	servers, err := newServers(ctx, cfg, env, logger)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		logger.Info("listening", logging.Fields{"address": s.Addr, "tls": s.tls})
+		go func(s *server) { errs <- s.listen() }(s)
+	}
+
+	var serveErr error
+	select {
+	case sig := <-stop:
+		logger.Info("shutting down", logging.Fields{"signal": sig.String()})
+	case serveErr = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			logger.Error("error shutting down", logging.Fields{"address": s.Addr, "error": err})
+			if serveErr == nil {
+				serveErr = err
+			}
+		}
+	}
+	return serveErr
+}
+
+// newServers returns the main server for env, plus a server redirecting plain
+// HTTP to HTTPS if one is configured. When serving HTTPS, env isn't ready until
+// a certificate is loaded, and certificate files are watched until ctx is done.
+func newServers(ctx context.Context, cfg *config.Config, env *Env, logger *logging.Logger) ([]*server, error) {
+	handler := limitBody(cfg.Server.MaxBodyBytes, env)
+	if !cfg.TLSEnabled() {
+		return []*server{{Server: newHTTPServer(cfg.Server, cfg.Server.ListenAddress, handler)}}, nil
+	}
+
+	tlsConfig, redirect, err := newTLSConfig(ctx, cfg, env.db, logger)
+	if err != nil {
+		return nil, err
+	}
+	https := newHTTPServer(cfg.Server, cfg.Server.ListenAddress, hsts(cfg.TLS.HSTSMaxAge.Duration, handler))
+	https.TLSConfig = tlsConfig
+	env.readiness.add("tls_certificate", checkCertificate(tlsConfig.GetCertificate))
+	servers := []*server{{Server: https, tls: true}}
+
+	if cfg.TLS.RedirectAddress != "" {
+		servers = append(servers, &server{
+			Server: newHTTPServer(cfg.Server, cfg.TLS.RedirectAddress, redirect),
+		})
+	}
+	return servers, nil
+}
+
+// newHTTPServer returns an http.Server with timeouts, so slow or idle clients
+// can't hold connections open forever
+func newHTTPServer(serverConfig config.Server, address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadTimeout:       serverConfig.ReadTimeout.Duration,
+		ReadHeaderTimeout: serverConfig.ReadHeaderTimeout.Duration,
+		WriteTimeout:      serverConfig.WriteTimeout.Duration,
+		IdleTimeout:       serverConfig.IdleTimeout.Duration,
+		MaxHeaderBytes:    serverConfig.MaxHeaderBytes,
+	}
+}
+
+// withTimeout gives each request a deadline, after which its database queries
+// are cancelled
+func withTimeout(timeout time.Duration, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// limitBody stops handlers reading more than maxBytes of any request body
+func limitBody(maxBytes int64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(res, req.Body, maxBytes)
+		handler.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+func TestServeFinishesInFlightRequestsOnShutdown(t *testing.T) {
+	db := &blockingDatastore{DB: fakedb.New(), started: make(chan struct{}), release: make(chan struct{})}
+	cfg := config.Default()
+	cfg.Server.ListenAddress = freeAddress(t)
+	env := newEnv(db, cfg, newServerMetrics(nil, logging.Discard()), logging.Discard())
+
+	served := make(chan error, 1)
+	go func() { served <- serve(cfg, env, logging.Discard()) }()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		res, err := getWhenListening("http://" + cfg.Server.ListenAddress + "/v1/teams")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		responses <- result{status: res.StatusCode, body: string(body), err: err}
+	}()
+
+	select {
+	case <-db.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the database")
+	}
+	// serve registered for SIGTERM before it started listening
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("error sending SIGTERM: %v", err)
+	}
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(db.release)
+
+	res := <-responses
+	if res.err != nil || res.status != http.StatusOK {
+		t.Errorf("expected in-flight request to succeed, got %d %s, %v", res.status, res.body, res.err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected serve to return nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("serve didn't return after shutting down")
+	}
+	if _, err := http.Get("http://" + cfg.Server.ListenAddress + "/v1/teams"); err == nil {
+		t.Error("expected server to stop accepting connections")
+	}
+}
+
+func TestCancelledRequestAbortsQueries(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		method     string
+		path       func(teamUUID string) string
+		body       string
+		wantStatus int
+		wantCalled string
+		notCalled  string
+	}{
+		{
+			name:       "cancelled list of teams",
+			ctx:        cancelled,
+			method:     "GET",
+			path:       func(string) string { return "/v1/teams" },
+			wantStatus: http.StatusInternalServerError,
+			wantCalled: "AllTeams",
+		},
+		{
+			name:       "team request past its deadline",
+			ctx:        expired,
+			method:     "GET",
+			path:       func(teamUUID string) string { return "/v1/teams/" + teamUUID },
+			wantStatus: http.StatusServiceUnavailable,
+			wantCalled: "GetTeamWithMembers",
+		},
+		{
+			name:       "cancelled team creation",
+			ctx:        cancelled,
+			method:     "POST",
+			path:       func(string) string { return "/v1/teams" },
+			body:       jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: fixtures.Expired.Armored}),
+			wantStatus: http.StatusInternalServerError,
+			wantCalled: "WithTx",
+			notCalled:  "Tx.CreateTeam",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := fakedb.New()
+			teamUUID := createTestTeam(t, db, "Existing", fixtures.Valid)
+			calledBefore := db.Called(test.notCalled)
+			req := httptest.NewRequest(test.method, test.path(teamUUID.String()), strings.NewReader(test.body))
+			if test.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			res := httptest.NewRecorder()
+
+			newTestEnv(db).ServeHTTP(res, req.WithContext(test.ctx))
+
+			if res.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+			}
+			if db.Called(test.wantCalled) == 0 {
+				t.Errorf("expected %s to be called", test.wantCalled)
+			}
+			if test.notCalled != "" && db.Called(test.notCalled) != calledBefore {
+				t.Errorf("expected %s not to be called once the context was cancelled", test.notCalled)
+			}
+			teams, err := db.AllTeams(context.Background())
+			if err != nil || len(teams) != 1 {
+				t.Errorf("expected only the existing team, got %d teams, %v", len(teams), err)
+			}
+		})
+	}
+}
+
+func TestWithTimeoutCancelsQueries(t *testing.T) {
+	db := fakedb.New()
+	var queryErr error
+	handler := withTimeout(time.Millisecond, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		_, queryErr = db.AllTeams(req.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/teams", nil))
+
+	if queryErr != context.DeadlineExceeded {
+		t.Errorf("expected query to fail with context.DeadlineExceeded, got %v", queryErr)
+	}
+}
+
+// blockingDatastore holds AllTeams calls until release is closed, closing
+// started when the first one arrives
+type blockingDatastore struct {
+	*fakedb.DB
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (d *blockingDatastore) AllTeams(ctx context.Context) ([]*models.Team, error) {
+	d.once.Do(func() { close(d.started) })
+	<-d.release
+	return d.DB.AllTeams(ctx)
+}
+
+// freeAddress returns a local address with a port nothing is listening on
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error finding a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// getWhenListening retries GET url until the server accepts the connection
+func getWhenListening(url string) (*http.Response, error) {
+	var err error
+	for i := 0; i < 100; i++ {
+		var res *http.Response
+		if res, err = http.Get(url); err == nil {
+			return res, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, err
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"fmt"
 	"net/http"
 
 	"github.com/fluidkeys/teamserver/models"
@@ -18,21 +18,24 @@ func (h *SummaryHandler) Handler(uuidString string, db models.Datastore) http.Ha
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		uuid, err := uuid.FromString(uuidString)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
 			return
 		}
-		team, err := db.GetTeam(uuid)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+		team, err := db.GetTeam(req.Context(), uuid)
+		if err == sql.ErrNoRows {
+			writeJSONMessage(res, http.StatusNotFound, "team not found")
+			return
+		} else if err != nil {
+			internalServerError(res, req, err)
 			return
 		}
 		out, err := json.Marshal(models.TeamSummary{
 			Team: team,
 		})
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			internalServerError(res, req, err)
 			return
 		}
-		fmt.Fprintf(res, string(out))
+		writeJSON(res, http.StatusOK, out)
 	})
 }
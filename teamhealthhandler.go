@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/fluidkeys/teamserver/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+// TeamHealthHandler is used to server up HTTP requests to
+// `/teams/{uuid}/health`
+type TeamHealthHandler struct{}
+
+// Handler takes a team UUID and database and then lists the members whose keys
+// are expired, revoked or about to expire, writing JSON back.
+func (h *TeamHealthHandler) Handler(uuidString string, db models.Datastore) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		uuid, err := uuid.FromString(uuidString)
+		if err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		members, revokedMembers, err := db.GetTeamMembersWithRevoked(req.Context(), uuid)
+		if err == sql.ErrNoRows {
+			writeJSONMessage(res, http.StatusNotFound, "team not found")
+			return
+		} else if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		teamHealth, err := getTeamHealth(members, revokedMembers, time.Now())
+		if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		out, err := json.Marshal(teamHealth)
+		if err != nil {
+			internalServerError(res, req, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, out)
+	})
+}
@@ -1,106 +1,127 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 
 	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/teamserver/config"
 	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/tracing"
 	uuid "github.com/satori/go.uuid"
 )
 
 // TeamsHandler is used to server up HTTP requests to `/teams`
 type TeamsHandler struct {
-	SummaryHandler *SummaryHandler
-	RequestHandler *RequestHandler
-}
-
-func (h *TeamsHandler) ServeHTTP(res http.ResponseWriter, req *http.Request, db models.Datastore) {
-	var uuid string
-	uuid, tail := shiftPath(req.URL.Path)
-	if uuid == "" {
-		switch req.Method {
-		case "GET":
-			h.handleIndexGet(db).ServeHTTP(res, req)
-		case "POST":
-			h.handleIndexPost(db).ServeHTTP(res, req)
-		default:
-			http.Error(res, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
-		}
-	} else {
-		switch tail {
-		case "/":
-			h.handleGet(uuid, db).ServeHTTP(res, req)
-		case "/summary":
-			h.SummaryHandler.Handler(uuid, db).ServeHTTP(res, req)
-		case "/request":
-			h.RequestHandler.Handler(uuid, db).ServeHTTP(res, req)
-		default:
-			http.Error(res, "Not Found", http.StatusNotFound)
-		}
-	}
-	return
+	SummaryHandler    *SummaryHandler
+	RequestHandler    *RequestHandler
+	TeamHealthHandler *TeamHealthHandler
+	PayloadHandler    *PayloadHandler
+	KeyPolicy         config.KeyPolicy
 }
 
 func (h *TeamsHandler) handleIndexGet(db models.Datastore) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		teams, err := db.AllTeams()
+		teams, err := db.AllTeams(req.Context())
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			internalServerError(res, req, err)
+			return
 		}
 		out, err := json.Marshal(teams)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			internalServerError(res, req, err)
+			return
 		}
-		fmt.Fprintf(res, string(out))
+		writeJSON(res, http.StatusOK, out)
 	})
 }
 
 func (h *TeamsHandler) handleIndexPost(db models.Datastore) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		decoder := json.NewDecoder(req.Body)
 		var teamPost models.TeamsPOST
-		err := decoder.Decode(&teamPost)
-		if err != nil {
-			panic(err)
-		}
-
-		fingerprint, err := getFingerprintFromPublicKey(teamPost.PublicKey)
+		err := decodeJSON(res, req, &teamPost)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			writeRequestError(res, req, err)
 			return
 		}
 
-		_, err = db.CreatePublicKey(fingerprint, teamPost.PublicKey)
+		fingerprint, err := postedKeyFingerprint(req, teamPost.PublicKey)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
 			return
 		}
-
-		teamID, teamUUID, err := db.CreateTeam(teamPost.Name)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+		setRequestFingerprint(req, fingerprint)
+		if err = checkKeyPolicy(teamPost.PublicKey, h.KeyPolicy); err != nil {
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		_, err = db.CreateTeamUser(teamID, fingerprint)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+		var teamUUID *uuid.UUID
+		err = db.WithTx(req.Context(), func(tx models.Tx) error {
+			_, err := tx.CreatePublicKey(fingerprint, teamPost.PublicKey)
+			if err != nil {
+				return err
+			}
+			var teamID int64
+			teamID, teamUUID, err = tx.CreateTeam(teamPost.Name)
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateTeamUser(teamID, fingerprint)
+			return err
+		})
+		if err == models.ErrPublicKeyRevoked {
+			writeJSONMessage(res, http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
+			internalServerError(res, req, err)
 			return
 		}
 
 		out, err := json.Marshal(models.TeamUUID{UUID: teamUUID.String()})
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			internalServerError(res, req, err)
+			return
 		}
-		fmt.Fprintf(res, string(out))
+		writeJSON(res, http.StatusOK, out)
 	})
 }
 
-func getFingerprintFromPublicKey(armoredPublicKey string) (string, error) {
+type parsedPublicKeyKey struct{}
+
+// A parsedPublicKey is the result of parsing a posted public key, kept in the
+// request context so it's only parsed once
+type parsedPublicKey struct {
+	armored     string
+	fingerprint models.Fingerprint
+	err         error
+}
+
+// postedKeyFingerprint returns the fingerprint of armoredPublicKey, posted in
+// req's body, reusing the result if the rate limiter already parsed it
+func postedKeyFingerprint(req *http.Request, armoredPublicKey string) (models.Fingerprint, error) {
+	parsed, ok := req.Context().Value(parsedPublicKeyKey{}).(*parsedPublicKey)
+	if ok && parsed.armored == armoredPublicKey {
+		return parsed.fingerprint, parsed.err
+	}
+	return getFingerprintFromPublicKey(req.Context(), armoredPublicKey)
+}
+
+// getFingerprintFromPublicKey parses the armored public key, recording how
+// long that takes as a span of the request in ctx
+func getFingerprintFromPublicKey(ctx context.Context, armoredPublicKey string) (models.Fingerprint, error) {
+	_, span := tracing.StartSpan(ctx, "getFingerprintFromPublicKey", tracing.Internal)
+	fingerprint, err := fingerprintFromPublicKey(armoredPublicKey)
+	span.SetError(err)
+	span.End()
+	return fingerprint, err
+}
+
+func fingerprintFromPublicKey(armoredPublicKey string) (models.Fingerprint, error) {
 	entityList, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredPublicKey))
 	if err != nil {
 		return "", fmt.Errorf("error reading armored key ring: %v", err)
@@ -109,52 +130,48 @@ func getFingerprintFromPublicKey(armoredPublicKey string) (string, error) {
 		return "", fmt.Errorf("expected 1 openpgp.Entity, got %d", len(entityList))
 	}
 	entity := entityList[0]
+	if hasPrivateKey(entity) {
+		return "", fmt.Errorf("expected a public key, got a private key")
+	}
 
-	fingerprint := fingerprintString(entity.PrimaryKey.Fingerprint)
-	return fingerprint, nil
+	return models.FingerprintFromBytes(entity.PrimaryKey.Fingerprint[:])
 }
 
-func fingerprintString(b [20]byte) string {
-	return fmt.Sprintf(
-		"%0X %0X %0X %0X %0X  %0X %0X %0X %0X %0X",
-		b[0:2], b[2:4], b[4:6], b[6:8], b[8:10],
-		b[10:12], b[12:14], b[14:16], b[16:18], b[18:20],
-	)
+// hasPrivateKey returns true if entity includes private key material for its
+// primary key or any subkey, which must never be stored
+func hasPrivateKey(entity *openpgp.Entity) bool {
+	if entity.PrivateKey != nil {
+		return true
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *TeamsHandler) handleGet(uuidString string, db models.Datastore) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		uuid, err := uuid.FromString(uuidString)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			writeJSONMessage(res, http.StatusBadRequest, err.Error())
 			return
 		}
-		team, err := db.GetTeam(uuid)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+		team, err := db.GetTeamWithMembers(req.Context(), uuid)
+		if err == sql.ErrNoRows {
+			writeJSONMessage(res, http.StatusNotFound, "team not found")
 			return
-		}
-		teamID, err := strconv.Atoi(team.ID)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
-			return
-		}
-		team.Members, err = db.GetTeamMembers(teamID)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
-			return
-		}
-		team.JoinRequests, err = db.GetTeamJoinRequests(teamID)
-		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+		} else if err != nil {
+			internalServerError(res, req, err)
 			return
 		}
 
 		out, err := json.Marshal(team)
 		if err != nil {
-			http.Error(res, formatAsJSONMessage(err.Error()), http.StatusInternalServerError)
+			internalServerError(res, req, err)
 			return
 		}
-		fmt.Fprintf(res, string(out))
+		writeWithETag(res, req, out)
 	})
 }
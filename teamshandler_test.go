@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fluidkeys/crypto/openpgp"
+	"github.com/fluidkeys/crypto/openpgp/armor"
+	"github.com/fluidkeys/teamserver/fixtures"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/models/fakedb"
+)
+
+func TestCreateTeamWithRevokedKey(t *testing.T) {
+	db := fakedb.New()
+	createTestTeam(t, db, "Kiffix", fixtures.Valid)
+	err := db.RevokePublicKey(context.Background(), fixtures.Valid.Fingerprint, fixtures.Valid.Armored)
+	if err != nil {
+		t.Fatalf("error revoking key: %v", err)
+	}
+
+	res := doRequest(newTestEnv(db), "POST", "/v1/teams",
+		jsonBody(models.TeamsPOST{Name: "Another", PublicKey: fixtures.Valid.Armored}))
+	if res.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d: %s", res.Code, res.Body)
+	}
+	if n := db.Called("Tx.CreateTeamUser"); n != 1 {
+		t.Errorf("expected only the first team's member to be created, got %d calls", n)
+	}
+}
+
+func TestPostingAStrippedKeyKeepsTheStoredKey(t *testing.T) {
+	db := fakedb.New()
+	teamUUID := createTestTeam(t, db, "Kiffix", fixtures.Valid)
+	entity := readEntity(t, fixtures.Valid)
+	entity.Subkeys = nil
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("error armoring key: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	w.Close()
+
+	res := doRequest(newTestEnv(db), "POST", "/v1/teams/"+teamUUID.String()+"/request",
+		jsonBody(models.RequestPOST{PublicKey: buf.String()}))
+	if res.Code >= 500 {
+		t.Fatalf("expected request to be handled, got %d: %s", res.Code, res.Body)
+	}
+	publicKey, err := db.GetPublicKey(context.Background(), fixtures.Valid.Fingerprint)
+	if err != nil {
+		t.Fatalf("error getting key: %v", err)
+	}
+	if publicKey.ArmoredPublicKey != fixtures.Valid.Armored {
+		t.Error("expected the stored key to be kept")
+	}
+}
+
+func TestCreateTeamRollsBackOnFailure(t *testing.T) {
+	db := fakedb.New()
+	db.Fail("Tx.CreateTeamUser", errors.New("connection lost"))
+
+	res := doRequest(newTestEnv(db), "POST", "/v1/teams",
+		jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: fixtures.Valid.Armored}))
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d: %s", res.Code, res.Body)
+	}
+	if db.Called("Tx.CreatePublicKey") != 1 || db.Called("Tx.CreateTeam") != 1 {
+		t.Fatalf("expected the key and team to be created before the failure, got calls %v", db.Calls())
+	}
+	ctx := context.Background()
+	if teams, err := db.AllTeams(ctx); err != nil || len(teams) != 0 {
+		t.Errorf("expected team to be rolled back, got %d teams, %v", len(teams), err)
+	}
+	if _, err := db.GetPublicKey(ctx, fixtures.Valid.Fingerprint); err != sql.ErrNoRows {
+		t.Errorf("expected public key to be rolled back, got %v", err)
+	}
+}
+
+func TestPrivateKeysAreNotStored(t *testing.T) {
+	tests := []struct {
+		name       string
+		armored    string
+		wantStatus int
+	}{
+		{"private key block", fixtures.SecretKey.Armored, http.StatusBadRequest},
+		{"private key armored as a public key", rearmor(t, fixtures.SecretKey.Armored, openpgp.PublicKeyType), http.StatusBadRequest},
+		{"signature block", rearmor(t, fixtures.Valid.Armored, openpgp.SignatureType), http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := fakedb.New()
+			teamUUID := createTestTeam(t, db, "Existing")
+			env := newTestEnv(db)
+
+			for _, res := range []*httptest.ResponseRecorder{
+				doRequest(env, "POST", "/v1/teams",
+					jsonBody(models.TeamsPOST{Name: "Kiffix", PublicKey: test.armored})),
+				doRequest(env, "POST", "/v1/teams/"+teamUUID.String()+"/request",
+					jsonBody(models.RequestPOST{PublicKey: test.armored})),
+			} {
+				if res.Code != test.wantStatus {
+					t.Errorf("expected status %d, got %d: %s", test.wantStatus, res.Code, res.Body)
+				}
+			}
+			if keys, err := db.AllPublicKeys(context.Background()); err != nil || len(keys) != 0 {
+				t.Errorf("expected no keys stored, got %d, %v", len(keys), err)
+			}
+		})
+	}
+}
+
+// rearmor replaces the armor header of armored with blockType, leaving the
+// packets inside unchanged
+func rearmor(t *testing.T, armored string, blockType string) string {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		t.Fatalf("error decoding armor: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, blockType, nil)
+	if err != nil {
+		t.Fatalf("error encoding armor: %v", err)
+	}
+	if _, err := io.Copy(w, block.Body); err != nil {
+		t.Fatalf("error copying packets: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error encoding armor: %v", err)
+	}
+	return buf.String()
+}
+
+func jsonBody(v interface{}) string {
+	body, _ := json.Marshal(v)
+	return string(body)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"golang.org/x/crypto/acme"
+)
+
+// newTLSConfig returns the TLS config for serving HTTPS with the configured
+// certificate files or ACME, with certificates from ACME kept in db, along
+// with the handler for the plain HTTP redirect listener, which sends clients
+// to HTTPS and answers ACME http-01 challenges. Certificate files are
+// reloaded when they change until ctx is done.
+func newTLSConfig(ctx context.Context, cfg *config.Config, db models.Datastore, logger *logging.Logger) (*tls.Config, http.Handler, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	redirect := httpsRedirect(cfg.Server.ListenAddress)
+
+	if cfg.TLS.ACME.Enabled {
+		manager, err := newACMEManager(cfg.TLS.ACME, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetCertificate = withDefaultServerName(cfg.TLS.ACME.Domains[0], manager.GetCertificate)
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+		if cfg.TLS.ACME.Challenge == "http-01" {
+			redirect = manager.HTTPHandler(redirect)
+		}
+	} else {
+		reloader, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		go reloader.watch(ctx, certReloadInterval)
+	}
+	return tlsConfig, redirect, nil
+}
+
+// hsts tells browsers to only ever use HTTPS for this host. A maxAge of zero
+// leaves the header out.
+func hsts(maxAge time.Duration, handler http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return handler
+	}
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Strict-Transport-Security", value)
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// httpsRedirect permanently redirects requests to the same host and path on
+// the HTTPS listen address
+func httpsRedirect(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host // no port in the Host header
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(res, req, target, http.StatusMovedPermanently)
+	})
+}
+
+// certReloadInterval is how often the certificate files are checked for
+// changes. Sending the process SIGHUP checks them straight away.
+const certReloadInterval = time.Minute
+
+// certReloader serves a certificate and key from files, reloading them when
+// either file changes so certificates can be renewed without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      *logging.Logger
+
+	cert atomic.Value // *tls.Certificate
+
+	// Only used by reload, which isn't called concurrently
+	modTimes  string
+	lastError string
+}
+
+func newCertReloader(certFile string, keyFile string, logger *logging.Logger) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, log: logger}
+	modTimes, err := reloader.modificationTimes()
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	reloader.cert.Store(&cert)
+	reloader.modTimes = modTimes
+	return reloader, nil
+}
+
+// GetCertificate returns the most recently loaded certificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// watch reloads the certificate every interval, and whenever the process
+// receives SIGHUP, until ctx is done
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-hangup:
+		case <-ctx.Done():
+			return
+		}
+		r.reload()
+	}
+}
+
+// reload loads the certificate again if either file has been modified since it
+// was last loaded. If that fails the previous certificate continues to be
+// served, and the error is only logged again once the files change.
+func (r *certReloader) reload() {
+	modTimes, err := r.modificationTimes()
+	if err == nil && modTimes == r.modTimes {
+		return
+	}
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err == nil {
+			r.cert.Store(&cert)
+			r.modTimes = modTimes
+			r.lastError = ""
+			r.log.Info("reloaded TLS certificate", logging.Fields{"file": r.certFile})
+			return
+		}
+	}
+	if failure := modTimes + err.Error(); failure != r.lastError {
+		r.lastError = failure
+		r.log.Error("error reloading TLS certificate, keeping the old one", logging.Fields{"error": err})
+	}
+}
+
+func (r *certReloader) modificationTimes() (string, error) {
+	modTimes := ""
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		modTimes += strconv.FormatInt(info.ModTime().UnixNano(), 10) + " "
+	}
+	return modTimes, nil
+}
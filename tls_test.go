@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluidkeys/teamserver/logging"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teamserver-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first.test")
+
+	out := new(bytes.Buffer)
+	reloader, err := newCertReloader(certFile, keyFile, logging.New(out, logging.Info))
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+	first, _ := reloader.GetCertificate(nil)
+
+	reloader.reload()
+	if cert, _ := reloader.GetCertificate(nil); cert != first {
+		t.Errorf("expected unchanged files not to be reloaded")
+	}
+
+	// A half-written certificate is refused, and only logged once
+	touchLater(t, certFile, []byte("not a certificate"))
+	reloader.reload()
+	reloader.reload()
+	if cert, _ := reloader.GetCertificate(nil); cert != first {
+		t.Errorf("expected the old certificate to be kept")
+	}
+	if n := strings.Count(out.String(), "error reloading TLS certificate"); n != 1 {
+		t.Errorf("expected the failure to be logged once, got %d times: %s", n, out)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second.test")
+	touchLater(t, certFile, nil)
+	reloader.reload()
+	cert, _ := reloader.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.Subject.CommonName != "second.test" {
+		t.Errorf("expected the new certificate to be loaded, got %v, %v", leaf, err)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for commonName and its
+// key to certFile and keyFile
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touchLater writes contents to filename if it isn't nil, then moves its
+// modification time forward so the change is seen however coarse the
+// filesystem's timestamps are
+func touchLater(t *testing.T, filename string, contents []byte) {
+	if contents != nil {
+		if err := ioutil.WriteFile(filename, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := info.ModTime().Add(time.Second)
+	if err = os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
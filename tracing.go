@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/fluidkeys/teamserver/config"
+	"github.com/fluidkeys/teamserver/logging"
+	"github.com/fluidkeys/teamserver/models"
+	"github.com/fluidkeys/teamserver/tracing"
+	uuid "github.com/satori/go.uuid"
+)
+
+// newTracer returns a Tracer for the configured exporter, or nil if tracing is
+// turned off
+func newTracer(tracingConfig config.Tracing, logger *logging.Logger) *tracing.Tracer {
+	switch tracingConfig.Exporter {
+	case "stdout":
+		return tracing.NewTracer(tracing.NewWriterExporter(os.Stdout, tracingConfig.ServiceName))
+	case "otlp":
+		return tracing.NewTracer(tracing.NewOTLPExporter(
+			tracingConfig.OTLPEndpoint, tracingConfig.ServiceName,
+			func(err error) {
+				logger.Error("error exporting spans", logging.Fields{"error": err})
+			}))
+	}
+	return nil
+}
+
+// endSpan ends span, marking it failed if err is a real error rather than a
+// lookup finding nothing
+func endSpan(span *tracing.Span, err error) {
+	if err != sql.ErrNoRows {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// tracedDatastore wraps a Datastore, recording each call as a child of the
+// span in the context it's given
+type tracedDatastore struct {
+	next models.Datastore
+}
+
+// traceDatastore returns a Datastore recording a span for every call to db
+// made while serving a traced request
+func traceDatastore(db models.Datastore) models.Datastore {
+	return &tracedDatastore{next: db}
+}
+
+func (d *tracedDatastore) start(ctx context.Context, method string) *tracing.Span {
+	_, span := tracing.StartSpan(ctx, "Datastore."+method, tracing.Client)
+	return span
+}
+
+func (d *tracedDatastore) AllTeams(ctx context.Context) ([]*models.Team, error) {
+	span := d.start(ctx, "AllTeams")
+	teams, err := d.next.AllTeams(ctx)
+	endSpan(span, err)
+	return teams, err
+}
+
+func (d *tracedDatastore) CreateTeam(ctx context.Context, teamName string) (int64, *uuid.UUID, error) {
+	span := d.start(ctx, "CreateTeam")
+	teamID, teamUUID, err := d.next.CreateTeam(ctx, teamName)
+	endSpan(span, err)
+	return teamID, teamUUID, err
+}
+
+func (d *tracedDatastore) CreateTeamUser(ctx context.Context, teamID int64, fingerprint models.Fingerprint) (int64, error) {
+	span := d.start(ctx, "CreateTeamUser")
+	id, err := d.next.CreateTeamUser(ctx, teamID, fingerprint)
+	endSpan(span, err)
+	return id, err
+}
+
+func (d *tracedDatastore) CreatePublicKey(ctx context.Context, fingerprint models.Fingerprint, armoredPublicKey string) (int64, error) {
+	span := d.start(ctx, "CreatePublicKey")
+	id, err := d.next.CreatePublicKey(ctx, fingerprint, armoredPublicKey)
+	endSpan(span, err)
+	return id, err
+}
+
+func (d *tracedDatastore) GetTeam(ctx context.Context, teamUUID uuid.UUID) (*models.Team, error) {
+	span := d.start(ctx, "GetTeam")
+	team, err := d.next.GetTeam(ctx, teamUUID)
+	endSpan(span, err)
+	return team, err
+}
+
+func (d *tracedDatastore) GetTeamWithMembers(ctx context.Context, teamUUID uuid.UUID) (*models.Team, error) {
+	span := d.start(ctx, "GetTeamWithMembers")
+	team, err := d.next.GetTeamWithMembers(ctx, teamUUID)
+	endSpan(span, err)
+	return team, err
+}
+
+func (d *tracedDatastore) CreateTeamJoinRequest(ctx context.Context, fingerprint models.Fingerprint, teamUUID string) (int64, error) {
+	span := d.start(ctx, "CreateTeamJoinRequest")
+	id, err := d.next.CreateTeamJoinRequest(ctx, fingerprint, teamUUID)
+	endSpan(span, err)
+	return id, err
+}
+
+func (d *tracedDatastore) GetTeamMembers(ctx context.Context, teamID int) ([]*models.Member, error) {
+	span := d.start(ctx, "GetTeamMembers")
+	members, err := d.next.GetTeamMembers(ctx, teamID)
+	endSpan(span, err)
+	return members, err
+}
+
+func (d *tracedDatastore) GetTeamMembersWithRevoked(ctx context.Context, teamUUID uuid.UUID) ([]*models.Member, []*models.Member, error) {
+	span := d.start(ctx, "GetTeamMembersWithRevoked")
+	members, revokedMembers, err := d.next.GetTeamMembersWithRevoked(ctx, teamUUID)
+	endSpan(span, err)
+	return members, revokedMembers, err
+}
+
+func (d *tracedDatastore) GetTeamJoinRequests(ctx context.Context, teamID int) ([]*models.JoinRequest, error) {
+	span := d.start(ctx, "GetTeamJoinRequests")
+	joinRequests, err := d.next.GetTeamJoinRequests(ctx, teamID)
+	endSpan(span, err)
+	return joinRequests, err
+}
+
+func (d *tracedDatastore) GetTeamJoinRequest(ctx context.Context, teamUUID string, fingerprint models.Fingerprint) (*models.JoinRequest, error) {
+	span := d.start(ctx, "GetTeamJoinRequest")
+	joinRequest, err := d.next.GetTeamJoinRequest(ctx, teamUUID, fingerprint)
+	endSpan(span, err)
+	return joinRequest, err
+}
+
+func (d *tracedDatastore) AllPublicKeys(ctx context.Context) ([]*models.PublicKey, error) {
+	span := d.start(ctx, "AllPublicKeys")
+	publicKeys, err := d.next.AllPublicKeys(ctx)
+	endSpan(span, err)
+	return publicKeys, err
+}
+
+func (d *tracedDatastore) AllRevokedPublicKeys(ctx context.Context) ([]*models.PublicKey, error) {
+	span := d.start(ctx, "AllRevokedPublicKeys")
+	publicKeys, err := d.next.AllRevokedPublicKeys(ctx)
+	endSpan(span, err)
+	return publicKeys, err
+}
+
+func (d *tracedDatastore) GetPublicKey(ctx context.Context, fingerprint models.Fingerprint) (*models.PublicKey, error) {
+	span := d.start(ctx, "GetPublicKey")
+	publicKey, err := d.next.GetPublicKey(ctx, fingerprint)
+	endSpan(span, err)
+	return publicKey, err
+}
+
+func (d *tracedDatastore) RevokePublicKey(ctx context.Context, fingerprint models.Fingerprint, armoredPublicKey string) error {
+	span := d.start(ctx, "RevokePublicKey")
+	err := d.next.RevokePublicKey(ctx, fingerprint, armoredPublicKey)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDatastore) GetIdempotentResponse(ctx context.Context, client string, key string, method string, path string) (*models.IdempotentResponse, error) {
+	span := d.start(ctx, "GetIdempotentResponse")
+	response, err := d.next.GetIdempotentResponse(ctx, client, key, method, path)
+	endSpan(span, err)
+	return response, err
+}
+
+func (d *tracedDatastore) ClaimIdempotencyKey(ctx context.Context, claim *models.IdempotentResponse, staleAfter time.Duration) (*models.IdempotentResponse, error) {
+	span := d.start(ctx, "ClaimIdempotencyKey")
+	existing, err := d.next.ClaimIdempotencyKey(ctx, claim, staleAfter)
+	endSpan(span, err)
+	return existing, err
+}
+
+func (d *tracedDatastore) CompleteIdempotentResponse(ctx context.Context, response *models.IdempotentResponse) error {
+	span := d.start(ctx, "CompleteIdempotentResponse")
+	err := d.next.CompleteIdempotentResponse(ctx, response)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDatastore) ReleaseIdempotencyKey(ctx context.Context, client string, key string, method string, path string) error {
+	span := d.start(ctx, "ReleaseIdempotencyKey")
+	err := d.next.ReleaseIdempotencyKey(ctx, client, key, method, path)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDatastore) DeleteIdempotentResponses(ctx context.Context, olderThan time.Duration) (int64, error) {
+	span := d.start(ctx, "DeleteIdempotentResponses")
+	deleted, err := d.next.DeleteIdempotentResponses(ctx, olderThan)
+	endSpan(span, err)
+	return deleted, err
+}
+
+func (d *tracedDatastore) TakeRateLimitToken(ctx context.Context, key string, ratePerSecond float64, burst int) (bool, time.Duration, error) {
+	span := d.start(ctx, "TakeRateLimitToken")
+	allowed, retryAfter, err := d.next.TakeRateLimitToken(ctx, key, ratePerSecond, burst)
+	endSpan(span, err)
+	return allowed, retryAfter, err
+}
+
+func (d *tracedDatastore) ReturnRateLimitToken(ctx context.Context, key string, burst int) error {
+	span := d.start(ctx, "ReturnRateLimitToken")
+	err := d.next.ReturnRateLimitToken(ctx, key, burst)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDatastore) DeleteFullRateLimitBuckets(ctx context.Context) (int64, error) {
+	span := d.start(ctx, "DeleteFullRateLimitBuckets")
+	deleted, err := d.next.DeleteFullRateLimitBuckets(ctx)
+	endSpan(span, err)
+	return deleted, err
+}
+
+func (d *tracedDatastore) GetACMECacheEntry(ctx context.Context, key string) ([]byte, error) {
+	span := d.start(ctx, "GetACMECacheEntry")
+	data, err := d.next.GetACMECacheEntry(ctx, key)
+	endSpan(span, err)
+	return data, err
+}
+
+func (d *tracedDatastore) PutACMECacheEntry(ctx context.Context, key string, data []byte) error {
+	span := d.start(ctx, "PutACMECacheEntry")
+	err := d.next.PutACMECacheEntry(ctx, key, data)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDatastore) DeleteACMECacheEntry(ctx context.Context, key string) error {
+	span := d.start(ctx, "DeleteACMECacheEntry")
+	err := d.next.DeleteACMECacheEntry(ctx, key)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDatastore) CountRecords(ctx context.Context) (*models.RecordCounts, error) {
+	span := d.start(ctx, "CountRecords")
+	counts, err := d.next.CountRecords(ctx)
+	endSpan(span, err)
+	return counts, err
+}
+
+// WithTx records the whole transaction as one span, including the work done
+// by fn
+func (d *tracedDatastore) WithTx(ctx context.Context, fn func(models.Tx) error) error {
+	span := d.start(ctx, "WithTx")
+	err := d.next.WithTx(ctx, fn)
+	endSpan(span, err)
+	return err
+}
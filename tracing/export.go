@@ -0,0 +1,288 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Exporter sends finished spans somewhere they can be looked at
+type Exporter interface {
+	// Export is called when each sampled span ends. It mustn't block for
+	// long, since it's called while serving requests.
+	Export(span *SpanData)
+	// Shutdown sends any spans still waiting to be sent
+	Shutdown(ctx context.Context) error
+}
+
+// WriterExporter writes each span as a line of JSON, for trying tracing out
+// without a collector
+type WriterExporter struct {
+	mu          sync.Mutex
+	out         io.Writer
+	serviceName string
+}
+
+// NewWriterExporter returns an Exporter writing spans from serviceName to out
+func NewWriterExporter(out io.Writer, serviceName string) *WriterExporter {
+	return &WriterExporter{out: out, serviceName: serviceName}
+}
+
+// Export writes span as one line of JSON
+func (e *WriterExporter) Export(span *SpanData) {
+	line := map[string]interface{}{
+		"service":    e.serviceName,
+		"name":       span.Name,
+		"traceId":    span.TraceID.String(),
+		"spanId":     span.SpanID.String(),
+		"kind":       kindNames[span.Kind],
+		"start":      span.Start.UTC().Format(time.RFC3339Nano),
+		"durationMs": float64(span.End.Sub(span.Start).Nanoseconds()) / 1e6,
+		"attributes": span.Attributes,
+	}
+	if span.ParentSpanID.IsValid() {
+		line["parentSpanId"] = span.ParentSpanID.String()
+	}
+	if span.Error != "" {
+		line["error"] = span.Error
+	}
+	out, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.out.Write(append(out, '\n'))
+}
+
+// Shutdown does nothing, since spans are written as soon as they end
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+var kindNames = map[SpanKind]string{Internal: "internal", Server: "server", Client: "client"}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector, using
+// OTLP's JSON encoding over HTTP. Spans are dropped rather than slowing down
+// requests if the collector can't keep up.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	onError     func(error)
+
+	queue    chan *SpanData
+	shutdown chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// NewOTLPExporter returns an Exporter sending spans from serviceName to the
+// collector at endpoint, such as http://localhost:4318. Errors sending spans
+// are passed to onError.
+func NewOTLPExporter(endpoint string, serviceName string, onError func(error)) *OTLPExporter {
+	e := &OTLPExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		onError:     onError,
+		queue:       make(chan *SpanData, otlpQueueSize),
+		shutdown:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues span to be sent with the next batch
+func (e *OTLPExporter) Export(span *SpanData) {
+	select {
+	case e.queue <- span:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Shutdown sends the spans still queued and stops the exporter
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	close(e.shutdown)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	batch := []*SpanData{}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.shutdown:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			return
+		}
+		e.send(batch)
+		batch = []*SpanData{}
+	}
+}
+
+func (e *OTLPExporter) send(batch []*SpanData) {
+	e.mu.Lock()
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		e.onError(fmt.Errorf("dropped %d spans because the export queue was full", dropped))
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		e.onError(fmt.Errorf("error encoding spans: %v", err))
+		return
+	}
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.onError(fmt.Errorf("error sending %d spans: %v", len(batch), err))
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		e.onError(fmt.Errorf("error sending %d spans: collector responded %s", len(batch), res.Status))
+	}
+}
+
+// The OTLP JSON encoding, described at
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *OTLPExporter) request(batch []*SpanData) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		s := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentSpanID.IsValid() {
+			s.ParentSpanID = span.ParentSpanID.String()
+		}
+		for key, value := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttributeFor(key, value))
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		spans = append(spans, s)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpAttributeFor("service.name", e.serviceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/fluidkeys/teamserver/tracing"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func otlpAttributeFor(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
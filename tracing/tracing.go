@@ -0,0 +1,272 @@
+// Package tracing records spans timing the work done to serve a request, such
+// as parsing keys and querying the database, and exports them to stdout or an
+// OpenTelemetry collector. Trace context is propagated between services with
+// the W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TraceID identifies every span in a trace
+type TraceID [16]byte
+
+// A SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// IsValid returns false for the all-zeros trace ID, which isn't allowed
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid returns false for the all-zeros span ID, which isn't allowed
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// A SpanKind says whether a span is serving a request, making one, or neither.
+// The values match OpenTelemetry's.
+type SpanKind int
+
+// Kinds of span
+const (
+	Internal SpanKind = 1
+	Server   SpanKind = 2
+	Client   SpanKind = 3
+)
+
+// SpanContext is the part of a span propagated to other services: which trace
+// it's in, its ID, and whether the trace is being recorded
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// A Span times one piece of work. A nil *Span is valid and does nothing, so
+// code can record spans whether or not tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	context  SpanContext
+	parentID SpanID
+	kind     SpanKind
+	start    time.Time
+
+	mu         sync.Mutex
+	name       string
+	attributes map[string]interface{}
+	err        string
+	end        time.Time
+}
+
+// SpanData is a finished span, as given to an Exporter
+type SpanData struct {
+	Name         string
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        string
+}
+
+// SetName replaces the span's name, such as once a request's route is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttribute records key with a string, bool, integer or float value
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed with err
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// Context returns the span's SpanContext, or the zero SpanContext for a nil
+// span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// End records the span as finished and exports it if the trace is sampled.
+// Calling End more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	attributes := make(map[string]interface{}, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes[key] = value
+	}
+	data := &SpanData{
+		Name:         s.name,
+		TraceID:      s.context.TraceID,
+		SpanID:       s.context.SpanID,
+		ParentSpanID: s.parentID,
+		Kind:         s.kind,
+		Start:        s.start,
+		End:          s.end,
+		Attributes:   attributes,
+		Error:        s.err,
+	}
+	s.mu.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+// A Tracer starts spans and sends them to an Exporter when they end
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a Tracer exporting finished spans to exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts a span which is a child of the span in ctx or, failing that, of
+// the remote parent in ctx. Otherwise it starts a new trace. It returns a copy
+// of ctx carrying the new span. A nil Tracer starts nil spans.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:     t,
+		kind:       kind,
+		start:      time.Now(),
+		name:       name,
+		attributes: map[string]interface{}{},
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context = parent.context
+		span.parentID = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(SpanContext); ok {
+		span.context = remote
+		span.parentID = remote.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Shutdown exports any spans still waiting to be sent
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+// StartSpan starts a child of the span in ctx using the same Tracer. If ctx
+// has no span, such as outside a request, it returns ctx and a nil Span.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind)
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+// SpanFromContext returns the span carried by ctx, or nil if there isn't one
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent returns a copy of ctx in which new spans continue the
+// trace of parent, a span in another service
+func ContextWithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentKey{}, parent)
+}
+
+const traceparentHeader = "traceparent"
+
+// Extract reads the span context a caller sent in the traceparent header, as
+// described in https://www.w3.org/TR/trace-context/
+func Extract(header http.Header) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header.Get(traceparentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	var flags [1]byte
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) ||
+		!decodeHex(flags[:], parts[3]) {
+		return SpanContext{}, false
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Inject writes the span context of the span in ctx to header, so a service
+// called with it continues the trace
+func Inject(ctx context.Context, header http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	flags := 0
+	if span.context.Sampled {
+		flags = 1
+	}
+	header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%02x",
+		span.context.TraceID, span.context.SpanID, flags))
+}
+
+// decodeHex decodes lowercase hex s into dst, which it must exactly fill
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}